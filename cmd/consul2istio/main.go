@@ -18,6 +18,7 @@ import (
 	"flag"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"istio.io/pkg/log"
@@ -27,18 +28,141 @@ import (
 	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry/consul"
 )
 
+// secretFlags are the flags whose values are not logged
+var secretFlags = map[string]bool{
+	"consulToken":    true,
+	"consulHTTPAuth": true,
+}
+
 func main() {
 	args := consul.NewConsulBootStrapArgs()
 
 	flag.StringVar(&args.ConsulAddress, "consulAddress", constants.DefaultConsulAddress, "Consul Address")
+	flag.StringVar(&args.Token, "consulToken", "", "The ACL token of Consul")
+	flag.StringVar(&args.TokenFile, "consulTokenFile", "",
+		"The file containing the ACL token of Consul, it's reloaded when it changes")
+	flag.StringVar(&args.CAFile, "consulCAFile", "",
+		"The CA bundle to verify the certificate of Consul, it's reloaded when it changes")
+	flag.StringVar(&args.CertFile, "consulCertFile", "",
+		"The client certificate for mTLS with Consul, it's reloaded when it changes")
+	flag.StringVar(&args.KeyFile, "consulKeyFile", "",
+		"The client key for mTLS with Consul, it's reloaded when it changes")
+	flag.StringVar(&args.TLSServerName, "consulTLSServerName", "",
+		"The server name to verify the certificate of Consul")
+	flag.BoolVar(&args.InsecureSkipVerify, "consulInsecureSkipVerify", false,
+		"Skip the verification of the certificate of Consul")
+	flag.StringVar(&args.HTTPAuth, "consulHTTPAuth", "",
+		"The HTTP basic auth of Consul in the username[:password] format")
 	flag.StringVar(&args.Namespace, "namespace", constants.ConfigRootNS, "namespace")
 	flag.StringVar(&args.FQDN, "fqdn", "", "The FQDN for consul service")
 	flag.BoolVar(&args.EnableDefaultPort, "enableDefaultPort", true,
 		"The flag to start default port for consul service")
+	flag.BoolVar(&args.EnableHealthCheck, "enableHealthCheck", false,
+		"Get service instances from the Consul health API and drop the instances with critical health checks")
+	flag.StringVar(&args.WarningPolicy, "warningPolicy", consul.WarningPolicyInclude,
+		"How to treat instances with warning health checks when enableHealthCheck is set: include or exclude")
+	flag.IntVar(&args.WatchConcurrency, "watchConcurrency", consul.DefaultWatchConcurrency,
+		"The maximum number of concurrent initial fetches of Consul service instances")
+	flag.Var((*stringList)(&args.Datacenters), "datacenters",
+		"Comma separated Consul datacenters to synchronize, * for all datacenters, default to the local datacenter")
+	flag.StringVar(&args.DatacenterMode, "datacenterMode", consul.DatacenterModeMerge,
+		"How to synchronize a service in multiple datacenters: merge into one ServiceEntry, "+
+			"or split into a ServiceEntry with a per-datacenter hostname for each datacenter")
+	flag.Var((*stringList)(&args.ConsulPartitions), "consulPartitions",
+		"Comma separated Consul Enterprise admin partitions to synchronize, * for all partitions")
+	flag.Var((*stringList)(&args.ConsulNamespaces), "consulNamespaces",
+		"Comma separated Consul Enterprise namespaces to synchronize, * for all namespaces")
+	flag.StringVar(&args.NamespaceMode, "namespaceMode", consul.NamespaceModeHostname,
+		"How to map the Consul namespace of a service: hostname includes it in the hostname of the ServiceEntry, "+
+			"kubernetes creates the ServiceEntry in the Kubernetes namespace of the same name")
+
+	flag.Var((*stringList)(&args.TagSeparators), "tagSeparators",
+		"Comma separated separators between the keys and values of the tags converted to labels, default to |")
+	flag.Var((*stringList)(&args.TagPrefixes), "tagPrefixes",
+		"Comma separated prefixes of the tags converted to labels, all the tags are converted if it's empty")
+	flag.BoolVar(&args.StripTagPrefix, "stripTagPrefix", false,
+		"Remove the matched prefix of tagPrefixes from the label keys")
+	flag.Var((*stringList)(&args.MetaLabels), "metaLabels",
+		"Comma separated service meta keys copied to labels, * for all the keys")
+	flag.Var((*stringList)(&args.NodeMetaLabels), "nodeMetaLabels",
+		"Comma separated node meta keys copied to labels, * for all the keys")
+	flag.Var((*repeatedString)(&args.HostTemplates), "hostTemplate",
+		"A Go template of a host of the ServiceEntries, e.g. '{{.Name}}.service.{{.Datacenter}}.consul', "+
+			"repeat the flag for multiple hosts")
+	flag.Var((*stringList)(&args.LocalityRegion), "localityRegion",
+		"Comma separated sources of the locality region of the instances, tried in order: datacenter, locality, "+
+			"node-meta:<key> or service-meta:<key>, default to datacenter")
+	flag.Var((*stringList)(&args.LocalityZone), "localityZone",
+		"Comma separated sources of the locality zone of the instances, tried in order: locality, "+
+			"node-meta:<key> or service-meta:<key>")
+	flag.Var((*stringList)(&args.LocalitySubzone), "localitySubzone",
+		"Comma separated sources of the locality subzone of the instances, tried in order: "+
+			"node-meta:<key> or service-meta:<key>")
+	flag.Var((*stringList)(&args.AddressPreference), "addressPreference",
+		"Comma separated address types of the instances in the order of preference, e.g. lan_ipv4,wan,lan_ipv6, "+
+			"service and node stand for the service and node addresses, default to the service address")
+	flag.StringVar(&args.HostnameResolution, "hostnameResolution", "DNS",
+		"The resolution of the ServiceEntries of the instances with hostname addresses: DNS or DNS_ROUND_ROBIN")
+	flag.StringVar(&args.OverridePrefix, "overridePrefix", "",
+		"The Consul KV prefix of the per-service overrides, <prefix>/<service> holds the JSON override of a service")
+	flag.Var((*stringList)(&args.TagHosts), "tagHosts",
+		"Comma separated tags which get a ServiceEntry on <tag>.<host> of only the instances with the tag, "+
+			"like the tag lookups of Consul DNS")
+	flag.StringVar(&args.IncludeServices, "includeServices", "",
+		"The regular expression of the names of the services to synchronize")
+	flag.StringVar(&args.ExcludeServices, "excludeServices", "",
+		"The regular expression of the names of the services not to synchronize")
+	flag.Var((*stringList)(&args.RequiredTags), "requiredTags",
+		"Comma separated tags a service must have to be synchronized")
+	flag.Var((*stringList)(&args.RequiredMeta), "requiredMeta",
+		"Comma separated key[=value] meta an instance must have to be synchronized")
+	flag.StringVar(&args.Filter, "filter", "",
+		"The Consul filter expression of the instances to synchronize, e.g. 'ServiceMeta.env == prod'")
+	flag.BoolVar(&args.SyncGateways, "syncGateways", false,
+		"Synchronize the mesh, terminating and ingress gateways of Consul Connect as services")
+	flag.BoolVar(&args.ConnectSidecar, "connectSidecar", false,
+		"Point the endpoints of the instances with a Consul Connect sidecar proxy to the sidecar")
+	flag.BoolVar(&args.ConfigEntryProtocols, "configEntryProtocols", false,
+		"Read the protocols of the services without a protocol meta from the service-defaults and proxy-defaults "+
+			"config entries")
+	flag.BoolVar(&args.SyncPreparedQueries, "syncPreparedQueries", false,
+		"Synchronize the prepared queries of the local datacenter as ServiceEntries on <query>.<preparedQueryDomain>")
+	flag.StringVar(&args.PreparedQueryDomain, "preparedQueryDomain", consul.DefaultPreparedQueryDomain,
+		"The domain of the hosts of the prepared queries")
+	flag.DurationVar(&args.PreparedQueryInterval, "preparedQueryInterval", consul.DefaultPreparedQueryInterval,
+		"The interval to execute the prepared queries if the Consul catalog doesn't change")
+	flag.BoolVar(&args.SyncDiscoveryChains, "syncDiscoveryChains", false,
+		"Convert the service-resolver, service-splitter and service-router config entries to DestinationRules and "+
+			"VirtualServices")
+	flag.BoolVar(&args.SyncFailover, "syncFailover", false,
+		"Convert the failovers of the service-resolvers and prepared queries to the locality failover between "+
+			"datacenters in DestinationRules")
+	flag.BoolVar(&args.WorkloadEntries, "workloadEntries", false,
+		"Push a WorkloadEntry for each Consul instance and a ServiceEntry with a workloadSelector, instead of the "+
+			"instances as the endpoints of the ServiceEntry")
+	flag.BoolVar(&args.ExportServices, "exportServices", false,
+		"Register the Kubernetes services in the Consul catalog under a synthetic node")
+	flag.StringVar(&args.ExportNode, "exportNode", consul.DefaultExportNode,
+		"The name of the synthetic Consul node of the exported Kubernetes services")
+	flag.Var((*stringList)(&args.ExportNamespaces), "exportNamespaces",
+		"Comma separated Kubernetes namespaces whose services are exported, default to all but kube-system")
+	flag.BoolVar(&args.SyncIntentions, "syncIntentions", false,
+		"Convert the intentions of Consul Connect to AuthorizationPolicies")
+	flag.BoolVar(&args.IntentionsDryRun, "intentionsDryRun", false,
+		"Log the AuthorizationPolicies converted from the intentions and the intentions which can't be converted, "+
+			"without pushing the AuthorizationPolicies")
+	flag.StringVar(&args.IntentionDefaultAction, "intentionDefaultAction", consul.IntentionActionDeny,
+		"The action on the requests which match no intention, allow or deny like the default ACL policy of Consul")
+	flag.StringVar(&args.IntentionSelectorLabel, "intentionSelectorLabel", consul.DefaultIntentionSelectorLabel,
+		"The label of the workloads whose value is the name of their Consul service")
 
 	flag.Parse()
 
 	flag.VisitAll(func(flag *flag.Flag) {
+		if secretFlags[flag.Name] && flag.Value.String() != "" {
+			log.Infof("consul2istio parameter: %s: <redacted>", flag.Name)
+			return
+		}
 		log.Infof("consul2istio parameter: %s: %v", flag.Name, flag.Value)
 	})
 
@@ -67,8 +191,48 @@ func initArgsWithEnv(args *consul.BootStrapArgs) {
 		args.ConsulAddress = consulAddress
 	}
 
+	// Secrets are better passed with environment variables than with flags
+	consulToken := os.Getenv("consulToken")
+	if consulToken != "" {
+		args.Token = consulToken
+	}
+
+	consulHTTPAuth := os.Getenv("consulHTTPAuth")
+	if consulHTTPAuth != "" {
+		args.HTTPAuth = consulHTTPAuth
+	}
+
 	namespace := os.Getenv("namespace")
 	if namespace != "" {
 		args.Namespace = namespace
 	}
 }
+
+// stringList is a flag value of comma separated strings
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// repeatedString is a flag value of strings which may contain commas, each occurrence of the flag adds a string
+type repeatedString []string
+
+func (l *repeatedString) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *repeatedString) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -15,7 +15,9 @@ require (
 	istio.io/client-go v1.16.4-0.20230518154329-f75cb9ff8e52
 	istio.io/istio v0.0.0-20230519000352-ae8d5164776c
 	istio.io/pkg v0.0.0-20221107183613-574f8d141535
+	k8s.io/api v0.25.2
 	k8s.io/apimachinery v0.25.2
+	k8s.io/client-go v0.25.2
 	sigs.k8s.io/controller-runtime v0.13.0
 )
 
@@ -84,8 +86,6 @@ require (
 	gopkg.in/inf.v0 v0.9.1 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
-	k8s.io/api v0.25.2 // indirect
-	k8s.io/client-go v0.25.2 // indirect
 	k8s.io/klog/v2 v2.80.1 // indirect
 	k8s.io/kube-openapi v0.0.0-20220803164354-a70c9af30aea // indirect
 	k8s.io/utils v0.0.0-20220823124924-e9cbc92d1a73 // indirect
@@ -0,0 +1,364 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+	istio "istio.io/api/networking/v1alpha3"
+	security "istio.io/api/security/v1beta1"
+	"istio.io/client-go/pkg/apis/networking/v1alpha3"
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	versionedclient "istio.io/client-go/pkg/clientset/versioned"
+	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/aeraki-framework/consul2istio/pkg/constants"
+	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry"
+)
+
+// istioConfig is an Istio config resource of any kind in the API server
+type istioConfig struct {
+	v1.ObjectMeta
+	Spec proto.Message
+}
+
+// configClient creates, lists, updates and deletes the Istio config resources of a kind
+type configClient struct {
+	list   func(ic versionedclient.Interface, namespace string, opts v1.ListOptions) ([]*istioConfig, error)
+	create func(ic versionedclient.Interface, config *istioConfig) (*istioConfig, error)
+	update func(ic versionedclient.Interface, config *istioConfig) (*istioConfig, error)
+	delete func(ic versionedclient.Interface, namespace, name string) error
+}
+
+// configClients are the clients of the kinds of Istio configs converted from the registries
+var configClients = map[string]*configClient{
+	"DestinationRule": {
+		list: func(ic versionedclient.Interface, namespace string, opts v1.ListOptions) ([]*istioConfig, error) {
+			list, err := ic.NetworkingV1alpha3().DestinationRules(namespace).List(context.TODO(), opts)
+			if err != nil {
+				return nil, err
+			}
+			configs := make([]*istioConfig, 0, len(list.Items))
+			for _, item := range list.Items {
+				configs = append(configs, &istioConfig{ObjectMeta: item.ObjectMeta, Spec: &item.Spec})
+			}
+			return configs, nil
+		},
+		create: func(ic versionedclient.Interface, config *istioConfig) (*istioConfig, error) {
+			created, err := ic.NetworkingV1alpha3().DestinationRules(config.Namespace).Create(context.TODO(),
+				&v1alpha3.DestinationRule{
+					ObjectMeta: config.ObjectMeta,
+					Spec:       *config.Spec.(*istio.DestinationRule).DeepCopy(),
+				}, v1.CreateOptions{FieldManager: constants.AerakiFieldManager})
+			if err != nil {
+				return nil, err
+			}
+			return &istioConfig{ObjectMeta: created.ObjectMeta, Spec: &created.Spec}, nil
+		},
+		update: func(ic versionedclient.Interface, config *istioConfig) (*istioConfig, error) {
+			updated, err := ic.NetworkingV1alpha3().DestinationRules(config.Namespace).Update(context.TODO(),
+				&v1alpha3.DestinationRule{
+					ObjectMeta: config.ObjectMeta,
+					Spec:       *config.Spec.(*istio.DestinationRule).DeepCopy(),
+				}, v1.UpdateOptions{FieldManager: constants.AerakiFieldManager})
+			if err != nil {
+				return nil, err
+			}
+			return &istioConfig{ObjectMeta: updated.ObjectMeta, Spec: &updated.Spec}, nil
+		},
+		delete: func(ic versionedclient.Interface, namespace, name string) error {
+			return ic.NetworkingV1alpha3().DestinationRules(namespace).Delete(context.TODO(), name,
+				v1.DeleteOptions{})
+		},
+	},
+	"VirtualService": {
+		list: func(ic versionedclient.Interface, namespace string, opts v1.ListOptions) ([]*istioConfig, error) {
+			list, err := ic.NetworkingV1alpha3().VirtualServices(namespace).List(context.TODO(), opts)
+			if err != nil {
+				return nil, err
+			}
+			configs := make([]*istioConfig, 0, len(list.Items))
+			for _, item := range list.Items {
+				configs = append(configs, &istioConfig{ObjectMeta: item.ObjectMeta, Spec: &item.Spec})
+			}
+			return configs, nil
+		},
+		create: func(ic versionedclient.Interface, config *istioConfig) (*istioConfig, error) {
+			created, err := ic.NetworkingV1alpha3().VirtualServices(config.Namespace).Create(context.TODO(),
+				&v1alpha3.VirtualService{
+					ObjectMeta: config.ObjectMeta,
+					Spec:       *config.Spec.(*istio.VirtualService).DeepCopy(),
+				}, v1.CreateOptions{FieldManager: constants.AerakiFieldManager})
+			if err != nil {
+				return nil, err
+			}
+			return &istioConfig{ObjectMeta: created.ObjectMeta, Spec: &created.Spec}, nil
+		},
+		update: func(ic versionedclient.Interface, config *istioConfig) (*istioConfig, error) {
+			updated, err := ic.NetworkingV1alpha3().VirtualServices(config.Namespace).Update(context.TODO(),
+				&v1alpha3.VirtualService{
+					ObjectMeta: config.ObjectMeta,
+					Spec:       *config.Spec.(*istio.VirtualService).DeepCopy(),
+				}, v1.UpdateOptions{FieldManager: constants.AerakiFieldManager})
+			if err != nil {
+				return nil, err
+			}
+			return &istioConfig{ObjectMeta: updated.ObjectMeta, Spec: &updated.Spec}, nil
+		},
+		delete: func(ic versionedclient.Interface, namespace, name string) error {
+			return ic.NetworkingV1alpha3().VirtualServices(namespace).Delete(context.TODO(), name,
+				v1.DeleteOptions{})
+		},
+	},
+	"WorkloadEntry": {
+		list: func(ic versionedclient.Interface, namespace string, opts v1.ListOptions) ([]*istioConfig, error) {
+			list, err := ic.NetworkingV1alpha3().WorkloadEntries(namespace).List(context.TODO(), opts)
+			if err != nil {
+				return nil, err
+			}
+			configs := make([]*istioConfig, 0, len(list.Items))
+			for _, item := range list.Items {
+				configs = append(configs, &istioConfig{ObjectMeta: item.ObjectMeta, Spec: &item.Spec})
+			}
+			return configs, nil
+		},
+		create: func(ic versionedclient.Interface, config *istioConfig) (*istioConfig, error) {
+			created, err := ic.NetworkingV1alpha3().WorkloadEntries(config.Namespace).Create(context.TODO(),
+				&v1alpha3.WorkloadEntry{
+					ObjectMeta: config.ObjectMeta,
+					Spec:       *config.Spec.(*istio.WorkloadEntry).DeepCopy(),
+				}, v1.CreateOptions{FieldManager: constants.AerakiFieldManager})
+			if err != nil {
+				return nil, err
+			}
+			return &istioConfig{ObjectMeta: created.ObjectMeta, Spec: &created.Spec}, nil
+		},
+		update: func(ic versionedclient.Interface, config *istioConfig) (*istioConfig, error) {
+			updated, err := ic.NetworkingV1alpha3().WorkloadEntries(config.Namespace).Update(context.TODO(),
+				&v1alpha3.WorkloadEntry{
+					ObjectMeta: config.ObjectMeta,
+					Spec:       *config.Spec.(*istio.WorkloadEntry).DeepCopy(),
+				}, v1.UpdateOptions{FieldManager: constants.AerakiFieldManager})
+			if err != nil {
+				return nil, err
+			}
+			return &istioConfig{ObjectMeta: updated.ObjectMeta, Spec: &updated.Spec}, nil
+		},
+		delete: func(ic versionedclient.Interface, namespace, name string) error {
+			return ic.NetworkingV1alpha3().WorkloadEntries(namespace).Delete(context.TODO(), name,
+				v1.DeleteOptions{})
+		},
+	},
+	"AuthorizationPolicy": {
+		list: func(ic versionedclient.Interface, namespace string, opts v1.ListOptions) ([]*istioConfig, error) {
+			list, err := ic.SecurityV1beta1().AuthorizationPolicies(namespace).List(context.TODO(), opts)
+			if err != nil {
+				return nil, err
+			}
+			configs := make([]*istioConfig, 0, len(list.Items))
+			for _, item := range list.Items {
+				configs = append(configs, &istioConfig{ObjectMeta: item.ObjectMeta, Spec: &item.Spec})
+			}
+			return configs, nil
+		},
+		create: func(ic versionedclient.Interface, config *istioConfig) (*istioConfig, error) {
+			created, err := ic.SecurityV1beta1().AuthorizationPolicies(config.Namespace).Create(context.TODO(),
+				&securityv1beta1.AuthorizationPolicy{
+					ObjectMeta: config.ObjectMeta,
+					Spec:       *config.Spec.(*security.AuthorizationPolicy).DeepCopy(),
+				}, v1.CreateOptions{FieldManager: constants.AerakiFieldManager})
+			if err != nil {
+				return nil, err
+			}
+			return &istioConfig{ObjectMeta: created.ObjectMeta, Spec: &created.Spec}, nil
+		},
+		update: func(ic versionedclient.Interface, config *istioConfig) (*istioConfig, error) {
+			updated, err := ic.SecurityV1beta1().AuthorizationPolicies(config.Namespace).Update(context.TODO(),
+				&securityv1beta1.AuthorizationPolicy{
+					ObjectMeta: config.ObjectMeta,
+					Spec:       *config.Spec.(*security.AuthorizationPolicy).DeepCopy(),
+				}, v1.UpdateOptions{FieldManager: constants.AerakiFieldManager})
+			if err != nil {
+				return nil, err
+			}
+			return &istioConfig{ObjectMeta: updated.ObjectMeta, Spec: &updated.Spec}, nil
+		},
+		delete: func(ic versionedclient.Interface, namespace, name string) error {
+			return ic.SecurityV1beta1().AuthorizationPolicies(namespace).Delete(context.TODO(), name,
+				v1.DeleteOptions{})
+		},
+	},
+}
+
+// pushConfigs2APIServer synchronizes all the Istio configs converted from the registries, other than the
+// ServiceEntries, to the API server
+func (s *Controller) pushConfigs2APIServer() error {
+	kinds := make(map[string]bool)
+	configs := make(map[string][]*serviceregistry.ConfigWrapper)
+	for _, store := range s.configStores {
+		for _, kind := range store.Kinds() {
+			kinds[kind] = true
+		}
+		storeConfigs, err := store.Configs()
+		if err != nil {
+			return fmt.Errorf("failed to get configs from consul: %v", err)
+		}
+		for _, config := range storeConfigs {
+			configs[config.Kind()] = append(configs[config.Kind()], config)
+		}
+	}
+	if len(kinds) == 0 {
+		return nil
+	}
+
+	ic, err := s.getIstioClient()
+	if err != nil {
+		return err
+	}
+
+	sortedKinds := make([]string, 0, len(kinds))
+	for kind := range kinds {
+		sortedKinds = append(sortedKinds, kind)
+	}
+	sort.Strings(sortedKinds)
+	var pushErr error
+	for _, kind := range sortedKinds {
+		client, ok := configClients[kind]
+		if !ok {
+			pushErr = fmt.Errorf("unsupported config kind %s", kind)
+			continue
+		}
+		if err := s.reconcileConfigs(ic, kind, client, configs[kind]); err != nil {
+			pushErr = err
+		}
+	}
+	return pushErr
+}
+
+// reconcileConfigs creates, updates or deletes the Istio configs of a kind in the API server to make them identical
+// to the new ones
+func (s *Controller) reconcileConfigs(ic versionedclient.Interface, kind string, client *configClient,
+	newConfigs []*serviceregistry.ConfigWrapper) error {
+	existingConfigs, err := client.list(ic, s.listNamespace(), v1.ListOptions{
+		LabelSelector: "manager=" + constants.AerakiFieldManager + ", registry=consul",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list %ss: %v", kind, err)
+	}
+	oldConfigs := make(map[string]*istioConfig, len(existingConfigs))
+	for _, oldConfig := range existingConfigs {
+		oldConfigs[resourceKey(oldConfig.Namespace, oldConfig.Name)] = oldConfig
+	}
+	_, err = s.applyConfigs(ic, kind, client, oldConfigs, newConfigs)
+	return err
+}
+
+// applyConfigs creates, updates or deletes the Istio configs of a kind in the API server to make the old ones
+// identical to the new ones, and returns the configs in the API server after the reconciliation
+func (s *Controller) applyConfigs(ic versionedclient.Interface, kind string, client *configClient,
+	oldConfigs map[string]*istioConfig, newConfigs []*serviceregistry.ConfigWrapper) (map[string]*istioConfig, error) {
+	var err error
+	pushed := make(map[string]*istioConfig, len(newConfigs))
+
+	newKeys := make(map[string]bool, len(newConfigs))
+	for _, newConfig := range newConfigs {
+		newKeys[resourceKey(s.configNamespace(newConfig), newConfig.Name)] = true
+	}
+	for key, oldConfig := range oldConfigs {
+		if newKeys[key] {
+			continue
+		}
+		log.Infof("Deleting %s: %s", kind, key)
+		if deleteErr := client.delete(ic, oldConfig.Namespace, oldConfig.Name); deleteErr != nil &&
+			!errors.IsNotFound(deleteErr) {
+			err = fmt.Errorf("failed to delete %s: %w", kind, deleteErr)
+			pushed[key] = oldConfig
+		}
+	}
+
+	for _, newConfig := range newConfigs {
+		newCRD := toIstioConfig(newConfig, s.configNamespace(newConfig))
+		key := resourceKey(newCRD.Namespace, newCRD.Name)
+		oldConfig, ok := oldConfigs[key]
+		if !ok {
+			log.Infof("Creating %s: %v", kind, newConfig.Spec)
+			created, createErr := client.create(ic, newCRD)
+			if createErr != nil {
+				err = fmt.Errorf("failed to create %s: %w", kind, createErr)
+				continue
+			}
+			pushed[key] = created
+			continue
+		}
+
+		if proto.Equal(newConfig.Spec, oldConfig.Spec) &&
+			managedMapsEqual(oldConfig.Labels, newCRD.Labels) &&
+			managedMapsEqual(oldConfig.Annotations, newCRD.Annotations) {
+			log.Debugf("%s: %s unchanged", kind, key)
+			pushed[key] = oldConfig
+			continue
+		}
+		log.Infof("Updating %s: %v", kind, newConfig.Spec)
+		newCRD.ResourceVersion = oldConfig.ResourceVersion
+		newCRD.Labels = withUnmanaged(newCRD.Labels, oldConfig.Labels)
+		newCRD.Annotations = withUnmanaged(newCRD.Annotations, oldConfig.Annotations)
+		updated, updateErr := client.update(ic, newCRD)
+		if updateErr != nil {
+			err = fmt.Errorf("failed to update %s: %w", kind, updateErr)
+			pushed[key] = oldConfig
+			continue
+		}
+		pushed[key] = updated
+	}
+	return pushed, err
+}
+
+// configNamespace returns the namespace to create an Istio config in
+func (s *Controller) configNamespace(config *serviceregistry.ConfigWrapper) string {
+	if config.Namespace != "" {
+		return config.Namespace
+	}
+	return s.namespace
+}
+
+func toIstioConfig(new *serviceregistry.ConfigWrapper, namespace string) *istioConfig {
+	labels := map[string]string{
+		"manager":  constants.AerakiFieldManager,
+		"registry": constants.RegistryConsul,
+	}
+	for k, v := range new.Labels {
+		labels[k] = v
+	}
+	annotations := map[string]string{
+		constants.ConsulServiceAnnotation: new.Service,
+	}
+	for k, v := range new.Annotations {
+		annotations[k] = v
+	}
+	return &istioConfig{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        new.Name,
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: new.Spec,
+	}
+}
@@ -20,9 +20,48 @@ const (
 	// Defaults to 10 seconds. If events keep showing up with no break for this time, we'll trigger a push.
 	DebounceMax = 10 * time.Second
 
+	// RetryBackoffMax caps the delay between the retries of a failed push, the delay starts at DebounceAfter and
+	// doubles after each failure.
+	RetryBackoffMax = 5 * time.Minute
+
 	// AerakiFieldManager is the FileldManager for Aeraki CRDs
 	AerakiFieldManager = "Aeraki"
 
 	// RegistryConsul is the registry category for Aeraki
 	RegistryConsul = "consul"
+
+	// ManagedKeyPrefix prefixes the labels and annotations managed by consul2istio, besides the manager and registry
+	// labels
+	ManagedKeyPrefix = "consul.aeraki.net/"
+
+	// ConsulServiceAnnotation records the name of the Consul service which a resource is converted from
+	ConsulServiceAnnotation = "consul.aeraki.net/service"
+
+	// ExternalConflictAnnotation records why the instances of a Consul service have been split into internal and
+	// external ServiceEntries
+	ExternalConflictAnnotation = "consul.aeraki.net/external-conflict"
+
+	// AddressConflictAnnotation records why the instances of a Consul service have been split into ServiceEntries
+	// with IP addresses and hostnames
+	AddressConflictAnnotation = "consul.aeraki.net/address-conflict"
+
+	// ConsulTagAnnotation records the Consul tag of the instances in a tag-scoped ServiceEntry
+	ConsulTagAnnotation = "consul.aeraki.net/tag"
+
+	// ConsulNamespaceLabel records the Consul Enterprise namespace which a resource is converted from
+	ConsulNamespaceLabel = "consul.aeraki.net/namespace"
+
+	// ConsulPartitionLabel records the Consul Enterprise admin partition which a resource is converted from
+	ConsulPartitionLabel = "consul.aeraki.net/partition"
+
+	// WorkloadSelectorLabel selects the WorkloadEntries of the instances of a ServiceEntry, its value is derived from
+	// the name of the ServiceEntry
+	WorkloadSelectorLabel = "consul.aeraki.net/service-entry"
+
+	// ExportAnnotation opts a Kubernetes Service out of the export to Consul with the value "false"
+	ExportAnnotation = "consul.aeraki.net/export"
+
+	// ExportServiceAnnotation is the name of the Consul service which a Kubernetes Service is exported as, it
+	// defaults to the name of the Kubernetes Service
+	ExportServiceAnnotation = "consul.aeraki.net/export-service"
 )
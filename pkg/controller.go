@@ -19,14 +19,16 @@ package pkg
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"google.golang.org/protobuf/proto"
-	istio "istio.io/api/networking/v1alpha3"
 	"istio.io/client-go/pkg/apis/networking/v1alpha3"
 	versionedclient "istio.io/client-go/pkg/clientset/versioned"
 	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 
 	"github.com/aeraki-framework/consul2istio/pkg/constants"
@@ -34,33 +36,38 @@ import (
 	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry/consul"
 )
 
-type changeEvent struct{}
-
 // Controller represents Consul service registry
 type Controller struct {
-	consulAddress     string
-	namespace         string
-	fqdn              string
-	enableDefaultPort bool
-	pushChannel       chan *changeEvent
-	registry          serviceregistry.Registry
+	args        *consul.BootStrapArgs
+	namespace   string
+	pushChannel chan serviceregistry.ServiceEvent
+	registry    serviceregistry.Registry
+	istioClient versionedclient.Interface
+	// serviceEntries caches the ServiceEntries pushed to the API server, keyed by the Consul service and then by
+	// namespace/name
+	serviceEntries map[string]map[string]*v1alpha3.ServiceEntry
+	// configStores convert the configs of Consul other than the services, configChannel receives their changes
+	configStores  []serviceregistry.ConfigStore
+	configChannel chan struct{}
+	// workloadEntries caches the WorkloadEntries pushed to the API server like serviceEntries
+	workloadEntries map[string]map[string]*istioConfig
 }
 
 // NewController creates Consul Controller
 func NewController(args *consul.BootStrapArgs) *Controller {
 	controller := &Controller{
-		consulAddress:     args.ConsulAddress,
-		fqdn:              args.FQDN,
-		namespace:         args.Namespace,
-		enableDefaultPort: args.EnableDefaultPort,
-		pushChannel:       make(chan *changeEvent),
+		args:           args,
+		namespace:      args.Namespace,
+		pushChannel:    make(chan serviceregistry.ServiceEvent),
+		configChannel:  make(chan struct{}),
+		serviceEntries: make(map[string]map[string]*v1alpha3.ServiceEntry),
 	}
 	return controller
 }
 
 // Run until a signal is received, this function won't block
 func (s *Controller) Run(stop <-chan struct{}) error {
-	log.Infof("Watch Consul at %s", s.consulAddress)
+	log.Infof("Watch Consul at %s", s.args.ConsulAddress)
 	if err := s.watchRegistry(stop); err != nil {
 		log.Errorf(err)
 		return err
@@ -72,31 +79,95 @@ func (s *Controller) Run(stop <-chan struct{}) error {
 }
 
 func (s *Controller) watchRegistry(stop <-chan struct{}) error {
-	var err error
-	s.registry, err = consul.NewController(s.consulAddress, s.fqdn, s.enableDefaultPort)
+	registry, err := consul.NewController(s.args)
 	if err != nil {
 		return err
 	}
+	s.registry = registry
+	// queryRules are the DestinationRules of the prepared queries, which are run by the registry
+	var queryRules serviceregistry.ConfigStore
+	if s.args.SyncPreparedQueries {
+		queries, err := consul.NewPreparedQueryController(s.args)
+		if err != nil {
+			return err
+		}
+		s.registry = serviceregistry.NewAggregate(registry, queries)
+		if s.args.SyncFailover {
+			queries.AppendConfigChangeHandler(func() {
+				s.configChannel <- struct{}{}
+			})
+			queryRules = queries
+		}
+	}
 
-	s.registry.AppendServiceChangeHandler(func() {
-		s.pushChannel <- &changeEvent{}
+	s.registry.AppendServiceChangeHandler(func(event serviceregistry.ServiceEvent) {
+		s.pushChannel <- event
 	})
 	// todo gracefully close the registry controller
 	s.registry.Run(stop)
+
+	if s.args.SyncDiscoveryChains {
+		chains, err := consul.NewDiscoveryChainController(s.args)
+		if err != nil {
+			return err
+		}
+		s.configStores = append(s.configStores, chains)
+	}
+	if s.args.SyncIntentions {
+		intentions, err := consul.NewIntentionController(s.args)
+		if err != nil {
+			return err
+		}
+		s.configStores = append(s.configStores, intentions)
+	}
+	for _, store := range s.configStores {
+		store.AppendConfigChangeHandler(func() {
+			s.configChannel <- struct{}{}
+		})
+		store.Run(stop)
+	}
+	if queryRules != nil {
+		s.configStores = append(s.configStores, queryRules)
+	}
+
+	if s.args.ExportServices {
+		restConfig, err := config.GetConfig()
+		if err != nil {
+			return fmt.Errorf("can not get kubernetes config: %v", err)
+		}
+		kubeClient, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			return fmt.Errorf("failed to create kubernetes client: %v", err)
+		}
+		export, err := consul.NewExportController(s.args, kubeClient)
+		if err != nil {
+			return err
+		}
+		export.Run(stop)
+	}
 	return nil
 }
 
 func (s *Controller) mainLoop(stop <-chan struct{}) {
-	var timeChan <-chan time.Time
 	var startDebounce time.Time
 	var lastResourceUpdateTime time.Time
 	pushCounter := 0
 	debouncedEvents := 0
+	// changedServices collects the services changed since the last push
+	changedServices := make(map[string]serviceregistry.EventType)
+	// configChanged tells whether the Istio configs other than the ServiceEntries changed since the last push
+	configChanged := false
+	// Synchronize all the services at startup to clean up the stale ServiceEntries
+	fullSync := true
+	timeChan := time.After(constants.DebounceAfter)
+	// retryDelay is the backoff of a failed push, the changes of a failed push are kept and retried at retryAt
+	var retryDelay time.Duration
+	var retryAt time.Time
 
 	for {
 		select {
 		case <-stop:
-			break
+			return
 		case e := <-s.pushChannel:
 			log.Debugf("Receive event from push chanel : %v", e)
 			lastResourceUpdateTime = time.Now()
@@ -106,23 +177,57 @@ func (s *Controller) mainLoop(stop <-chan struct{}) {
 			}
 			timeChan = time.After(constants.DebounceAfter)
 			debouncedEvents++
+			changedServices[e.Service] = e.Type
+		case <-s.configChannel:
+			log.Debugf("Receive event from config channel")
+			lastResourceUpdateTime = time.Now()
+			if debouncedEvents == 0 {
+				startDebounce = lastResourceUpdateTime
+			}
+			timeChan = time.After(constants.DebounceAfter)
+			debouncedEvents++
+			configChanged = true
 		case <-timeChan:
 			log.Debugf("Receive event from time chanel")
+			if wait := time.Until(retryAt); wait > 0 {
+				timeChan = time.After(wait)
+				continue
+			}
 			eventDelay := time.Since(startDebounce)
 			quietTime := time.Since(lastResourceUpdateTime)
 			// it has been too long since the first debounced event or quiet enough since the last debounced event
 			if eventDelay >= constants.DebounceMax || quietTime >= constants.DebounceAfter {
-				if debouncedEvents > 0 {
+				if debouncedEvents > 0 || fullSync || retryDelay > 0 {
 					pushCounter++
 					log.Infof("Push debounce stable[%d] %d: %v since last change, %v since last push",
 						pushCounter, debouncedEvents, quietTime, eventDelay)
-					err := s.pushConsulService2APIServer()
-					if err != nil {
-						log.Errorf("Failed to synchronize consul services to Istio: %v", err)
-						// Retry if failed
-						s.pushChannel <- &changeEvent{}
+					var err, configErr error
+					if fullSync {
+						err = s.pushConsulService2APIServer()
+					} else {
+						err = s.pushChangedServices2APIServer(changedServices)
+					}
+					if fullSync || configChanged {
+						configErr = s.pushConfigs2APIServer()
 					}
 					debouncedEvents = 0
+					if err != nil || configErr != nil {
+						retryDelay = nextRetryDelay(retryDelay)
+						retryAt = time.Now().Add(retryDelay)
+						log.Errorf("Failed to synchronize consul services to Istio, retrying in %v: %v %v",
+							retryDelay, err, configErr)
+						// Only a full synchronization fixes a cache which is out of date, the other failures retry
+						// the same changes
+						if isStaleCacheError(err) || isStaleCacheError(configErr) {
+							fullSync = true
+						}
+						timeChan = time.After(retryDelay)
+					} else {
+						retryDelay = 0
+						fullSync = false
+						configChanged = false
+						changedServices = make(map[string]serviceregistry.EventType)
+					}
 				}
 			} else {
 				timeChan = time.After(constants.DebounceAfter - quietTime)
@@ -131,81 +236,270 @@ func (s *Controller) mainLoop(stop <-chan struct{}) {
 	}
 }
 
-func (s *Controller) pushConsulService2APIServer() error {
-	serviceEntries, err := s.registry.ServiceEntries()
-	if err != nil {
-		return fmt.Errorf("failed to get servcies from consul: %v", err)
+// nextRetryDelay doubles the delay before retrying a failed push, from DebounceAfter up to RetryBackoffMax
+func nextRetryDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return constants.DebounceAfter
 	}
+	if delay *= 2; delay > constants.RetryBackoffMax {
+		return constants.RetryBackoffMax
+	}
+	return delay
+}
+
+// isStaleCacheError tells whether a push failed because the cached Istio configs are out of date
+func isStaleCacheError(err error) bool {
+	return err != nil && (errors.IsConflict(err) || errors.IsAlreadyExists(err) || errors.IsNotFound(err))
+}
 
-	newServiceEntries := make(map[string]*istio.ServiceEntry)
-	for _, serviceEntry := range serviceEntries {
-		newServiceEntries[serviceEntry.Hosts[0]] = serviceEntry
+func (s *Controller) getIstioClient() (versionedclient.Interface, error) {
+	if s.istioClient != nil {
+		return s.istioClient, nil
 	}
 
 	config, err := config.GetConfig()
 	if err != nil {
-		return fmt.Errorf("can not get kubernetes config: %v", err)
+		return nil, fmt.Errorf("can not get kubernetes config: %v", err)
 	}
 
 	ic, err := versionedclient.NewForConfig(config)
 	if err != nil {
-		return fmt.Errorf("failed to create istio client: %v", err)
+		return nil, fmt.Errorf("failed to create istio client: %v", err)
 	}
+	s.istioClient = ic
+	return ic, nil
+}
 
-	existingServiceEntries, _ := ic.NetworkingV1alpha3().ServiceEntries(s.namespace).List(context.TODO(), v1.ListOptions{
-		LabelSelector: "manager=" + constants.AerakiFieldManager + ", registry=consul",
-	})
+// pushConsulService2APIServer synchronizes all the consul services to the API server
+func (s *Controller) pushConsulService2APIServer() error {
+	serviceEntries, err := s.registry.ServiceEntries()
+	if err != nil {
+		return fmt.Errorf("failed to get servcies from consul: %v", err)
+	}
+	// The WorkloadEntries are pushed first, so the ServiceEntries never select missing instances
+	var workloadEntryErr error
+	if s.args.WorkloadEntries {
+		var workloadEntries []*serviceregistry.ConfigWrapper
+		serviceEntries, workloadEntries = splitWorkloadEntries(serviceEntries)
+		workloadEntryErr = s.pushWorkloadEntries(workloadEntries)
+	}
+
+	ic, err := s.getIstioClient()
+	if err != nil {
+		return err
+	}
 
+	existingServiceEntries, err := ic.NetworkingV1alpha3().ServiceEntries(s.listNamespace()).List(context.TODO(),
+		v1.ListOptions{
+			LabelSelector: "manager=" + constants.AerakiFieldManager + ", registry=consul",
+		})
+	if err != nil {
+		return fmt.Errorf("failed to list ServiceEntries: %v", err)
+	}
+	oldServiceEntries := make(map[string]*v1alpha3.ServiceEntry, len(existingServiceEntries.Items))
 	for _, oldServiceEntry := range existingServiceEntries.Items {
-		if newServiceEntry, ok := newServiceEntries[oldServiceEntry.Spec.Hosts[0]]; !ok {
-			log.Infof("Deleting EnvoyFilter: %s", oldServiceEntry.Name)
-			err = ic.NetworkingV1alpha3().ServiceEntries(s.namespace).Delete(context.TODO(), oldServiceEntry.Spec.Hosts[0],
-				v1.DeleteOptions{})
+		oldServiceEntries[resourceKey(oldServiceEntry.Namespace, oldServiceEntry.Name)] = oldServiceEntry
+	}
+
+	pushed, err := s.reconcileServiceEntries(ic, oldServiceEntries, serviceEntries)
+	s.serviceEntries = make(map[string]map[string]*v1alpha3.ServiceEntry)
+	for key, serviceEntry := range pushed {
+		service := serviceEntry.Annotations[constants.ConsulServiceAnnotation]
+		if s.serviceEntries[service] == nil {
+			s.serviceEntries[service] = make(map[string]*v1alpha3.ServiceEntry)
+		}
+		s.serviceEntries[service][key] = serviceEntry
+	}
+	if err == nil {
+		err = workloadEntryErr
+	}
+	return err
+}
+
+// pushChangedServices2APIServer synchronizes the changed consul services to the API server,
+// the ServiceEntries of the other services are left untouched
+func (s *Controller) pushChangedServices2APIServer(changedServices map[string]serviceregistry.EventType) error {
+	ic, err := s.getIstioClient()
+	if err != nil {
+		return err
+	}
+
+	var pushErr error
+	for service, eventType := range changedServices {
+		log.Infof("Pushing ServiceEntries of consul service %s, event: %s", service, eventType)
+		serviceEntries := make([]*serviceregistry.ServiceEntryWrapper, 0)
+		if eventType != serviceregistry.EventDelete {
+			serviceEntries, err = s.registry.ServiceEntriesOf(service)
 			if err != nil {
-				err = fmt.Errorf("failed to create istio client: %v", err)
+				return fmt.Errorf("failed to get service %s from consul: %v", service, err)
 			}
-		} else {
-			if !proto.Equal(newServiceEntry, &oldServiceEntry.Spec) {
-				log.Infof("Updating ServiceEntry: %v", newServiceEntry)
-				_, err = ic.NetworkingV1alpha3().ServiceEntries(s.namespace).Update(context.TODO(),
-					toServiceEntryCRD(newServiceEntry, oldServiceEntry),
-					v1.UpdateOptions{FieldManager: constants.AerakiFieldManager})
-				if err != nil {
-					err = fmt.Errorf("failed to update ServiceEntry: %v", err)
-				}
-			} else {
-				log.Infof("ServiceEntry: %s unchanged", oldServiceEntry.Name)
+		}
+		if s.args.WorkloadEntries {
+			var workloadEntries []*serviceregistry.ConfigWrapper
+			serviceEntries, workloadEntries = splitWorkloadEntries(serviceEntries)
+			if err := s.pushServiceWorkloadEntries(service, workloadEntries); err != nil {
+				pushErr = err
 			}
-			delete(newServiceEntries, newServiceEntry.Hosts[0])
+		}
+
+		pushed, err := s.reconcileServiceEntries(ic, s.serviceEntries[service], serviceEntries)
+		if err != nil {
+			pushErr = err
+		}
+		if len(pushed) == 0 {
+			delete(s.serviceEntries, service)
+		} else {
+			s.serviceEntries[service] = pushed
 		}
 	}
+	return pushErr
+}
 
+// reconcileServiceEntries creates, updates or deletes the ServiceEntries in the API server to make the old ones
+// identical to the new ones, and returns the ServiceEntries in the API server after the reconciliation
+func (s *Controller) reconcileServiceEntries(ic versionedclient.Interface,
+	oldServiceEntries map[string]*v1alpha3.ServiceEntry,
+	newServiceEntries []*serviceregistry.ServiceEntryWrapper) (map[string]*v1alpha3.ServiceEntry, error) {
+	var err error
+	pushed := make(map[string]*v1alpha3.ServiceEntry, len(newServiceEntries))
+
+	newKeys := make(map[string]bool, len(newServiceEntries))
 	for _, newServiceEntry := range newServiceEntries {
-		_, err = ic.NetworkingV1alpha3().ServiceEntries(s.namespace).Create(context.TODO(),
-			toServiceEntryCRD(newServiceEntry, nil),
-			v1.CreateOptions{FieldManager: constants.AerakiFieldManager})
-		log.Infof("Creating ServiceEntry: %v", newServiceEntry)
-		if err != nil {
-			err = fmt.Errorf("failed to create ServiceEntry: %v", err)
+		newKeys[resourceKey(s.namespaceOf(newServiceEntry), newServiceEntry.Name)] = true
+	}
+	for key, oldServiceEntry := range oldServiceEntries {
+		if newKeys[key] {
+			continue
+		}
+		log.Infof("Deleting ServiceEntry: %s", key)
+		if deleteErr := ic.NetworkingV1alpha3().ServiceEntries(oldServiceEntry.Namespace).Delete(context.TODO(),
+			oldServiceEntry.Name, v1.DeleteOptions{}); deleteErr != nil && !errors.IsNotFound(deleteErr) {
+			err = fmt.Errorf("failed to delete ServiceEntry: %w", deleteErr)
+			pushed[key] = oldServiceEntry
 		}
 	}
-	return err
+
+	for _, newServiceEntry := range newServiceEntries {
+		namespace := s.namespaceOf(newServiceEntry)
+		key := resourceKey(namespace, newServiceEntry.Name)
+		newCRD := toServiceEntryCRD(newServiceEntry, namespace, nil)
+		oldServiceEntry, ok := oldServiceEntries[key]
+		if !ok {
+			log.Infof("Creating ServiceEntry: %v", newServiceEntry.Spec)
+			created, createErr := ic.NetworkingV1alpha3().ServiceEntries(namespace).Create(context.TODO(), newCRD,
+				v1.CreateOptions{FieldManager: constants.AerakiFieldManager})
+			if createErr != nil {
+				err = fmt.Errorf("failed to create ServiceEntry: %w", createErr)
+				continue
+			}
+			pushed[key] = created
+			continue
+		}
+
+		if proto.Equal(newServiceEntry.Spec, &oldServiceEntry.Spec) &&
+			managedMapsEqual(oldServiceEntry.Labels, newCRD.Labels) &&
+			managedMapsEqual(oldServiceEntry.Annotations, newCRD.Annotations) {
+			log.Debugf("ServiceEntry: %s unchanged", key)
+			pushed[key] = oldServiceEntry
+			continue
+		}
+		log.Infof("Updating ServiceEntry: %v", newServiceEntry.Spec)
+		updated, updateErr := ic.NetworkingV1alpha3().ServiceEntries(namespace).Update(context.TODO(),
+			toServiceEntryCRD(newServiceEntry, namespace, oldServiceEntry),
+			v1.UpdateOptions{FieldManager: constants.AerakiFieldManager})
+		if updateErr != nil {
+			err = fmt.Errorf("failed to update ServiceEntry: %w", updateErr)
+			pushed[key] = oldServiceEntry
+			continue
+		}
+		pushed[key] = updated
+	}
+	return pushed, err
+}
+
+// listNamespace returns the namespace to list the resources pushed to the API server in
+func (s *Controller) listNamespace() string {
+	// The resources may be spread over the namespaces named after the Consul namespaces, or over the
+	// namespaces set by the overrides
+	if s.args.NamespaceMode == consul.NamespaceModeKubernetes || s.args.OverridePrefix != "" {
+		return v1.NamespaceAll
+	}
+	return s.namespace
+}
+
+// namespaceOf returns the namespace to create a ServiceEntry in
+func (s *Controller) namespaceOf(serviceEntry *serviceregistry.ServiceEntryWrapper) string {
+	if serviceEntry.Namespace != "" {
+		return serviceEntry.Namespace
+	}
+	return s.namespace
+}
+
+// resourceKey identifies a resource across namespaces
+func resourceKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// isManagedKey tells whether a label or annotation is managed by consul2istio, the other ones may be added by
+// kubectl or other controllers and are left untouched
+func isManagedKey(key string) bool {
+	return key == "manager" || key == "registry" || strings.HasPrefix(key, constants.ManagedKeyPrefix)
 }
 
-func toServiceEntryCRD(new *istio.ServiceEntry, old *v1alpha3.ServiceEntry) *v1alpha3.ServiceEntry {
+// managedMapsEqual tells whether the labels or annotations managed by consul2istio in a resource are the new ones
+func managedMapsEqual(old, new map[string]string) bool {
+	for k, v := range new {
+		if oldValue, ok := old[k]; !ok || oldValue != v {
+			return false
+		}
+	}
+	for k := range old {
+		if _, ok := new[k]; !ok && isManagedKey(k) {
+			return false
+		}
+	}
+	return true
+}
+
+// withUnmanaged adds the labels or annotations of a resource which are not managed by consul2istio to the new ones,
+// so that an update keeps them
+func withUnmanaged(new, old map[string]string) map[string]string {
+	for k, v := range old {
+		if _, ok := new[k]; !ok && !isManagedKey(k) {
+			new[k] = v
+		}
+	}
+	return new
+}
+
+func toServiceEntryCRD(new *serviceregistry.ServiceEntryWrapper, namespace string,
+	old *v1alpha3.ServiceEntry) *v1alpha3.ServiceEntry {
+	labels := map[string]string{
+		"manager":  constants.AerakiFieldManager,
+		"registry": constants.RegistryConsul,
+	}
+	for k, v := range new.Labels {
+		labels[k] = v
+	}
+	annotations := map[string]string{
+		constants.ConsulServiceAnnotation: new.Service,
+	}
+	for k, v := range new.Annotations {
+		annotations[k] = v
+	}
 	serviceEntry := v1alpha3.ServiceEntry{
 		ObjectMeta: v1.ObjectMeta{
-			Name: new.Hosts[0],
-			//Namespace: configRootNS,
-			Labels: map[string]string{
-				"manager":  constants.AerakiFieldManager,
-				"registry": constants.RegistryConsul,
-			},
+			Name:        new.Name,
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: annotations,
 		},
-		Spec: *new.DeepCopy(),
+		Spec: *new.Spec.DeepCopy(),
 	}
 	if old != nil {
 		serviceEntry.ResourceVersion = old.ResourceVersion
+		serviceEntry.Labels = withUnmanaged(serviceEntry.Labels, old.Labels)
+		serviceEntry.Annotations = withUnmanaged(serviceEntry.Annotations, old.Annotations)
 	}
 	return &serviceEntry
 }
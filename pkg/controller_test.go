@@ -0,0 +1,90 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/aeraki-framework/consul2istio/pkg/constants"
+)
+
+func TestManagedMapsEqual(t *testing.T) {
+	managed := map[string]string{"manager": "Aeraki", constants.ConsulServiceAnnotation: "reviews"}
+	tests := []struct {
+		name string
+		old  map[string]string
+		want bool
+	}{
+		{"same", map[string]string{"manager": "Aeraki", constants.ConsulServiceAnnotation: "reviews"}, true},
+		{"foreign key", map[string]string{"manager": "Aeraki", constants.ConsulServiceAnnotation: "reviews",
+			"kubectl.kubernetes.io/last-applied-configuration": "{}"}, true},
+		{"changed value", map[string]string{"manager": "Aeraki", constants.ConsulServiceAnnotation: "ratings"}, false},
+		{"missing key", map[string]string{"manager": "Aeraki"}, false},
+		{"stale managed key", map[string]string{"manager": "Aeraki", constants.ConsulServiceAnnotation: "reviews",
+			constants.ExternalConflictAnnotation: "true"}, false},
+	}
+	for _, tt := range tests {
+		if got := managedMapsEqual(tt.old, managed); got != tt.want {
+			t.Errorf("%s: managedMapsEqual(%v, %v) => %v, want %v", tt.name, tt.old, managed, got, tt.want)
+		}
+	}
+
+	merged := withUnmanaged(map[string]string{"manager": "Aeraki"},
+		map[string]string{"manager": "other", "team": "a", constants.ConsulTagAnnotation: "v1"})
+	if len(merged) != 2 || merged["manager"] != "Aeraki" || merged["team"] != "a" {
+		t.Errorf("withUnmanaged() => %v, want the foreign labels only", merged)
+	}
+}
+
+func TestNextRetryDelay(t *testing.T) {
+	var delay time.Duration
+	for _, want := range []time.Duration{constants.DebounceAfter, 2 * constants.DebounceAfter,
+		4 * constants.DebounceAfter} {
+		if delay = nextRetryDelay(delay); delay != want {
+			t.Errorf("nextRetryDelay() => %v, want %v", delay, want)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		delay = nextRetryDelay(delay)
+	}
+	if delay != constants.RetryBackoffMax {
+		t.Errorf("nextRetryDelay() => %v, want it capped at %v", delay, constants.RetryBackoffMax)
+	}
+}
+
+func TestIsStaleCacheError(t *testing.T) {
+	resource := schema.GroupResource{Group: "networking.istio.io", Resource: "serviceentries"}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{fmt.Errorf("failed to update ServiceEntry: %w", errors.NewConflict(resource, "reviews", nil)), true},
+		{fmt.Errorf("failed to create ServiceEntry: %w", errors.NewAlreadyExists(resource, "reviews")), true},
+		{fmt.Errorf("failed to update ServiceEntry: %w", errors.NewNotFound(resource, "reviews")), true},
+		{fmt.Errorf("failed to create ServiceEntry: %w", errors.NewForbidden(resource, "reviews", nil)), false},
+		{fmt.Errorf("failed to create ServiceEntry: %w", errors.NewBadRequest("invalid resolution")), false},
+	}
+	for _, tt := range tests {
+		if got := isStaleCacheError(tt.err); got != tt.want {
+			t.Errorf("isStaleCacheError(%v) => %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serviceregistry
+
+// aggregate combines several registries into one, the names of the services must be unique across the registries
+type aggregate struct {
+	registries []Registry
+}
+
+// NewAggregate creates a registry which combines the services of the registries
+func NewAggregate(registries ...Registry) Registry {
+	return &aggregate{registries: registries}
+}
+
+// AppendServiceChangeHandler appends the handler to all the registries
+func (a *aggregate) AppendServiceChangeHandler(serviceChanged func(event ServiceEvent)) {
+	for _, registry := range a.registries {
+		registry.AppendServiceChangeHandler(serviceChanged)
+	}
+}
+
+// Run runs all the registries until a signal is received
+func (a *aggregate) Run(stop <-chan struct{}) {
+	for _, registry := range a.registries {
+		registry.Run(stop)
+	}
+}
+
+// ServiceEntries lists the ServiceEntries of all the registries
+func (a *aggregate) ServiceEntries() ([]*ServiceEntryWrapper, error) {
+	serviceEntries := make([]*ServiceEntryWrapper, 0)
+	for _, registry := range a.registries {
+		registryServiceEntries, err := registry.ServiceEntries()
+		if err != nil {
+			return nil, err
+		}
+		serviceEntries = append(serviceEntries, registryServiceEntries...)
+	}
+	return serviceEntries, nil
+}
+
+// ServiceEntriesOf lists the ServiceEntries of a service in whichever registry it belongs to
+func (a *aggregate) ServiceEntriesOf(service string) ([]*ServiceEntryWrapper, error) {
+	serviceEntries := make([]*ServiceEntryWrapper, 0)
+	for _, registry := range a.registries {
+		registryServiceEntries, err := registry.ServiceEntriesOf(service)
+		if err != nil {
+			return nil, err
+		}
+		serviceEntries = append(serviceEntries, registryServiceEntries...)
+	}
+	return serviceEntries, nil
+}
@@ -0,0 +1,73 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serviceregistry
+
+import (
+	"reflect"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ConfigStore converts the configs of a registry other than its services, e.g. traffic policies, to Istio configs
+type ConfigStore interface {
+	// AppendConfigChangeHandler notifies about changes to the Istio configs converted from the registry
+	AppendConfigChangeHandler(configChanged func())
+
+	// Run until a signal is received
+	Run(stop <-chan struct{})
+
+	// Configs lists all the Istio configs converted from the registry
+	Configs() ([]*ConfigWrapper, error)
+
+	// Kinds lists the kinds of the Istio configs converted from the registry, the stale resources of these kinds are
+	// deleted even if no config of the kind is left
+	Kinds() []string
+}
+
+// ConfigWrapper is an Istio config resource converted from a registry, e.g. a DestinationRule
+type ConfigWrapper struct {
+	// Service is the name of the service in the registry which the config applies to
+	Service string
+	// Name is the name of the config resource
+	Name string
+	// Namespace is the namespace of the config resource, empty for the default namespace of the registry
+	Namespace string
+	// Labels are the extra labels of the config resource which record where it comes from
+	Labels map[string]string
+	// Annotations are the extra annotations of the config resource
+	Annotations map[string]string
+	// Spec is the spec of the config resource, whose message name is the kind of the resource
+	Spec proto.Message
+}
+
+// Kind returns the kind of the config resource, e.g. DestinationRule
+func (c *ConfigWrapper) Kind() string {
+	return string(c.Spec.ProtoReflect().Descriptor().Name())
+}
+
+// ConfigsEqual tells whether two lists of configs are identical
+func ConfigsEqual(a, b []*ConfigWrapper) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Service != b[i].Service || a[i].Name != b[i].Name || a[i].Namespace != b[i].Namespace ||
+			!reflect.DeepEqual(a[i].Labels, b[i].Labels) || !reflect.DeepEqual(a[i].Annotations, b[i].Annotations) ||
+			!proto.Equal(a[i].Spec, b[i].Spec) {
+			return false
+		}
+	}
+	return true
+}
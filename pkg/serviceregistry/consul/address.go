@@ -0,0 +1,80 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// AddressTypeService is the address of a service instance
+	AddressTypeService = "service"
+	// AddressTypeNode is the address of the node of a service instance
+	AddressTypeNode = "node"
+
+	// addressTypeLabel records which address of an instance the WorkloadEntry points to
+	addressTypeLabel = "consul-address-type"
+)
+
+// taggedAddressTypes are the tagged addresses of Consul services and nodes
+var taggedAddressTypes = map[string]bool{
+	"lan":      true,
+	"lan_ipv4": true,
+	"lan_ipv6": true,
+	"wan":      true,
+	"wan_ipv4": true,
+	"wan_ipv6": true,
+}
+
+// parseAddressPreference validates the address types in the order of preference
+func parseAddressPreference(preference []string) ([]string, error) {
+	for _, addressType := range preference {
+		if !taggedAddressTypes[addressType] && addressType != AddressTypeService && addressType != AddressTypeNode {
+			return nil, fmt.Errorf("unknown address type %s", addressType)
+		}
+	}
+	return preference, nil
+}
+
+// selectAddress returns the address of an instance and its type. A tagged address type is looked up in the tagged
+// addresses of the service first, then in the ones of the node, the port is 0 unless a tagged address of the
+// service has its own port. The address of the service or the node is used if no preferred address is found.
+func selectAddress(preference []string, endpoint *api.CatalogService) (string, int, string) {
+	for _, addressType := range preference {
+		switch addressType {
+		case AddressTypeService:
+			if endpoint.ServiceAddress != "" {
+				return endpoint.ServiceAddress, 0, AddressTypeService
+			}
+		case AddressTypeNode:
+			if endpoint.Address != "" {
+				return endpoint.Address, 0, AddressTypeNode
+			}
+		default:
+			if address, ok := endpoint.ServiceTaggedAddresses[addressType]; ok && address.Address != "" {
+				return address.Address, address.Port, addressType
+			}
+			if address := endpoint.TaggedAddresses[addressType]; address != "" {
+				return address, 0, addressType
+			}
+		}
+	}
+	if endpoint.ServiceAddress != "" {
+		return endpoint.ServiceAddress, 0, AddressTypeService
+	}
+	return endpoint.Address, 0, AddressTypeNode
+}
@@ -0,0 +1,334 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"fmt"
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+	security "istio.io/api/security/v1beta1"
+	typev1beta1 "istio.io/api/type/v1beta1"
+
+	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry"
+)
+
+// wildcardIntention is the name of a source or destination of intentions which stands for all the services
+const wildcardIntention = "*"
+
+// intentionTier is the precedence of a source of intentions, a source of a lower tier takes precedence
+type intentionTier int
+
+const (
+	// tierService is a source naming a service
+	tierService intentionTier = iota
+	// tierNamespace is a source naming all the services of a namespace
+	tierNamespace
+	// tierAll is a source naming all the services
+	tierAll
+)
+
+// intentions converts the intentions to AuthorizationPolicies. Consul evaluates the intentions to a destination in
+// the order of precedence of their sources, and the first one which matches decides, while Istio evaluates the DENY
+// policies before the ALLOW ones. The order of Consul is kept by excluding the sources of a higher precedence from
+// the rules of each source, and the requests which match no intention are denied by an ALLOW policy if the default
+// action is deny.
+type intentions struct {
+	opts          *convertOptions
+	scopes        scopeConfig
+	defaultAction string
+	selectorLabel string
+	// report lists the intentions which can't be expressed as AuthorizationPolicies
+	report []string
+}
+
+// convert converts the intentions to each destination to an ALLOW and a DENY AuthorizationPolicy on the workloads
+// of the destination, the intentions to all the services are converted to policies on the whole namespace
+func (i *intentions) convert(entries []*intentionEntry) []*serviceregistry.ConfigWrapper {
+	sort.Slice(entries, func(a, b int) bool {
+		return configEntryServiceID(entries[a].Partition, entries[a].Namespace, entries[a].Name) <
+			configEntryServiceID(entries[b].Partition, entries[b].Namespace, entries[b].Name)
+	})
+	hasServices := false
+	for _, entry := range entries {
+		if entry.Name != wildcardIntention {
+			hasServices = true
+		}
+	}
+
+	configs := make([]*serviceregistry.ConfigWrapper, 0)
+	for _, entry := range entries {
+		key := i.scopes.serviceKey(entry.Partition, entry.Namespace, entry.Name)
+		if entry.JWT != nil {
+			i.reportf(key, nil, "the JWT requirement is ignored")
+		}
+
+		name := i.opts.serviceHost(key)
+		var selector *typev1beta1.WorkloadSelector
+		if entry.Name == wildcardIntention {
+			if key.Namespace != "" && i.opts.targetNamespace(key) == "" {
+				i.reportf(key, nil, "the services of a Consul namespace can only be selected when Consul namespaces "+
+					"are mapped to Kubernetes namespaces")
+				continue
+			}
+			name = "consul-intentions"
+		} else {
+			selector = &typev1beta1.WorkloadSelector{MatchLabels: map[string]string{i.selectorLabel: entry.Name}}
+		}
+
+		allow, deny := i.policies(key, entry.Sources)
+		if entry.Name == wildcardIntention && hasServices && (deny != nil || (allow != nil && len(allow.Rules) > 0)) {
+			i.reportf(key, nil, "the rules also apply to the destinations with their own intentions")
+		}
+		if allow != nil {
+			allow.Selector = selector
+			configs = append(configs, newConfigWrapper(i.opts, key, name+"-allow", allow))
+		}
+		if deny != nil {
+			deny.Selector = selector
+			configs = append(configs, newConfigWrapper(i.opts, key, name+"-deny", deny))
+		}
+	}
+	return configs
+}
+
+// policies converts the intentions to a destination to an ALLOW and a DENY policy, the ALLOW policy is nil if the
+// requests matching no intention are allowed, and the DENY policy is nil if it has no rule
+func (i *intentions) policies(destination ServiceKey,
+	sources []*intentionSource) (*security.AuthorizationPolicy, *security.AuthorizationPolicy) {
+	// The requests which match no intention get the action of the L4 intention from all the services if any
+	fallback := i.defaultAction
+	tiers := make([][]*intentionSource, tierAll+1)
+	for _, source := range sources {
+		tier := i.tier(source)
+		tiers[tier] = append(tiers[tier], source)
+		if tier == tierAll && len(source.Permissions) == 0 &&
+			(source.Action == IntentionActionAllow || source.Action == IntentionActionDeny) {
+			fallback = source.Action
+		}
+	}
+
+	allowRules := make([]*security.Rule, 0)
+	denyRules := make([]*security.Rule, 0)
+	// precedent are the matches of the sources of the tiers of higher precedence
+	precedent := make([]*security.Source, 0)
+	for tier, tierSources := range tiers {
+		matches := make([]*security.Source, 0, len(tierSources))
+		for _, source := range tierSources {
+			if source.Peer != "" || source.SamenessGroup != "" {
+				i.reportf(destination, source, "the sources in cluster peers or sameness groups are not supported")
+				continue
+			}
+			match, err := i.sourceMatch(destination, source, intentionTier(tier))
+			if err != nil {
+				i.reportf(destination, source, "%v", err)
+				continue
+			}
+			from := []*security.Rule_From{{Source: excludeSources(match, precedent)}}
+
+			if len(source.Permissions) == 0 {
+				switch source.Action {
+				case IntentionActionAllow:
+					if fallback == IntentionActionDeny {
+						allowRules = append(allowRules, &security.Rule{From: from})
+					}
+				case IntentionActionDeny:
+					if intentionTier(tier) != tierAll && fallback == IntentionActionAllow {
+						denyRules = append(denyRules, &security.Rule{From: from})
+					}
+				default:
+					i.reportf(destination, source, "action %q is not supported", source.Action)
+					continue
+				}
+				matches = append(matches, match)
+				continue
+			}
+
+			// The requests which match no permission get the default action rather than the one of the intention
+			// from all the services
+			if fallback != i.defaultAction {
+				i.reportf(destination, source, "the requests matching no permission would fall back to the %s "+
+					"intention from all the services instead of the default action %s", fallback, i.defaultAction)
+				continue
+			}
+			allows, denies, err := permissionRules(from, source.Permissions)
+			if err != nil {
+				i.reportf(destination, source, "%v", err)
+				continue
+			}
+			if fallback == IntentionActionDeny {
+				allowRules = append(allowRules, allows...)
+			}
+			denyRules = append(denyRules, denies...)
+			matches = append(matches, match)
+		}
+		precedent = append(precedent, matches...)
+	}
+
+	var allow, deny *security.AuthorizationPolicy
+	if fallback == IntentionActionDeny {
+		// An ALLOW policy without rules denies all the requests
+		allow = &security.AuthorizationPolicy{Action: security.AuthorizationPolicy_ALLOW, Rules: allowRules}
+	}
+	if len(denyRules) > 0 {
+		deny = &security.AuthorizationPolicy{Action: security.AuthorizationPolicy_DENY, Rules: denyRules}
+	}
+	return allow, deny
+}
+
+// tier returns the precedence of a source, the namespaces are ignored if they are not synchronized
+func (i *intentions) tier(source *intentionSource) intentionTier {
+	if source.Name != wildcardIntention {
+		return tierService
+	}
+	if len(i.scopes.namespaces) == 0 || source.Namespace == wildcardIntention {
+		return tierAll
+	}
+	return tierNamespace
+}
+
+// sourceMatch converts the source of an intention to the peers it matches. A service is matched by the principal of
+// its service account, which is named after the service like Consul on Kubernetes requires. The namespace of the
+// principal is only matched if Consul namespaces are mapped to Kubernetes namespaces.
+func (i *intentions) sourceMatch(destination ServiceKey, source *intentionSource,
+	tier intentionTier) (*security.Source, error) {
+	if tier == tierAll {
+		return &security.Source{Principals: []string{"*"}}, nil
+	}
+	key := i.sourceKey(destination, source)
+	namespace := i.opts.targetNamespace(key)
+	if tier == tierNamespace {
+		if namespace == "" {
+			return nil, fmt.Errorf("the services of a Consul namespace can only be matched when Consul namespaces " +
+				"are mapped to Kubernetes namespaces")
+		}
+		return &security.Source{Namespaces: []string{namespace}}, nil
+	}
+	if namespace != "" && source.Namespace != wildcardIntention {
+		return &security.Source{Principals: []string{"*/ns/" + namespace + "/sa/" + source.Name}}, nil
+	}
+	return &security.Source{Principals: []string{"*/sa/" + source.Name}}, nil
+}
+
+// sourceKey returns the key of the source service of an intention, the namespace and partition default to the ones
+// of the destination
+func (i *intentions) sourceKey(destination ServiceKey, source *intentionSource) ServiceKey {
+	namespace, partition := source.Namespace, source.Partition
+	if namespace == "" {
+		namespace = destination.Namespace
+	}
+	if partition == "" {
+		partition = destination.Partition
+	}
+	return i.scopes.serviceKey(partition, namespace, source.Name)
+}
+
+// reportf records an intention which can't be expressed, the source is nil for all the intentions to a destination
+func (i *intentions) reportf(destination ServiceKey, source *intentionSource, format string, args ...interface{}) {
+	sourceID := wildcardIntention
+	if source != nil {
+		sourceID = i.sourceKey(destination, source).serviceID()
+	}
+	i.report = append(i.report, fmt.Sprintf("%s => %s: %s", sourceID, destination.serviceID(),
+		fmt.Sprintf(format, args...)))
+}
+
+// excludeSources excludes the peers matched by the sources of a higher precedence from the match of a source
+func excludeSources(match *security.Source, precedent []*security.Source) *security.Source {
+	out := proto.Clone(match).(*security.Source)
+	for _, source := range precedent {
+		out.NotPrincipals = append(out.NotPrincipals, source.Principals...)
+		out.NotNamespaces = append(out.NotNamespaces, source.Namespaces...)
+	}
+	return out
+}
+
+// permissionRules converts the L7 permissions of an intention to ALLOW and DENY rules. Consul evaluates the
+// permissions in order while Istio evaluates the DENY rules first, so a deny permission after an allow one can't be
+// expressed.
+func permissionRules(from []*security.Rule_From,
+	permissions []*intentionPermission) ([]*security.Rule, []*security.Rule, error) {
+	allows := make([]*security.Rule, 0, len(permissions))
+	denies := make([]*security.Rule, 0)
+	for _, permission := range permissions {
+		rule, err := permissionRule(from, permission)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch permission.Action {
+		case IntentionActionAllow:
+			allows = append(allows, rule)
+		case IntentionActionDeny:
+			if len(allows) > 0 {
+				return nil, nil, fmt.Errorf("a deny permission after an allow permission is not supported since " +
+					"Istio evaluates the deny rules first")
+			}
+			denies = append(denies, rule)
+		default:
+			return nil, nil, fmt.Errorf("permission action %q is not supported", permission.Action)
+		}
+	}
+	return allows, denies, nil
+}
+
+// permissionRule converts the HTTP match of a permission to the operation and the header conditions of a rule
+func permissionRule(from []*security.Rule_From, permission *intentionPermission) (*security.Rule, error) {
+	if permission.JWT != nil {
+		return nil, fmt.Errorf("the JWT requirements of permissions are not supported")
+	}
+	rule := &security.Rule{From: from}
+	match := permission.HTTP
+	if match == nil {
+		return rule, nil
+	}
+
+	operation := &security.Operation{Methods: match.Methods}
+	switch {
+	case match.PathExact != "":
+		operation.Paths = []string{match.PathExact}
+	case match.PathPrefix != "":
+		operation.Paths = []string{match.PathPrefix + "*"}
+	case match.PathRegex != "":
+		return nil, fmt.Errorf("path regex %s is not supported", match.PathRegex)
+	}
+	if len(operation.Paths) > 0 || len(operation.Methods) > 0 {
+		rule.To = []*security.Rule_To{{Operation: operation}}
+	}
+
+	for _, header := range match.Header {
+		var value string
+		switch {
+		case header.Exact != "":
+			value = header.Exact
+		case header.Prefix != "":
+			value = header.Prefix + "*"
+		case header.Suffix != "":
+			value = "*" + header.Suffix
+		case header.Regex != "":
+			return nil, fmt.Errorf("regex %s of header %s is not supported", header.Regex, header.Name)
+		default:
+			// The header is present
+			value = "*"
+		}
+		condition := &security.Condition{Key: "request.headers[" + header.Name + "]"}
+		if header.Invert {
+			condition.NotValues = []string{value}
+		} else {
+			condition.Values = []string{value}
+		}
+		rule.When = append(rule.When, condition)
+	}
+	return rule, nil
+}
@@ -0,0 +1,205 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	security "istio.io/api/security/v1beta1"
+	typev1beta1 "istio.io/api/type/v1beta1"
+)
+
+const testIntentions = `[
+  {"Kind": "service-intentions", "Name": "db",
+   "Sources": [
+     {"Name": "web", "Action": "allow"},
+     {"Name": "batch", "Action": "deny"},
+     {"Name": "*", "Action": "deny"}
+   ]},
+  {"Kind": "service-intentions", "Name": "api",
+   "Sources": [
+     {"Name": "web", "Action": "deny"},
+     {"Name": "admin", "Permissions": [{"Action": "allow", "HTTP": {"PathPrefix": "/"}}]},
+     {"Name": "*", "Action": "allow"}
+   ]},
+  {"Kind": "service-intentions", "Name": "reviews",
+   "Sources": [
+     {"Name": "web", "Permissions": [
+       {"Action": "deny", "HTTP": {"PathPrefix": "/admin"}},
+       {"Action": "allow", "HTTP": {"PathPrefix": "/", "Methods": ["GET"],
+         "Header": [{"Name": "x-env", "Exact": "prod"}, {"Name": "x-debug", "Present": true, "Invert": true}]}}
+     ]},
+     {"Name": "*", "Permissions": [{"Action": "allow", "HTTP": {"PathExact": "/health"}}]}
+   ]},
+  {"Kind": "service-intentions", "Name": "rating",
+   "Sources": [
+     {"Name": "web", "Peer": "cluster-2", "Action": "allow"},
+     {"Name": "batch", "Permissions": [{"Action": "allow", "HTTP": {"PathRegex": "/v[0-9]+/.*"}}]}
+   ]}
+]`
+
+func TestIntentions(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+	ts.rawConfigEntries = map[string]string{serviceIntentions: testIntentions}
+
+	controller, err := NewIntentionController(newTestArgs(ts.server.URL))
+	if err != nil {
+		t.Fatalf("could not create intention controller: %v", err)
+	}
+	configs, err := controller.Configs()
+	if err != nil {
+		t.Fatalf("Configs() => %v", err)
+	}
+
+	selector := func(service string) *typev1beta1.WorkloadSelector {
+		return &typev1beta1.WorkloadSelector{MatchLabels: map[string]string{DefaultIntentionSelectorLabel: service}}
+	}
+	from := func(source *security.Source) []*security.Rule_From {
+		return []*security.Rule_From{{Source: source}}
+	}
+	want := []struct {
+		name string
+		spec proto.Message
+	}{
+		{
+			// The intention from all the services to api allows the requests matching no intention
+			name: "api-deny",
+			spec: &security.AuthorizationPolicy{
+				Selector: selector("api"),
+				Action:   security.AuthorizationPolicy_DENY,
+				Rules:    []*security.Rule{{From: from(&security.Source{Principals: []string{"*/sa/web"}})}},
+			},
+		},
+		{
+			name: "db-allow",
+			spec: &security.AuthorizationPolicy{
+				Selector: selector("db"),
+				Action:   security.AuthorizationPolicy_ALLOW,
+				Rules:    []*security.Rule{{From: from(&security.Source{Principals: []string{"*/sa/web"}})}},
+			},
+		},
+		{
+			// No intention to rating can be converted, so all the requests are denied by default
+			name: "rating-allow",
+			spec: &security.AuthorizationPolicy{
+				Selector: selector("rating"),
+				Action:   security.AuthorizationPolicy_ALLOW,
+				Rules:    []*security.Rule{},
+			},
+		},
+		{
+			name: "reviews-allow",
+			spec: &security.AuthorizationPolicy{
+				Selector: selector("reviews"),
+				Action:   security.AuthorizationPolicy_ALLOW,
+				Rules: []*security.Rule{
+					{
+						From: from(&security.Source{Principals: []string{"*/sa/web"}}),
+						To: []*security.Rule_To{{
+							Operation: &security.Operation{Paths: []string{"/*"}, Methods: []string{"GET"}},
+						}},
+						When: []*security.Condition{
+							{Key: "request.headers[x-env]", Values: []string{"prod"}},
+							{Key: "request.headers[x-debug]", NotValues: []string{"*"}},
+						},
+					},
+					{
+						From: from(&security.Source{Principals: []string{"*"}, NotPrincipals: []string{"*/sa/web"}}),
+						To:   []*security.Rule_To{{Operation: &security.Operation{Paths: []string{"/health"}}}},
+					},
+				},
+			},
+		},
+		{
+			name: "reviews-deny",
+			spec: &security.AuthorizationPolicy{
+				Selector: selector("reviews"),
+				Action:   security.AuthorizationPolicy_DENY,
+				Rules: []*security.Rule{{
+					From: from(&security.Source{Principals: []string{"*/sa/web"}}),
+					To:   []*security.Rule_To{{Operation: &security.Operation{Paths: []string{"/admin*"}}}},
+				}},
+			},
+		},
+	}
+	if len(configs) != len(want) {
+		t.Fatalf("Configs() => %d configs, want %d", len(configs), len(want))
+	}
+	for i, config := range configs {
+		if config.Name != want[i].name || !proto.Equal(config.Spec, want[i].spec) {
+			t.Errorf("Configs()[%d] => %s %v, want %s %v", i, config.Name, config.Spec, want[i].name, want[i].spec)
+		}
+	}
+
+	wantReport := []string{
+		"admin => api: the requests matching no permission would fall back to the allow intention from all the " +
+			"services instead of the default action deny",
+		"web => rating: the sources in cluster peers or sameness groups are not supported",
+		"batch => rating: path regex /v[0-9]+/.* is not supported",
+	}
+	if !reflect.DeepEqual(controller.report, wantReport) {
+		t.Errorf("report => %v, want %v", controller.report, wantReport)
+	}
+}
+
+func TestIntentionsDefaultAllow(t *testing.T) {
+	opts, err := newConvertOptions(&BootStrapArgs{NamespaceMode: NamespaceModeKubernetes})
+	if err != nil {
+		t.Fatalf("newConvertOptions() => %v", err)
+	}
+	converter := &intentions{
+		opts:          opts,
+		scopes:        scopeConfig{namespaces: []string{"default", "team-a"}},
+		defaultAction: IntentionActionAllow,
+		selectorLabel: DefaultIntentionSelectorLabel,
+	}
+	entries := []*intentionEntry{{
+		Name:      "db",
+		Namespace: "team-a",
+		Sources: []*intentionSource{
+			{Name: "web", Action: IntentionActionAllow},
+			{Name: "*", Namespace: "default", Action: IntentionActionDeny},
+			{Name: "batch", Namespace: "*", Action: IntentionActionDeny},
+		},
+	}}
+	configs := converter.convert(entries)
+
+	// No ALLOW policy is needed, and the deny intention from the default namespace excludes the services named by
+	// the more precise intentions
+	want := &security.AuthorizationPolicy{
+		Selector: &typev1beta1.WorkloadSelector{MatchLabels: map[string]string{"app": "db"}},
+		Action:   security.AuthorizationPolicy_DENY,
+		Rules: []*security.Rule{
+			{From: []*security.Rule_From{{Source: &security.Source{Principals: []string{"*/sa/batch"}}}}},
+			{From: []*security.Rule_From{{Source: &security.Source{
+				Namespaces:    []string{"default"},
+				NotPrincipals: []string{"*/ns/team-a/sa/web", "*/sa/batch"},
+			}}}},
+		},
+	}
+	if len(configs) != 1 {
+		t.Fatalf("convert() => %d configs, want a DENY policy", len(configs))
+	}
+	if configs[0].Name != "db-deny" || configs[0].Namespace != "team-a" || !proto.Equal(configs[0].Spec, want) {
+		t.Errorf("convert() => %s/%s %v, want team-a/db-deny %v", configs[0].Namespace, configs[0].Name,
+			configs[0].Spec, want)
+	}
+	if len(converter.report) != 0 {
+		t.Errorf("report => %v, want none", converter.report)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"istio.io/pkg/log"
+)
+
+type partitionContextKey struct{}
+
+// withPartition returns a context which makes the Consul queries carrying it run in an admin partition
+func withPartition(ctx context.Context, partition string) context.Context {
+	if partition == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, partitionContextKey{}, partition)
+}
+
+// partitionTransport sets the admin partition of a request from its context,
+// since the vendored Consul client doesn't support admin partitions
+type partitionTransport struct {
+	base http.RoundTripper
+}
+
+func (t *partitionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	partition, ok := req.Context().Value(partitionContextKey{}).(string)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	query := req.URL.Query()
+	query.Set("partition", partition)
+	req.URL.RawQuery = query.Encode()
+	return t.base.RoundTrip(req)
+}
+
+// credentialReloadInterval is the interval to check whether the ACL token or the TLS files have been rotated
+const credentialReloadInterval = 10 * time.Second
+
+// credentialTransport sends the requests with the ACL token and the TLS material read from files, the files are
+// reloaded when they change so that rotated credentials take effect without a restart
+type credentialTransport struct {
+	tokenFile string
+	tlsConfig api.TLSConfig
+	// base is the template of the transports built with the TLS material
+	base *http.Transport
+
+	mutex     sync.Mutex
+	lastCheck time.Time
+	// contents are the contents of the files the credentials are loaded from
+	contents  map[string][]byte
+	token     string
+	transport *http.Transport
+}
+
+func newCredentialTransport(tokenFile string, tlsConfig api.TLSConfig,
+	base *http.Transport) (*credentialTransport, error) {
+	t := &credentialTransport{
+		tokenFile: tokenFile,
+		tlsConfig: tlsConfig,
+		base:      base,
+	}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *credentialTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mutex.Lock()
+	if time.Since(t.lastCheck) >= credentialReloadInterval {
+		if err := t.reload(); err != nil {
+			log.Warnf("Could not reload the Consul credentials, keep using the old ones: %v", err)
+		}
+	}
+	token, transport := t.token, t.transport
+	t.mutex.Unlock()
+
+	// The token of a query takes precedence over the token file
+	if token != "" && req.Header.Get("X-Consul-Token") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Consul-Token", token)
+	}
+	return transport.RoundTrip(req)
+}
+
+// reload reads the token and TLS files, and rebuilds the credentials if any of them has changed,
+// the caller must hold the mutex
+func (t *credentialTransport) reload() error {
+	t.lastCheck = time.Now()
+
+	contents := make(map[string][]byte)
+	for _, file := range []string{t.tokenFile, t.tlsConfig.CAFile, t.tlsConfig.CertFile, t.tlsConfig.KeyFile} {
+		if file == "" {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		contents[file] = data
+	}
+	if t.transport != nil && reflect.DeepEqual(contents, t.contents) {
+		return nil
+	}
+
+	tlsClientConfig, err := api.SetupTLSConfig(&t.tlsConfig)
+	if err != nil {
+		return err
+	}
+	transport := t.base.Clone()
+	transport.TLSClientConfig = tlsClientConfig
+
+	if t.transport != nil {
+		log.Infof("Consul credentials have changed, reloading")
+		t.transport.CloseIdleConnections()
+	}
+	t.contents = contents
+	t.token = strings.TrimSpace(string(contents[t.tokenFile]))
+	t.transport = transport
+	return nil
+}
+
+// newConsulClient creates a Consul client with the bootstrap arguments, the arguments which are not set fall back
+// to the CONSUL_* environment variables of the Consul client
+func newConsulClient(args *BootStrapArgs) (*api.Client, error) {
+	conf := api.DefaultConfig()
+	conf.Address = args.ConsulAddress
+
+	if args.Token != "" {
+		conf.Token = args.Token
+	}
+	if args.TokenFile != "" {
+		conf.TokenFile = args.TokenFile
+	}
+	if args.CAFile != "" {
+		conf.TLSConfig.CAFile = args.CAFile
+	}
+	if args.CertFile != "" {
+		conf.TLSConfig.CertFile = args.CertFile
+	}
+	if args.KeyFile != "" {
+		conf.TLSConfig.KeyFile = args.KeyFile
+	}
+	if args.TLSServerName != "" {
+		conf.TLSConfig.Address = args.TLSServerName
+	}
+	if args.InsecureSkipVerify {
+		conf.TLSConfig.InsecureSkipVerify = true
+	}
+	if args.HTTPAuth != "" {
+		conf.HttpAuth = parseHTTPAuth(args.HTTPAuth)
+	}
+
+	// The token file is read by the transport so that a rotated token is picked up, it takes precedence over
+	// the static token as it does in the Consul client
+	tokenFile := conf.TokenFile
+	if tokenFile != "" {
+		conf.Token = ""
+		conf.TokenFile = ""
+	}
+	transport, err := newCredentialTransport(tokenFile, conf.TLSConfig, conf.Transport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load Consul credentials: %v", err)
+	}
+	conf.HttpClient = &http.Client{
+		Transport: &partitionTransport{base: transport},
+	}
+	return api.NewClient(conf)
+}
+
+// parseHTTPAuth parses HTTP basic auth in the "username[:password]" format of CONSUL_HTTP_AUTH
+func parseHTTPAuth(auth string) *api.HttpBasicAuth {
+	username, password := auth, ""
+	if i := strings.Index(auth, ":"); i >= 0 {
+		username, password = auth[:i], auth[i+1:]
+	}
+	return &api.HttpBasicAuth{
+		Username: username,
+		Password: password,
+	}
+}
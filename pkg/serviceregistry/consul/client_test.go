@@ -0,0 +1,203 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// credentialServer records the credentials of the last request
+type credentialServer struct {
+	server   *httptest.Server
+	lock     sync.Mutex
+	token    string
+	username string
+	password string
+}
+
+func newCredentialServer(tls bool) *credentialServer {
+	s := &credentialServer{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		s.token = r.Header.Get("X-Consul-Token")
+		s.username, s.password, _ = r.BasicAuth()
+		s.lock.Unlock()
+		w.Header().Set("X-Consul-Index", "1")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte("{}"))
+	})
+	if tls {
+		s.server = httptest.NewTLSServer(handler)
+	} else {
+		s.server = httptest.NewServer(handler)
+	}
+	return s
+}
+
+func (s *credentialServer) lastToken() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.token
+}
+
+func writeFile(t *testing.T, file, content string) {
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("could not write %s: %v", file, err)
+	}
+}
+
+func TestConsulClientCredentials(t *testing.T) {
+	ts := newCredentialServer(false)
+	defer ts.server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	writeFile(t, tokenFile, "token-from-file\n")
+
+	tests := []struct {
+		name      string
+		token     string
+		tokenFile string
+		httpAuth  string
+		wantToken string
+		wantUser  string
+		wantPass  string
+	}{
+		{
+			name:      "static token",
+			token:     "static-token",
+			wantToken: "static-token",
+		},
+		{
+			name:      "token file takes precedence",
+			token:     "static-token",
+			tokenFile: tokenFile,
+			wantToken: "token-from-file",
+		},
+		{
+			name:     "http basic auth",
+			httpAuth: "consul:secret:with:colons",
+			wantUser: "consul",
+			wantPass: "secret:with:colons",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := newTestArgs(ts.server.URL)
+			args.Token = tt.token
+			args.TokenFile = tt.tokenFile
+			args.HTTPAuth = tt.httpAuth
+			client, err := newConsulClient(args)
+			if err != nil {
+				t.Fatalf("could not create Consul client: %v", err)
+			}
+			if _, _, err := client.Catalog().Services(nil); err != nil {
+				t.Fatalf("could not query Consul: %v", err)
+			}
+
+			ts.lock.Lock()
+			defer ts.lock.Unlock()
+			if ts.token != tt.wantToken {
+				t.Errorf("token => %q, want %q", ts.token, tt.wantToken)
+			}
+			if ts.username != tt.wantUser || ts.password != tt.wantPass {
+				t.Errorf("basic auth => %q:%q, want %q:%q", ts.username, ts.password, tt.wantUser, tt.wantPass)
+			}
+		})
+	}
+}
+
+func TestCredentialTransportReload(t *testing.T) {
+	ts := newCredentialServer(true)
+	defer ts.server.Close()
+
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, tokenFile, "token-1")
+	writeFile(t, caFile, "")
+
+	args := newTestArgs(ts.server.URL)
+	args.TokenFile = tokenFile
+	args.CAFile = caFile
+	args.TLSServerName = "example.com"
+	if _, err := newConsulClient(args); err == nil {
+		t.Fatalf("newConsulClient() should fail with an invalid CA file")
+	}
+
+	writeFile(t, caFile, string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: ts.server.Certificate().Raw,
+	})))
+	client, err := newConsulClient(args)
+	if err != nil {
+		t.Fatalf("could not create Consul client: %v", err)
+	}
+	if _, _, err := client.Catalog().Services(nil); err != nil {
+		t.Fatalf("could not query Consul over TLS: %v", err)
+	}
+	if token := ts.lastToken(); token != "token-1" {
+		t.Errorf("token => %q, want %q", token, "token-1")
+	}
+
+	credentials, err := newCredentialTransport(tokenFile, api.TLSConfig{CAFile: caFile, Address: "example.com"},
+		http.DefaultTransport.(*http.Transport))
+	if err != nil {
+		t.Fatalf("could not create credential transport: %v", err)
+	}
+	httpClient := &http.Client{Transport: credentials}
+	get := func() {
+		resp, err := httpClient.Get(ts.server.URL + "/v1/catalog/services")
+		if err != nil {
+			t.Fatalf("could not query Consul over TLS: %v", err)
+		}
+		resp.Body.Close()
+	}
+	expireCheck := func() {
+		credentials.mutex.Lock()
+		credentials.lastCheck = time.Now().Add(-credentialReloadInterval)
+		credentials.mutex.Unlock()
+	}
+
+	// The rotated token is only picked up after the reload interval
+	writeFile(t, tokenFile, "token-2")
+	get()
+	if token := ts.lastToken(); token != "token-1" {
+		t.Errorf("token before reload => %q, want %q", token, "token-1")
+	}
+	expireCheck()
+	get()
+	if token := ts.lastToken(); token != "token-2" {
+		t.Errorf("token after reload => %q, want %q", token, "token-2")
+	}
+
+	// Broken files don't replace the credentials in use
+	writeFile(t, caFile, "broken")
+	writeFile(t, tokenFile, "token-3")
+	expireCheck()
+	get()
+	if token := ts.lastToken(); token != "token-2" {
+		t.Errorf("token after a failed reload => %q, want %q", token, "token-2")
+	}
+}
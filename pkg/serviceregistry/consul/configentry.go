@@ -0,0 +1,140 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"context"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// configEntryKinds are the kinds of the config entries which declare the protocols of services
+var configEntryKinds = []string{api.ServiceDefaults, api.ProxyDefaults}
+
+// configEntry is a service-defaults or proxy-defaults config entry, only the fields used to convert services are
+// decoded since the vendored Consul client doesn't support admin partitions
+type configEntry struct {
+	Kind      string
+	Name      string
+	Partition string
+	Namespace string
+	// Protocol is the protocol of a service-defaults config entry
+	Protocol string
+	// Config is the opaque proxy config of a proxy-defaults config entry, which may have a "protocol" key
+	Config map[string]interface{}
+}
+
+// protocol returns the protocol declared by the config entry
+func (e configEntry) protocol() string {
+	if e.Kind == api.ProxyDefaults {
+		protocol, _ := e.Config[protocolTagName].(string)
+		return protocol
+	}
+	return e.Protocol
+}
+
+// configEntryQueryOptions returns the options to query the config entries of an admin partition, config entries are
+// replicated from the primary datacenter so the local datacenter is always queried
+func configEntryQueryOptions(ctx context.Context, scopes scopeConfig, partition string) *api.QueryOptions {
+	q := &api.QueryOptions{}
+	if scopes.enterprise() {
+		q.Namespace = AllNamespaces
+	}
+	return q.WithContext(withPartition(ctx, partition))
+}
+
+// getConfigEntries lists the config entries of a kind
+func getConfigEntries(client *api.Client, kind string, q *api.QueryOptions) ([]configEntry, *api.QueryMeta, error) {
+	var out []configEntry
+	queryMeta, err := client.Raw().Query("/v1/config/"+kind, &out, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range out {
+		// The kind is omitted by some Consul versions
+		out[i].Kind = kind
+	}
+	return out, queryMeta, nil
+}
+
+// listConfigEntries lists the config entries of all kinds in the admin partitions of the scopes
+func listConfigEntries(client *api.Client, config scopeConfig, scopes []scope) ([]configEntry, error) {
+	partitions := make(map[string]bool)
+	entries := make([]configEntry, 0)
+	for _, s := range scopes {
+		if partitions[s.Partition] {
+			continue
+		}
+		partitions[s.Partition] = true
+		for _, kind := range configEntryKinds {
+			kindEntries, _, err := getConfigEntries(client, kind,
+				configEntryQueryOptions(context.Background(), config, s.Partition))
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, kindEntries...)
+		}
+	}
+	return entries, nil
+}
+
+// protocolDefaults are the protocols declared by the config entries. The protocol of the main port of an instance
+// is taken from, in order of precedence, its "protocol" meta, the service-defaults of its service, and the global
+// proxy-defaults of its admin partition.
+type protocolDefaults struct {
+	// services are the protocols of the service-defaults keyed by "<partition>/<namespace>/<service>"
+	services map[string]string
+	// proxies are the protocols of the global proxy-defaults keyed by partition
+	proxies map[string]string
+}
+
+func newProtocolDefaults(entries []configEntry) *protocolDefaults {
+	defaults := &protocolDefaults{
+		services: make(map[string]string),
+		proxies:  make(map[string]string),
+	}
+	for _, entry := range entries {
+		protocol := entry.protocol()
+		if protocol == "" {
+			continue
+		}
+		switch entry.Kind {
+		case api.ServiceDefaults:
+			defaults.services[configEntryServiceID(entry.Partition, entry.Namespace, entry.Name)] = protocol
+		case api.ProxyDefaults:
+			if entry.Name == api.ProxyConfigGlobal {
+				defaults.proxies[enterpriseName(entry.Partition)] = protocol
+			}
+		}
+	}
+	return defaults
+}
+
+// protocol returns the protocol of a service declared by the config entries, it's empty if none is declared
+func (d *protocolDefaults) protocol(key ServiceKey) string {
+	if d == nil {
+		return ""
+	}
+	if protocol, ok := d.services[configEntryServiceID(key.Partition, key.Namespace, key.Name)]; ok {
+		return protocol
+	}
+	return d.proxies[enterpriseName(key.Partition)]
+}
+
+// configEntryServiceID identifies a service in the config entries, the default namespace and partition are explicit
+// since Consul Enterprise returns them even if they are not synchronized
+func configEntryServiceID(partition, namespace, name string) string {
+	return enterpriseName(partition) + "/" + enterpriseName(namespace) + "/" + name
+}
@@ -0,0 +1,293 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/protobuf/proto"
+	"istio.io/pkg/log"
+
+	"github.com/aeraki-framework/consul2istio/pkg/constants"
+	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry"
+)
+
+// configEntryConverter converts the config entries of each kind in each admin partition to Istio configs
+type configEntryConverter func(entries map[configEntrySource][]json.RawMessage) []*serviceregistry.ConfigWrapper
+
+// configEntryStore watches the config entries of some kinds in the admin partitions, and converts them to Istio
+// configs whenever they change. The config entries are kept encoded, each converter decodes the fields it needs.
+type configEntryStore struct {
+	client  *api.Client
+	scopes  scopeConfig
+	kinds   []string
+	convert configEntryConverter
+	// partitions are the admin partitions whose config entries are converted, nil until they are resolved
+	partitions []string
+	// watchers watch the config entries of each admin partition
+	watchers map[string]*watcher
+	// refreshInterval is the interval to resolve the admin partitions again when all of them are watched
+	refreshInterval time.Duration
+	// entries are the latest config entries of each kind in each admin partition
+	entries  map[configEntrySource][]json.RawMessage
+	configs  []*serviceregistry.ConfigWrapper
+	initDone bool
+	// configChangeHandlers are notified after the configs have been refreshed
+	configChangeHandlers []func()
+	mutex                sync.Mutex
+}
+
+func newConfigEntryStore(client *api.Client, scopes scopeConfig, kinds []string,
+	convert configEntryConverter) *configEntryStore {
+	return &configEntryStore{
+		client:          client,
+		scopes:          scopes,
+		kinds:           kinds,
+		convert:         convert,
+		entries:         make(map[configEntrySource][]json.RawMessage),
+		watchers:        make(map[string]*watcher),
+		refreshInterval: scopeRefreshInterval,
+	}
+}
+
+// getRawConfigEntries lists the config entries of a kind without decoding them
+func getRawConfigEntries(client *api.Client, kind string,
+	q *api.QueryOptions) ([]json.RawMessage, *api.QueryMeta, error) {
+	var out []json.RawMessage
+	queryMeta, err := client.Raw().Query("/v1/config/"+kind, &out, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, queryMeta, nil
+}
+
+// Run until a stop signal is received
+func (s *configEntryStore) Run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	go s.watch(ctx)
+}
+
+// watch keeps a blocking query on each kind of the config entries in each admin partition. The admin partitions are
+// resolved again periodically when all of them are watched, and the watchers are started or stopped accordingly.
+func (s *configEntryStore) watch(ctx context.Context) {
+	for {
+		partitions, err := resolvePartitions(s.client, "", s.scopes.partitions)
+		if err != nil {
+			log.Warnf("Could not fetch partitions to watch the %v config entries: %v", s.kinds, err)
+		} else {
+			s.updateWatchers(ctx, partitions)
+		}
+
+		// The partitions never change unless all of them are watched
+		if err == nil && !contains(s.scopes.partitions, AllPartitions) {
+			return
+		}
+		interval := s.refreshInterval
+		if err != nil {
+			interval = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// updateWatchers starts or stops the watchers of the config entries in the admin partitions, the configs are
+// converted again if a partition has been removed
+func (s *configEntryStore) updateWatchers(ctx context.Context, partitions []string) {
+	s.mutex.Lock()
+	desired := make(map[string]bool, len(partitions))
+	for _, partition := range partitions {
+		desired[partition] = true
+	}
+	removed := false
+	for partition, w := range s.watchers {
+		if !desired[partition] {
+			log.Infof("Stop watching the %v config entries of partition %s since it has been removed from consul",
+				s.kinds, enterpriseName(partition))
+			w.cancel()
+			delete(s.watchers, partition)
+			for _, kind := range s.kinds {
+				delete(s.entries, configEntrySource{partition: partition, kind: kind})
+			}
+			removed = true
+		}
+	}
+	for _, partition := range partitions {
+		if _, ok := s.watchers[partition]; !ok {
+			w := newWatcher(ctx)
+			s.watchers[partition] = w
+			for _, kind := range s.kinds {
+				go s.watchEntries(w, configEntrySource{partition: partition, kind: kind})
+			}
+		}
+	}
+	s.partitions = partitions
+	changed := removed && s.convertEntries()
+	s.mutex.Unlock()
+
+	if changed {
+		s.notify()
+	}
+}
+
+func (s *configEntryStore) watchEntries(w *watcher, source configEntrySource) {
+	var consulWaitIndex uint64
+
+	for {
+		queryOptions := configEntryQueryOptions(w.ctx, s.scopes, source.partition)
+		queryOptions.WaitIndex = consulWaitIndex
+		queryOptions.WaitTime = blockQueryWaitTime
+		entries, queryMeta, err := getRawConfigEntries(s.client, source.kind, queryOptions)
+		if w.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warnf("Could not fetch %s config entries of partition %s: %v", source.kind,
+				enterpriseName(source.partition), err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if consulWaitIndex != queryMeta.LastIndex {
+			consulWaitIndex = queryMeta.LastIndex
+			s.refresh(w, source, entries)
+		}
+	}
+}
+
+// Configs lists the Istio configs converted from all the config entries
+func (s *configEntryStore) Configs() ([]*serviceregistry.ConfigWrapper, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.initCache(); err != nil {
+		return nil, err
+	}
+	return s.configs, nil
+}
+
+// AppendConfigChangeHandler implements a config store operation
+func (s *configEntryStore) AppendConfigChangeHandler(configChanged func()) {
+	s.configChangeHandlers = append(s.configChangeHandlers, configChanged)
+}
+
+// resolvePartitions resolves the admin partitions once, the caller must hold the mutex
+func (s *configEntryStore) resolvePartitions() ([]string, error) {
+	if s.partitions != nil {
+		return s.partitions, nil
+	}
+	partitions, err := resolvePartitions(s.client, "", s.scopes.partitions)
+	if err != nil {
+		return nil, err
+	}
+	s.partitions = partitions
+	return partitions, nil
+}
+
+// initCache fetches all the config entries if the cache hasn't been populated by the watch yet,
+// the caller must hold the mutex
+func (s *configEntryStore) initCache() error {
+	if s.initDone {
+		return nil
+	}
+	partitions, err := s.resolvePartitions()
+	if err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		for _, kind := range s.kinds {
+			source := configEntrySource{partition: partition, kind: kind}
+			entries, _, err := getRawConfigEntries(s.client, kind,
+				configEntryQueryOptions(context.Background(), s.scopes, partition))
+			if err != nil {
+				return err
+			}
+			s.entries[source] = entries
+		}
+	}
+	s.configs = s.convert(s.entries)
+	s.initDone = true
+	return nil
+}
+
+// refresh converts the config entries after the ones of a kind in a partition have changed, and notifies the
+// handlers if the configs have changed
+func (s *configEntryStore) refresh(w *watcher, source configEntrySource, entries []json.RawMessage) {
+	s.mutex.Lock()
+	// The partition may have been removed while the query was in flight
+	if s.watchers[source.partition] != w {
+		s.mutex.Unlock()
+		return
+	}
+	s.entries[source] = entries
+	changed := s.convertEntries()
+	s.mutex.Unlock()
+
+	if changed {
+		s.notify()
+	}
+}
+
+// convertEntries converts the config entries and tells whether the configs have changed. Nothing is converted until
+// the config entries of every kind in every partition have been fetched, so that a partial result doesn't remove the
+// configs. The caller must hold the mutex.
+func (s *configEntryStore) convertEntries() bool {
+	if len(s.entries) < len(s.partitions)*len(s.kinds) {
+		return false
+	}
+	configs := s.convert(s.entries)
+	changed := !s.initDone || !serviceregistry.ConfigsEqual(s.configs, configs)
+	s.configs = configs
+	s.initDone = true
+	return changed
+}
+
+// notify calls the handlers after the configs have changed, the caller must not hold the mutex
+func (s *configEntryStore) notify() {
+	log.Debugf("Configs converted from the %v config entries changed", s.kinds)
+	for _, handler := range s.configChangeHandlers {
+		handler()
+	}
+}
+
+// newConfigWrapper wraps an Istio config converted for a Consul service, the config is created in the target
+// namespace of the service and labeled with its Consul namespace and partition
+func newConfigWrapper(opts *convertOptions, key ServiceKey, name string,
+	spec proto.Message) *serviceregistry.ConfigWrapper {
+	labels := make(map[string]string)
+	if key.Namespace != "" {
+		labels[constants.ConsulNamespaceLabel] = key.Namespace
+	}
+	if key.Partition != "" {
+		labels[constants.ConsulPartitionLabel] = key.Partition
+	}
+	return &serviceregistry.ConfigWrapper{
+		Service:   key.serviceID(),
+		Name:      name,
+		Namespace: opts.targetNamespace(key),
+		Labels:    labels,
+		Spec:      spec,
+	}
+}
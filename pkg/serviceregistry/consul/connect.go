@@ -0,0 +1,110 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"github.com/hashicorp/consul/api"
+)
+
+// instanceQuery decides how the instances of a service are fetched from Consul
+type instanceQuery struct {
+	healthCheck bool
+	// kinds are the kinds of the service instances to fetch, the instances of the other kinds are dropped
+	kinds map[api.ServiceKind]bool
+	// requiredMeta is the meta the instances must have, the value is nil if only the key is required
+	requiredMeta map[string]*string
+	// filter is the Consul filter expression of the instances, which is evaluated by Consul
+	filter string
+}
+
+func newInstanceQuery(args *BootStrapArgs) instanceQuery {
+	kinds := map[api.ServiceKind]bool{
+		api.ServiceKindTypical: true,
+	}
+	if args.SyncGateways {
+		kinds[api.ServiceKindMeshGateway] = true
+		kinds[api.ServiceKindTerminatingGateway] = true
+		kinds[api.ServiceKindIngressGateway] = true
+	}
+	// Sidecar proxies are never synchronized as services, but they're needed to find the sidecars of the instances
+	if args.ConnectSidecar {
+		kinds[api.ServiceKindConnectProxy] = true
+	}
+	return instanceQuery{
+		healthCheck:  args.EnableHealthCheck,
+		kinds:        kinds,
+		requiredMeta: parseRequiredMeta(args.RequiredMeta),
+		filter:       args.Filter,
+	}
+}
+
+// catalogServiceWithKind is an instance of the catalog API with its kind and locality, which the vendored Consul
+// client doesn't decode
+type catalogServiceWithKind struct {
+	api.CatalogService
+	ServiceKind     api.ServiceKind
+	ServiceLocality *consulLocality `json:",omitempty"`
+}
+
+// healthEntryWithLocality is an entry of the health API with the locality of the instance, which the vendored Consul
+// client doesn't decode
+type healthEntryWithLocality struct {
+	api.ServiceEntry
+	Service *agentServiceWithLocality
+}
+
+type agentServiceWithLocality struct {
+	api.AgentService
+	Locality *consulLocality `json:",omitempty"`
+}
+
+// isConnectProxy tells whether an instance is a Connect sidecar proxy
+func isConnectProxy(endpoint *api.CatalogService) bool {
+	return endpoint.ServiceProxy != nil && endpoint.ServiceProxy.DestinationServiceName != ""
+}
+
+// connectDestinations returns the names of the services which the sidecar proxies in the endpoints proxy for
+func connectDestinations(endpoints []*api.CatalogService) map[string]bool {
+	destinations := make(map[string]bool)
+	for _, endpoint := range endpoints {
+		if isConnectProxy(endpoint) {
+			destinations[endpoint.ServiceProxy.DestinationServiceName] = true
+		}
+	}
+	return destinations
+}
+
+// connectSidecars indexes the Connect sidecar proxies by the instance they proxy for
+type connectSidecars map[string]*api.CatalogService
+
+func sidecarKey(node, serviceID string) string {
+	return node + "/" + serviceID
+}
+
+func (s connectSidecars) add(proxies []*api.CatalogService) {
+	for _, proxy := range proxies {
+		if isConnectProxy(proxy) {
+			s[sidecarKey(proxy.Node, proxy.ServiceProxy.DestinationServiceID)] = proxy
+		}
+	}
+}
+
+// of returns the sidecar proxy of an instance, nil if the instance doesn't have one
+func (s connectSidecars) of(endpoint *api.CatalogService) *api.CatalogService {
+	if s == nil {
+		return nil
+	}
+	return s[sidecarKey(endpoint.Node, endpoint.ServiceID)]
+}
@@ -15,42 +15,104 @@
 package consul
 
 import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/hashicorp/consul/api"
-	istio "istio.io/api/networking/v1alpha3"
+	"google.golang.org/protobuf/proto"
 	"istio.io/pkg/log"
+
+	"github.com/aeraki-framework/consul2istio/pkg/constants"
+	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry"
 )
 
 // Controller communicates with Consul and monitors for changes
 type Controller struct {
-	client            *api.Client
-	monitor           Monitor
-	servicesList      []*istio.ServiceEntry
-	initDone          bool
-	fqdn              string
-	enableDefaultPort bool
-	cacheMutex        sync.Mutex
+	client   *api.Client
+	monitor  Monitor
+	services map[string]*serviceState
+	initDone bool
+	options  *convertOptions
+	query    instanceQuery
+	filter   *serviceFilter
+	// proxies indexes the services of the Connect sidecar proxies by the service they proxy for
+	proxies map[string]map[string]bool
+	// scopes are the datacenters, partitions and namespaces configured to synchronize
+	scopes scopeConfig
+	// overridePrefix is the KV prefix of the overrides, and overrides are the overrides keyed by service ID
+	overridePrefix string
+	overrides      map[string]*serviceOverride
+	// configEntryProtocols enables the protocols declared by the config entries, which are cached in protocols
+	configEntryProtocols bool
+	protocols            *protocolDefaults
+	// serviceChangeHandlers are notified after the cache has been refreshed
+	serviceChangeHandlers []func(event serviceregistry.ServiceEvent)
+	cacheMutex            sync.Mutex
 }
 
-// NewController creates a new Consul controller
-func NewController(addr, fqdn string, enableDefaultPort bool) (*Controller, error) {
-	conf := api.DefaultConfig()
-	conf.Address = addr
+// serviceState is the cached state of a Consul service across datacenters
+type serviceState struct {
+	// key identifies the service, its datacenter is always empty
+	key ServiceKey
+	// indexes are the last Consul ModifyIndex of the service instances in each datacenter
+	indexes map[string]uint64
+	// endpoints are the instances of the service in each datacenter, and localities are their Consul localities
+	endpoints      map[string][]*api.CatalogService
+	localities     map[string]instanceLocalities
+	serviceEntries []*serviceregistry.ServiceEntryWrapper
+}
+
+func newServiceState(key ServiceKey) *serviceState {
+	key.Datacenter = ""
+	return &serviceState{
+		key:        key,
+		indexes:    make(map[string]uint64),
+		endpoints:  make(map[string][]*api.CatalogService),
+		localities: make(map[string]instanceLocalities),
+	}
+}
 
-	client, err := api.NewClient(conf)
-	monitor := NewConsulMonitor(client)
+// NewController creates a new Consul controller
+func NewController(args *BootStrapArgs) (*Controller, error) {
+	client, err := newConsulClient(args)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := newServiceFilter(args)
+	if err != nil {
+		return nil, err
+	}
+	options, err := newConvertOptions(args)
+	if err != nil {
+		return nil, err
+	}
+	monitor, err := NewConsulMonitor(client, args)
+	if err != nil {
+		return nil, err
+	}
 	controller := Controller{
-		monitor:           monitor,
-		client:            client,
-		fqdn:              fqdn,
-		enableDefaultPort: enableDefaultPort,
-		servicesList:      make([]*istio.ServiceEntry, 0),
+		monitor:        monitor,
+		client:         client,
+		filter:         filter,
+		options:        options,
+		query:          newInstanceQuery(args),
+		scopes:         newScopeConfig(args),
+		overridePrefix: args.OverridePrefix,
+		overrides:      make(map[string]*serviceOverride),
+		services:       make(map[string]*serviceState),
+		proxies:        make(map[string]map[string]bool),
+
+		configEntryProtocols: args.ConfigEntryProtocols,
 	}
 
 	// Watch the change events to refresh local caches
 	monitor.AppendServiceChangeHandler(controller.serviceChanged)
-	return &controller, err
+	monitor.AppendOverrideChangeHandler(controller.overridesChanged)
+	monitor.AppendProtocolChangeHandler(controller.protocolsChanged)
+	return &controller, nil
 }
 
 // Run until a stop signal is received
@@ -59,7 +121,7 @@ func (c *Controller) Run(stop <-chan struct{}) {
 }
 
 // ServiceEntries Services list declarations of all services in the system
-func (c *Controller) ServiceEntries() ([]*istio.ServiceEntry, error) {
+func (c *Controller) ServiceEntries() ([]*serviceregistry.ServiceEntryWrapper, error) {
 	c.cacheMutex.Lock()
 	defer c.cacheMutex.Unlock()
 
@@ -68,43 +130,113 @@ func (c *Controller) ServiceEntries() ([]*istio.ServiceEntry, error) {
 		return nil, err
 	}
 
-	return c.servicesList, nil
+	serviceEntries := make([]*serviceregistry.ServiceEntryWrapper, 0, len(c.services))
+	for _, state := range c.services {
+		serviceEntries = append(serviceEntries, state.serviceEntries...)
+	}
+	return serviceEntries, nil
+}
+
+// ServiceEntriesOf list declarations of a single service
+func (c *Controller) ServiceEntriesOf(service string) ([]*serviceregistry.ServiceEntryWrapper, error) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	err := c.initCache()
+	if err != nil {
+		return nil, err
+	}
+
+	state, ok := c.services[service]
+	if !ok {
+		return []*serviceregistry.ServiceEntryWrapper{}, nil
+	}
+	return state.serviceEntries, nil
 }
 
 // AppendServiceChangeHandler implements a service catalog operation
-func (c *Controller) AppendServiceChangeHandler(serviceChanged func()) {
-	c.monitor.AppendServiceChangeHandler(func() error {
-		serviceChanged()
-		return nil
-	})
+func (c *Controller) AppendServiceChangeHandler(serviceChanged func(event serviceregistry.ServiceEvent)) {
+	c.serviceChangeHandlers = append(c.serviceChangeHandlers, serviceChanged)
 }
 
+// initCache fetches all the services from Consul if the cache hasn't been populated by the monitor yet
 func (c *Controller) initCache() error {
 	if c.initDone {
 		return nil
 	}
 
-	// get all services from consul
-	consulServices, err := c.getServices()
+	scopes, err := resolveScopes(c.client, c.scopes)
 	if err != nil {
+		log.Warnf("Could not retrieve datacenters, partitions or namespaces from consul: %v", err)
 		return err
 	}
 
-	for serviceName := range consulServices {
-		// get endpoints of a service from consul
-		endpoints, err := c.getCatalogService(serviceName, nil)
+	if c.overridePrefix != "" {
+		overrides, _, err := getServiceOverrides(c.client, c.overridePrefix, nil)
 		if err != nil {
-			return nil
+			log.Warnf("Could not retrieve overrides from consul: %v", err)
+			return err
+		}
+		c.overrides = overrides
+	}
+
+	if c.configEntryProtocols {
+		entries, err := listConfigEntries(c.client, c.scopes, scopes)
+		if err != nil {
+			log.Warnf("Could not retrieve config entries from consul: %v", err)
+			return err
+		}
+		c.protocols = newProtocolDefaults(entries)
+	}
+
+	services := make(map[string]*serviceState)
+	for _, s := range scopes {
+		// get all services from consul
+		consulServices, err := c.getServices(s)
+		if err != nil {
+			return err
+		}
+
+		for serviceName := range c.filter.filter(consulServices) {
+			key := ServiceKey{Datacenter: s.Datacenter, Partition: s.Partition, Namespace: s.Namespace,
+				Name: serviceName}
+			// get endpoints of a service from consul
+			endpoints, localities, queryMeta, err := getServiceInstances(c.client, c.query, serviceName,
+				s.queryOptions(context.Background()))
+			if err != nil {
+				log.Warnf("Could not retrieve instances of service %s from consul: %v", serviceName, err)
+				return err
+			}
+			if endpoints == nil {
+				continue
+			}
+			state, ok := services[key.serviceID()]
+			if !ok {
+				state = newServiceState(key)
+				services[key.serviceID()] = state
+			}
+			state.indexes[s.Datacenter] = queryMeta.LastIndex
+			state.endpoints[s.Datacenter] = endpoints
+			state.localities[s.Datacenter] = localities
 		}
-		c.servicesList = append(c.servicesList, convertServiceEntry(c.enableDefaultPort, c.fqdn, serviceName, endpoints))
 	}
 
+	c.services = services
+	c.proxies = make(map[string]map[string]bool)
+	for id, state := range services {
+		for _, endpoints := range state.endpoints {
+			c.indexProxy(id, state.key, nil, endpoints)
+		}
+	}
+	for _, state := range services {
+		state.serviceEntries = c.convertService(state)
+	}
 	c.initDone = true
 	return nil
 }
 
-func (c *Controller) getServices() (map[string][]string, error) {
-	data, _, err := c.client.Catalog().Services(nil)
+func (c *Controller) getServices(s scope) (map[string][]string, error) {
+	data, _, err := c.client.Catalog().Services(s.queryOptions(context.Background()))
 	if err != nil {
 		log.Warnf("Could not retrieve services from consul: %v", err)
 		return nil, err
@@ -112,18 +244,448 @@ func (c *Controller) getServices() (map[string][]string, error) {
 	return data, nil
 }
 
-func (c *Controller) getCatalogService(name string, q *api.QueryOptions) ([]*api.CatalogService, error) {
-	endpoints, _, err := c.client.Catalog().Service(name, "", q)
-	if err != nil {
-		log.Warnf("Could not retrieve service catalog from consul: %v", err)
-		return nil, err
+// convertService converts the instances of a Consul service in all datacenters to ServiceEntries
+func (c *Controller) convertService(state *serviceState) []*serviceregistry.ServiceEntryWrapper {
+	key, endpoints := state.key, state.endpoints
+	datacenters := sortedDatacenters(endpoints)
+	for _, datacenter := range datacenters {
+		// Sidecar proxies only provide the endpoints of the services they proxy for
+		if len(connectDestinations(endpoints[datacenter])) > 0 {
+			return nil
+		}
+	}
+
+	sidecars := c.connectSidecars(key)
+	override := c.overrides[key.serviceID()]
+	opts := c.serviceOptions(key, state.localities)
+	if c.options.datacenterMode != DatacenterModeSplit {
+		merged := make([]*api.CatalogService, 0)
+		for _, datacenter := range datacenters {
+			merged = append(merged, endpoints[datacenter]...)
+		}
+		converted := convertServiceEntries(opts, key, "", merged, sidecars)
+		override.apply(converted)
+		return c.newServiceEntryWrappers(key, override, converted)
 	}
-	return endpoints, nil
+
+	serviceEntries := make([]*serviceregistry.ServiceEntryWrapper, 0, len(datacenters))
+	for _, datacenter := range datacenters {
+		converted := convertServiceEntries(opts, key, datacenter, endpoints[datacenter], sidecars)
+		override.apply(converted)
+		serviceEntries = append(serviceEntries, c.newServiceEntryWrappers(key, override, converted)...)
+	}
+	return serviceEntries
 }
 
-func (c *Controller) serviceChanged() error {
+// serviceOptions returns the options to convert a service, with the default protocol declared by its config entries,
+// the localities of its instances in each datacenter and the services synchronized next to it. The caller must hold
+// the cache mutex.
+func (c *Controller) serviceOptions(key ServiceKey, localities map[string]instanceLocalities) *convertOptions {
+	protocol := c.protocols.protocol(key)
+	opts := *c.options
+	opts.defaultProtocol = protocol
+	opts.serviceExists = func(name string) bool {
+		state, ok := c.services[ServiceKey{Partition: key.Partition, Namespace: key.Namespace, Name: name}.serviceID()]
+		return ok && len(state.endpoints) > 0
+	}
+	if len(localities) > 0 {
+		opts.localities = make(instanceLocalities)
+		for _, datacenterLocalities := range localities {
+			for endpoint, locality := range datacenterLocalities {
+				opts.localities[endpoint] = locality
+			}
+		}
+	}
+	return &opts
+}
+
+// connectSidecars returns the sidecar proxies of the instances of a service in all datacenters
+func (c *Controller) connectSidecars(key ServiceKey) connectSidecars {
+	proxies := c.proxies[key.serviceID()]
+	if len(proxies) == 0 {
+		return nil
+	}
+	sidecars := make(connectSidecars)
+	for proxy := range proxies {
+		if state, ok := c.services[proxy]; ok {
+			for _, endpoints := range state.endpoints {
+				sidecars.add(endpoints)
+			}
+		}
+	}
+	return sidecars
+}
+
+// indexProxy updates the index of the sidecar proxies when the instances of a service in a datacenter change
+// from old to new, and returns the IDs of the services which the changed proxies proxy for
+func (c *Controller) indexProxy(id string, key ServiceKey, old, new []*api.CatalogService) []string {
+	destinations := connectDestinations(old)
+	for destination := range connectDestinations(new) {
+		destinations[destination] = true
+	}
+
+	state, exists := c.services[id]
+	ids := make([]string, 0, len(destinations))
+	for destination := range destinations {
+		destinationKey := key
+		destinationKey.Name = destination
+		destinationID := destinationKey.serviceID()
+		ids = append(ids, destinationID)
+
+		proxied := false
+		if exists {
+			for _, endpoints := range state.endpoints {
+				if connectDestinations(endpoints)[destination] {
+					proxied = true
+				}
+			}
+		}
+		if proxied {
+			if c.proxies[destinationID] == nil {
+				c.proxies[destinationID] = make(map[string]bool)
+			}
+			c.proxies[destinationID][id] = true
+		} else if c.proxies[destinationID] != nil {
+			delete(c.proxies[destinationID], id)
+			if len(c.proxies[destinationID]) == 0 {
+				delete(c.proxies, destinationID)
+			}
+		}
+	}
+	return ids
+}
+
+func (c *Controller) newServiceEntryWrappers(key ServiceKey, override *serviceOverride,
+	serviceEntries []*convertedServiceEntry) []*serviceregistry.ServiceEntryWrapper {
+	namespace := c.options.targetNamespace(key)
+	if override != nil && override.Namespace != "" {
+		namespace = override.Namespace
+	}
+	labels := make(map[string]string)
+	if key.Namespace != "" {
+		labels[constants.ConsulNamespaceLabel] = key.Namespace
+	}
+	if key.Partition != "" {
+		labels[constants.ConsulPartitionLabel] = key.Partition
+	}
+
+	wrappers := make([]*serviceregistry.ServiceEntryWrapper, 0, len(serviceEntries))
+	for _, serviceEntry := range serviceEntries {
+		wrappers = append(wrappers, &serviceregistry.ServiceEntryWrapper{
+			Service:     key.serviceID(),
+			Name:        serviceEntryName(serviceEntry.spec.Hosts[0]),
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: serviceEntry.annotations,
+			Spec:        serviceEntry.spec,
+		})
+	}
+	return wrappers
+}
+
+// serviceEntryName names a ServiceEntry after its primary host, the wildcard of a host produced by the host templates
+// isn't allowed in a resource name
+func serviceEntryName(host string) string {
+	if strings.HasPrefix(host, "*.") {
+		return "wildcard" + strings.TrimPrefix(host, "*")
+	}
+	return host
+}
+
+// serviceChanged refreshes the cache of a single service with the instances got from the monitor,
+// and notifies the handlers if the ServiceEntries of the service have changed
+func (c *Controller) serviceChanged(key ServiceKey, index uint64, endpoints []*api.CatalogService,
+	localities instanceLocalities) error {
+	for _, event := range c.updateServiceState(key, index, endpoints, localities) {
+		log.Debugf("Service %s changed: %s", event.Service, event.Type)
+		for _, handler := range c.serviceChangeHandlers {
+			handler(event)
+		}
+	}
+	return nil
+}
+
+// overridesChanged refreshes the ServiceEntries of the services whose overrides have changed, and notifies the
+// handlers if the ServiceEntries of the services have changed
+func (c *Controller) overridesChanged(overrides map[string]*serviceOverride) error {
 	c.cacheMutex.Lock()
-	defer c.cacheMutex.Unlock()
-	c.initDone = false
+	changed := make([]string, 0)
+	for id, override := range overrides {
+		if !reflect.DeepEqual(c.overrides[id], override) {
+			changed = append(changed, id)
+		}
+	}
+	for id := range c.overrides {
+		if _, ok := overrides[id]; !ok {
+			changed = append(changed, id)
+		}
+	}
+	c.overrides = overrides
+	events := make([]serviceregistry.ServiceEvent, 0, len(changed))
+	for _, id := range changed {
+		if event, ok := c.refreshServiceEntries(id); ok {
+			events = append(events, event)
+		}
+	}
+	c.cacheMutex.Unlock()
+
+	for _, event := range events {
+		log.Debugf("Service %s changed by its override: %s", event.Service, event.Type)
+		for _, handler := range c.serviceChangeHandlers {
+			handler(event)
+		}
+	}
 	return nil
 }
+
+// protocolsChanged refreshes the ServiceEntries of the services whose protocols declared by the config entries have
+// changed, and notifies the handlers if the ServiceEntries of the services have changed
+func (c *Controller) protocolsChanged(defaults *protocolDefaults) error {
+	c.cacheMutex.Lock()
+	changed := make([]string, 0)
+	for id, state := range c.services {
+		if c.protocols.protocol(state.key) != defaults.protocol(state.key) {
+			changed = append(changed, id)
+		}
+	}
+	c.protocols = defaults
+	sort.Strings(changed)
+	events := make([]serviceregistry.ServiceEvent, 0, len(changed))
+	for _, id := range changed {
+		if event, ok := c.refreshServiceEntries(id); ok {
+			events = append(events, event)
+		}
+	}
+	c.cacheMutex.Unlock()
+
+	for _, event := range events {
+		log.Debugf("Service %s changed by its config entries: %s", event.Service, event.Type)
+		for _, handler := range c.serviceChangeHandlers {
+			handler(event)
+		}
+	}
+	return nil
+}
+
+// updateServiceState caches the instances of a service in a datacenter, and returns the events of the services
+// whose ServiceEntries have changed, which include the services proxied by the service if it's a sidecar proxy
+func (c *Controller) updateServiceState(key ServiceKey, index uint64, endpoints []*api.CatalogService,
+	localities instanceLocalities) []serviceregistry.ServiceEvent {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	id := key.serviceID()
+	state, exists := c.services[id]
+	existed := exists && len(state.endpoints) > 0
+	if endpoints == nil {
+		if !exists {
+			return nil
+		}
+		if _, ok := state.endpoints[key.Datacenter]; !ok {
+			return nil
+		}
+	} else if !exists {
+		state = newServiceState(key)
+		c.services[id] = state
+	} else if lastIndex, ok := state.indexes[key.Datacenter]; ok && lastIndex == index {
+		return nil
+	}
+
+	old := state.endpoints[key.Datacenter]
+	if endpoints == nil {
+		delete(state.indexes, key.Datacenter)
+		delete(state.endpoints, key.Datacenter)
+		delete(state.localities, key.Datacenter)
+	} else {
+		state.indexes[key.Datacenter] = index
+		state.endpoints[key.Datacenter] = endpoints
+		state.localities[key.Datacenter] = localities
+	}
+	destinations := c.indexProxy(id, key, old, endpoints)
+	// The ServiceEntries split off another service may take the name of a service which has been added or removed
+	if existed != (len(state.endpoints) > 0) {
+		destinations = append(destinations, c.namePrefixedServices(key)...)
+	}
+
+	events := make([]serviceregistry.ServiceEvent, 0, 1)
+	for _, changed := range append([]string{id}, destinations...) {
+		if event, ok := c.refreshServiceEntries(changed); ok {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// namePrefixedServices returns the services in the partition and namespace of a service whose names followed by "-"
+// prefix its name, the ServiceEntries split off them are named "<service>-<suffix>"
+func (c *Controller) namePrefixedServices(key ServiceKey) []string {
+	ids := make([]string, 0)
+	for id, state := range c.services {
+		if state.key.Partition == key.Partition && state.key.Namespace == key.Namespace &&
+			strings.HasPrefix(key.Name, state.key.Name+"-") {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// refreshServiceEntries converts the cached instances of a service to ServiceEntries, and returns the event of the
+// service if its ServiceEntries have changed
+func (c *Controller) refreshServiceEntries(id string) (serviceregistry.ServiceEvent, bool) {
+	event := serviceregistry.ServiceEvent{Service: id}
+	state, ok := c.services[id]
+	if !ok {
+		return event, false
+	}
+
+	var serviceEntries []*serviceregistry.ServiceEntryWrapper
+	if len(state.endpoints) == 0 {
+		delete(c.services, id)
+	} else {
+		serviceEntries = c.convertService(state)
+	}
+
+	old := state.serviceEntries
+	state.serviceEntries = serviceEntries
+	switch {
+	case len(old) == 0 && len(serviceEntries) == 0:
+		return event, false
+	case len(old) == 0:
+		event.Type = serviceregistry.EventAdd
+	case len(serviceEntries) == 0:
+		event.Type = serviceregistry.EventDelete
+	case serviceEntriesEqual(old, serviceEntries):
+		return event, false
+	default:
+		event.Type = serviceregistry.EventUpdate
+	}
+	return event, true
+}
+
+func serviceEntriesEqual(a, b []*serviceregistry.ServiceEntryWrapper) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Namespace != b[i].Namespace || !proto.Equal(a[i].Spec, b[i].Spec) ||
+			!reflect.DeepEqual(a[i].Annotations, b[i].Annotations) {
+			return false
+		}
+	}
+	return true
+}
+
+// getServiceInstances gets the instances of a service from either the health API or the catalog API, the instances
+// which are not selected by the query are dropped. It returns nil endpoints if the service is not synchronized since
+// none of its instances is selected.
+func getServiceInstances(client *api.Client, query instanceQuery, name string,
+	q *api.QueryOptions) ([]*api.CatalogService, instanceLocalities, *api.QueryMeta, error) {
+	getInstances := getCatalogService
+	if query.healthCheck {
+		getInstances = getHealthService
+	}
+	q.Filter = query.filter
+	endpoints, kinds, localities, queryMeta, err := getInstances(client, name, q)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	filtered := make([]*api.CatalogService, 0, len(endpoints))
+	filteredLocalities := make(instanceLocalities)
+	for i, endpoint := range endpoints {
+		if query.kinds[kinds[i]] && matchMeta(endpoint, query.requiredMeta) && !isExported(endpoint) {
+			filtered = append(filtered, endpoint)
+			filteredLocalities.add(endpoint, localities.of(endpoint))
+		}
+	}
+	// An empty result of a filter expression means that the service doesn't match it
+	if len(filtered) == 0 && (len(endpoints) > 0 || query.filter != "") {
+		log.Debugf("Service %s is skipped since none of its instances is selected", name)
+		return nil, nil, queryMeta, nil
+	}
+	endpoints = filtered
+
+	// Make sure that the locality of the instances is set even if Consul omits the datacenter
+	if q.Datacenter != "" {
+		for _, endpoint := range endpoints {
+			if endpoint.Datacenter == "" {
+				endpoint.Datacenter = q.Datacenter
+			}
+		}
+	}
+	return endpoints, filteredLocalities, queryMeta, nil
+}
+
+// getHealthService gets the instances of a service, their kinds and their localities from the health API
+func getHealthService(client *api.Client, name string, q *api.QueryOptions) ([]*api.CatalogService,
+	[]api.ServiceKind, instanceLocalities, *api.QueryMeta, error) {
+	var entries []*healthEntryWithLocality
+	queryMeta, err := client.Raw().Query("/v1/health/service/"+name, &entries, q)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	endpoints := make([]*api.CatalogService, 0, len(entries))
+	kinds := make([]api.ServiceKind, 0, len(entries))
+	localities := make(instanceLocalities)
+	for _, entry := range entries {
+		if entry.Service == nil {
+			continue
+		}
+		entry.ServiceEntry.Service = &entry.Service.AgentService
+		endpoint := healthEntryToCatalogService(&entry.ServiceEntry)
+		endpoints = append(endpoints, endpoint)
+		kinds = append(kinds, entry.Service.Kind)
+		localities.add(endpoint, entry.Service.Locality)
+	}
+	return endpoints, kinds, localities, queryMeta, nil
+}
+
+// getCatalogService gets the instances of a service, their kinds and their localities from the catalog API
+func getCatalogService(client *api.Client, name string, q *api.QueryOptions) ([]*api.CatalogService,
+	[]api.ServiceKind, instanceLocalities, *api.QueryMeta, error) {
+	var entries []*catalogServiceWithKind
+	queryMeta, err := client.Raw().Query("/v1/catalog/service/"+name, &entries, q)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	endpoints := make([]*api.CatalogService, 0, len(entries))
+	kinds := make([]api.ServiceKind, 0, len(entries))
+	localities := make(instanceLocalities)
+	for _, entry := range entries {
+		endpoints = append(endpoints, &entry.CatalogService)
+		kinds = append(kinds, entry.ServiceKind)
+		localities.add(&entry.CatalogService, entry.ServiceLocality)
+	}
+	return endpoints, kinds, localities, queryMeta, nil
+}
+
+// healthEntryToCatalogService flattens an entry of the health API into the catalog representation,
+// so that both APIs can share the same conversion code
+func healthEntryToCatalogService(entry *api.ServiceEntry) *api.CatalogService {
+	endpoint := &api.CatalogService{
+		ServiceID:                entry.Service.ID,
+		ServiceName:              entry.Service.Service,
+		ServiceAddress:           entry.Service.Address,
+		ServiceTaggedAddresses:   entry.Service.TaggedAddresses,
+		ServiceTags:              entry.Service.Tags,
+		ServiceMeta:              entry.Service.Meta,
+		ServicePort:              entry.Service.Port,
+		ServiceWeights:           api.Weights(entry.Service.Weights),
+		ServiceEnableTagOverride: entry.Service.EnableTagOverride,
+		ServiceProxy:             entry.Service.Proxy,
+		CreateIndex:              entry.Service.CreateIndex,
+		ModifyIndex:              entry.Service.ModifyIndex,
+		Checks:                   entry.Checks,
+		Namespace:                entry.Service.Namespace,
+	}
+	if entry.Node != nil {
+		endpoint.ID = entry.Node.ID
+		endpoint.Node = entry.Node.Node
+		endpoint.Address = entry.Node.Address
+		endpoint.Datacenter = entry.Node.Datacenter
+		endpoint.TaggedAddresses = entry.Node.TaggedAddresses
+		endpoint.NodeMeta = entry.Node.Meta
+	}
+	return endpoint
+}
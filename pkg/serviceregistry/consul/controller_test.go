@@ -19,22 +19,61 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul/api"
 	istio "istio.io/api/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/aeraki-framework/consul2istio/pkg/constants"
+	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry"
 )
 
+// mockBlockTime emulates a blocking query when the index of the request is up-to-date
+const mockBlockTime = 100 * time.Millisecond
+
 type mockServer struct {
 	server      *httptest.Server
 	services    map[string][]string
 	productpage []*api.CatalogService
 	reviews     []*api.CatalogService
 	rating      []*api.CatalogService
-	lock        sync.Mutex
-	consulIndex int
+	// extra are the instances of the services other than productpage, reviews and rating
+	extra map[string][]*api.CatalogService
+	// kinds are the kinds of the services, services are typical by default
+	kinds       map[string]api.ServiceKind
+	checks      map[string]string
+	datacenters []string
+	namespaces  []string
+	partitions  []string
+	// seenPartitions records the admin partitions of the requests
+	seenPartitions map[string]bool
+	// seenFilters records the filter expressions of the requests
+	seenFilters map[string]bool
+	// queries are the prepared queries, and queryResults are the results of the queries keyed by their IDs
+	queries      []*api.PreparedQueryDefinition
+	queryResults map[string]*api.PreparedQueryExecuteResponse
+	// kv are the values in Consul KV
+	kv map[string]string
+	// configEntries are the config entries keyed by their kinds
+	configEntries map[string][]configEntry
+	// nodeServices are the instances registered through the catalog API keyed by their nodes and IDs
+	nodeServices map[string]map[string]*api.AgentService
+	// rawConfigEntries are the config entries encoded like Consul does keyed by their kinds, they take precedence
+	// over configEntries
+	rawConfigEntries map[string]string
+	lock             sync.Mutex
+	consulIndex      int
+	// serviceIndex is added to consulIndex for the queries on the instances of a service
+	serviceIndex map[string]int
+	// servicesIndex is added to consulIndex for the queries on the service list
+	servicesIndex int
 }
 
 func newServer() *mockServer {
@@ -101,56 +140,239 @@ func newServer() *mockServer {
 			"reviews":     {"version|v1", "version|v2", "version|v3"},
 			"rating":      {"version|v1"},
 		},
-		consulIndex: 1,
+		checks: map[string]string{
+			"172.19.0.7": api.HealthCritical,
+			"172.19.0.8": api.HealthWarning,
+		},
+		extra:          map[string][]*api.CatalogService{},
+		kinds:          map[string]api.ServiceKind{},
+		datacenters:    []string{"dc1", "dc2"},
+		namespaces:     []string{"default", "team-a"},
+		partitions:     []string{"default", "ap1"},
+		seenPartitions: map[string]bool{},
+		seenFilters:    map[string]bool{},
+		queryResults:   map[string]*api.PreparedQueryExecuteResponse{},
+		kv:             map[string]string{},
+		configEntries:  map[string][]configEntry{},
+		consulIndex:    1,
+		serviceIndex:   map[string]int{},
 	}
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.lock.Lock()
+		index := m.index(r.URL.Path)
+		m.lock.Unlock()
+		if r.URL.Query().Get("index") == index {
+			time.Sleep(mockBlockTime)
+		}
+
+		m.lock.Lock()
+		var data []byte
+		datacenter := r.URL.Query().Get("dc")
+		namespace := r.URL.Query().Get("ns")
+		if partition := r.URL.Query().Get("partition"); partition != "" {
+			m.seenPartitions[partition] = true
+		}
+		filter := r.URL.Query().Get("filter")
+		if filter != "" {
+			m.seenFilters[filter] = true
+		}
 		if r.URL.Path == "/v1/catalog/services" {
-			m.lock.Lock()
-			data, _ := json.Marshal(&m.services)
-			w.Header().Set("X-Consul-Index", strconv.Itoa(m.consulIndex))
-			m.lock.Unlock()
-			w.Header().Set("Content-Type", "application/json")
-			_, _ = fmt.Fprintln(w, string(data))
-		} else if r.URL.Path == "/v1/catalog/service/reviews" {
-			m.lock.Lock()
-			data, _ := json.Marshal(&m.reviews)
-			w.Header().Set("X-Consul-Index", strconv.Itoa(m.consulIndex))
-			m.lock.Unlock()
-			w.Header().Set("Content-Type", "application/json")
-			_, _ = fmt.Fprintln(w, string(data))
-		} else if r.URL.Path == "/v1/catalog/service/productpage" {
-			m.lock.Lock()
-			data, _ := json.Marshal(&m.productpage)
-			w.Header().Set("X-Consul-Index", strconv.Itoa(m.consulIndex))
-			m.lock.Unlock()
-			w.Header().Set("Content-Type", "application/json")
-			_, _ = fmt.Fprintln(w, string(data))
-		} else if r.URL.Path == "/v1/catalog/service/rating" {
-			m.lock.Lock()
-			data, _ := json.Marshal(&m.rating)
-			w.Header().Set("X-Consul-Index", strconv.Itoa(m.consulIndex))
-			m.lock.Unlock()
-			w.Header().Set("Content-Type", "application/json")
-			_, _ = fmt.Fprintln(w, string(data))
+			data, _ = json.Marshal(&m.services)
+		} else if r.URL.Path == "/v1/catalog/datacenters" {
+			data, _ = json.Marshal(&m.datacenters)
+		} else if r.URL.Path == "/v1/namespaces" {
+			data, _ = json.Marshal(enterpriseNames(m.namespaces))
+		} else if r.URL.Path == "/v1/partitions" {
+			data, _ = json.Marshal(enterpriseNames(m.partitions))
+		} else if strings.HasPrefix(r.URL.Path, "/v1/catalog/service/") {
+			data, _ = json.Marshal(m.catalogService(strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/"),
+				datacenter, namespace, filter))
+		} else if strings.HasPrefix(r.URL.Path, "/v1/kv/") {
+			data, _ = json.Marshal(m.kvPairs(strings.TrimPrefix(r.URL.Path, "/v1/kv/")))
+		} else if strings.HasPrefix(r.URL.Path, "/v1/config/") {
+			kind := strings.TrimPrefix(r.URL.Path, "/v1/config/")
+			if raw, ok := m.rawConfigEntries[kind]; ok {
+				data = []byte(raw)
+			} else {
+				data, _ = json.Marshal(m.configEntries[kind])
+			}
+		} else if strings.HasPrefix(r.URL.Path, "/v1/catalog/node/") {
+			data = []byte("null")
+			if services, ok := m.nodeServices[strings.TrimPrefix(r.URL.Path, "/v1/catalog/node/")]; ok {
+				data, _ = json.Marshal(&api.CatalogNode{Services: services})
+			}
+		} else if r.URL.Path == "/v1/catalog/register" || r.URL.Path == "/v1/catalog/deregister" {
+			m.updateNodeServices(r)
+			data = []byte("true")
+		} else if r.URL.Path == "/v1/agent/self" {
+			data, _ = json.Marshal(map[string]map[string]string{"Config": {"Datacenter": "dc1"}})
+		} else if r.URL.Path == "/v1/query" {
+			data, _ = json.Marshal(&m.queries)
+		} else if strings.HasPrefix(r.URL.Path, "/v1/query/") && strings.HasSuffix(r.URL.Path, "/execute") {
+			id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/query/"), "/execute")
+			result, ok := m.queryResults[id]
+			if !ok {
+				m.lock.Unlock()
+				http.Error(w, "query not found", http.StatusNotFound)
+				return
+			}
+			data, _ = json.Marshal(result)
+		} else if strings.HasPrefix(r.URL.Path, "/v1/health/service/") {
+			data, _ = json.Marshal(m.healthService(strings.TrimPrefix(r.URL.Path, "/v1/health/service/"),
+				datacenter, namespace, filter))
 		} else {
-			m.lock.Lock()
-			data, _ := json.Marshal(&[]*api.CatalogService{})
-			w.Header().Set("X-Consul-Index", strconv.Itoa(m.consulIndex))
-			m.lock.Unlock()
-			w.Header().Set("Content-Type", "application/json")
-			_, _ = fmt.Fprintln(w, string(data))
+			data, _ = json.Marshal(&[]*api.CatalogService{})
 		}
+		w.Header().Set("X-Consul-Index", m.index(r.URL.Path))
+		m.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintln(w, string(data))
 	}))
 
 	m.server = server
 	return &m
 }
 
+// updateNodeServices applies a registration or deregistration of the catalog API, the caller must hold the lock
+func (m *mockServer) updateNodeServices(r *http.Request) {
+	if m.nodeServices == nil {
+		m.nodeServices = map[string]map[string]*api.AgentService{}
+	}
+	if r.URL.Path == "/v1/catalog/deregister" {
+		deregistration := &api.CatalogDeregistration{}
+		_ = json.NewDecoder(r.Body).Decode(deregistration)
+		delete(m.nodeServices[deregistration.Node], deregistration.ServiceID)
+		return
+	}
+	registration := &api.CatalogRegistration{}
+	_ = json.NewDecoder(r.Body).Decode(registration)
+	if m.nodeServices[registration.Node] == nil {
+		m.nodeServices[registration.Node] = map[string]*api.AgentService{}
+	}
+	m.nodeServices[registration.Node][registration.Service.ID] = registration.Service
+}
+
+// index returns the X-Consul-Index of a path, the caller must hold the lock
+func (m *mockServer) index(path string) string {
+	index := m.consulIndex
+	if path == "/v1/catalog/services" {
+		index += m.servicesIndex
+	}
+	for _, prefix := range []string{"/v1/catalog/service/", "/v1/health/service/"} {
+		if strings.HasPrefix(path, prefix) {
+			index += m.serviceIndex[strings.TrimPrefix(path, prefix)]
+		}
+	}
+	return strconv.Itoa(index)
+}
+
+// kvPairs returns the KV pairs under a prefix sorted by their keys
+func (m *mockServer) kvPairs(prefix string) api.KVPairs {
+	pairs := make(api.KVPairs, 0)
+	for key, value := range m.kv {
+		if strings.HasPrefix(key, prefix) {
+			pairs = append(pairs, &api.KVPair{Key: key, Value: []byte(value)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Key < pairs[j].Key
+	})
+	return pairs
+}
+
+// enterpriseNames returns namespaces or partitions in the format of the Consul Enterprise API
+func enterpriseNames(names []string) []map[string]string {
+	out := make([]map[string]string, 0, len(names))
+	for _, name := range names {
+		out = append(out, map[string]string{"Name": name})
+	}
+	return out
+}
+
+// catalogService returns the instances of a service, the datacenter and namespace of the instances are set to the
+// requested ones. Only the filter expressions in the `ServiceTags contains "<tag>"` format are supported.
+func (m *mockServer) catalogService(name, datacenter, namespace, filter string) []*catalogServiceWithKind {
+	var instances []*api.CatalogService
+	switch name {
+	case "productpage":
+		instances = m.productpage
+	case "reviews":
+		instances = m.reviews
+	case "rating":
+		instances = m.rating
+	default:
+		instances = m.extra[name]
+	}
+
+	out := make([]*catalogServiceWithKind, 0, len(instances))
+	for _, instance := range instances {
+		if tag, err := strconv.Unquote(strings.TrimPrefix(filter, "ServiceTags contains ")); err == nil &&
+			!contains(instance.ServiceTags, tag) {
+			continue
+		}
+		instance := *instance
+		if datacenter != "" {
+			instance.Datacenter = datacenter
+		}
+		instance.Namespace = namespace
+		out = append(out, &catalogServiceWithKind{CatalogService: instance, ServiceKind: m.kinds[name]})
+	}
+	return out
+}
+
+// healthService returns the instances of a service in the format of the health API, the health status
+// of an instance is looked up by its address in checks and defaults to passing
+func (m *mockServer) healthService(name, datacenter, namespace, filter string) []*api.ServiceEntry {
+	instances := m.catalogService(name, datacenter, namespace, filter)
+	entries := make([]*api.ServiceEntry, 0, len(instances))
+	for _, instance := range instances {
+		status, ok := m.checks[instance.ServiceAddress]
+		if !ok {
+			status = api.HealthPassing
+		}
+		entries = append(entries, &api.ServiceEntry{
+			Node: &api.Node{
+				ID:         instance.ID,
+				Node:       instance.Node,
+				Address:    instance.Address,
+				Datacenter: instance.Datacenter,
+			},
+			Service: &api.AgentService{
+				Kind:      instance.ServiceKind,
+				Proxy:     instance.ServiceProxy,
+				ID:        instance.ServiceID,
+				Service:   instance.ServiceName,
+				Tags:      instance.ServiceTags,
+				Meta:      instance.ServiceMeta,
+				Port:      instance.ServicePort,
+				Address:   instance.ServiceAddress,
+				Namespace: instance.Namespace,
+			},
+			Checks: api.HealthChecks{
+				{
+					Node:        instance.Node,
+					CheckID:     "service:" + instance.ServiceID,
+					Status:      status,
+					ServiceID:   instance.ServiceID,
+					ServiceName: instance.ServiceName,
+				},
+			},
+		})
+	}
+	return entries
+}
+
+func newTestArgs(address string) *BootStrapArgs {
+	args := NewConsulBootStrapArgs()
+	args.ConsulAddress = address
+	return args
+}
+
 func TestServiceEntries(t *testing.T) {
 	ts := newServer()
 	defer ts.server.Close()
-	controller, err := NewController(ts.server.URL, "", false)
+	controller, err := NewController(newTestArgs(ts.server.URL))
 	if err != nil {
 		t.Errorf("could not create Consul Controller: %v", err)
 	}
@@ -164,13 +386,13 @@ func TestServiceEntries(t *testing.T) {
 		t.Errorf("ServiceEntries() returned wrong number of service entry => %v, want 3", len(serviceEntries))
 	}
 
-	hostnames := []string{serviceHostname("productpage", ""),
-		serviceHostname("reviews", ""),
-		serviceHostname("rating", "")}
+	hostnames := []string{serviceHostname("productpage", "", ""),
+		serviceHostname("reviews", "", ""),
+		serviceHostname("rating", "", "")}
 	services := map[string]*istio.ServiceEntry{}
 	for _, serviceEntry := range serviceEntries {
-		if len(serviceEntry.Hosts) == 1 {
-			services[serviceEntry.Hosts[0]] = serviceEntry
+		if len(serviceEntry.Spec.Hosts) == 1 {
+			services[serviceEntry.Spec.Hosts[0]] = serviceEntry.Spec
 		}
 	}
 
@@ -180,7 +402,835 @@ func TestServiceEntries(t *testing.T) {
 		}
 	}
 
-	if len(services[serviceHostname("reviews", "")].Endpoints) != 3 {
+	if len(services[serviceHostname("reviews", "", "")].Endpoints) != 3 {
 		t.Errorf("ServiceEntries() get %v endpoints f, want 3", len(serviceEntries))
 	}
 }
+
+func TestServiceEntriesWithHealthCheck(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+
+	tests := []struct {
+		name          string
+		warningPolicy string
+		want          map[string]string
+	}{
+		{
+			name:          "include warning instances",
+			warningPolicy: WarningPolicyInclude,
+			want: map[string]string{
+				"172.19.0.6": api.HealthPassing,
+				"172.19.0.8": api.HealthWarning,
+			},
+		},
+		{
+			name:          "exclude warning instances",
+			warningPolicy: WarningPolicyExclude,
+			want: map[string]string{
+				"172.19.0.6": api.HealthPassing,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := newTestArgs(ts.server.URL)
+			args.EnableHealthCheck = true
+			args.WarningPolicy = tt.warningPolicy
+			controller, err := NewController(args)
+			if err != nil {
+				t.Fatalf("could not create Consul Controller: %v", err)
+			}
+			serviceEntries, err := controller.ServiceEntries()
+			if err != nil {
+				t.Fatalf("client encountered error during ServiceEntries(): %v", err)
+			}
+
+			var reviews *istio.ServiceEntry
+			for _, serviceEntry := range serviceEntries {
+				if serviceEntry.Spec.Hosts[0] == serviceHostname("reviews", "", "") {
+					reviews = serviceEntry.Spec
+				}
+			}
+			if reviews == nil {
+				t.Fatalf("Want host reviews, but it's not in the result of ServiceEntries()")
+			}
+
+			if len(reviews.Endpoints) != len(tt.want) {
+				t.Fatalf("ServiceEntries() get %v endpoints, want %v", len(reviews.Endpoints), len(tt.want))
+			}
+			for _, endpoint := range reviews.Endpoints {
+				status, ok := tt.want[endpoint.Address]
+				if !ok {
+					t.Errorf("ServiceEntries() get unexpected endpoint %v", endpoint.Address)
+				}
+				if endpoint.Labels[healthStatusLabel] != status {
+					t.Errorf("endpoint %v health status => %q, want %q",
+						endpoint.Address, endpoint.Labels[healthStatusLabel], status)
+				}
+			}
+		})
+	}
+
+	args := newTestArgs(ts.server.URL)
+	args.WarningPolicy = "exlude"
+	if _, err := NewController(args); err == nil {
+		t.Errorf("NewController() should fail with an unsupported warning policy")
+	}
+}
+
+func TestServiceChangeEvents(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+	controller, err := NewController(newTestArgs(ts.server.URL))
+	if err != nil {
+		t.Fatalf("could not create Consul Controller: %v", err)
+	}
+
+	var events []serviceregistry.ServiceEvent
+	controller.AppendServiceChangeHandler(func(event serviceregistry.ServiceEvent) {
+		events = append(events, event)
+	})
+
+	reviews := ts.reviews
+	tests := []struct {
+		name      string
+		index     uint64
+		endpoints []*api.CatalogService
+		want      []serviceregistry.ServiceEvent
+	}{
+		{
+			name:      "new service",
+			index:     1,
+			endpoints: reviews,
+			want:      []serviceregistry.ServiceEvent{{Type: serviceregistry.EventAdd, Service: "reviews"}},
+		},
+		{
+			name:      "same index",
+			index:     1,
+			endpoints: reviews[:1],
+		},
+		{
+			name:      "new index without change",
+			index:     2,
+			endpoints: reviews,
+		},
+		{
+			name:      "instances changed",
+			index:     3,
+			endpoints: reviews[:1],
+			want:      []serviceregistry.ServiceEvent{{Type: serviceregistry.EventUpdate, Service: "reviews"}},
+		},
+		{
+			name: "service removed",
+			want: []serviceregistry.ServiceEvent{{Type: serviceregistry.EventDelete, Service: "reviews"}},
+		},
+		{
+			name: "removed service removed again",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events = nil
+			if err := controller.serviceChanged(ServiceKey{Name: "reviews"}, tt.index, tt.endpoints, nil); err != nil {
+				t.Fatalf("serviceChanged() => %v", err)
+			}
+			if len(events) != len(tt.want) {
+				t.Fatalf("serviceChanged() emits %v, want %v", events, tt.want)
+			}
+			for i := range events {
+				if events[i] != tt.want[i] {
+					t.Errorf("serviceChanged() emits %v, want %v", events[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestServiceEntriesMultiDatacenter(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+
+	tests := []struct {
+		name        string
+		datacenters []string
+		mode        string
+		want        map[string][]string
+	}{
+		{
+			name:        "merge instances of all datacenters",
+			datacenters: []string{AllDatacenters},
+			mode:        DatacenterModeMerge,
+			want: map[string][]string{
+				"reviews": {"dc1", "dc1", "dc1", "dc2", "dc2", "dc2"},
+			},
+		},
+		{
+			name:        "split instances of configured datacenters",
+			datacenters: []string{"dc1", "dc2"},
+			mode:        DatacenterModeSplit,
+			want: map[string][]string{
+				"reviews.dc1": {"dc1", "dc1", "dc1"},
+				"reviews.dc2": {"dc2", "dc2", "dc2"},
+			},
+		},
+		{
+			name:        "only configured datacenters",
+			datacenters: []string{"dc2"},
+			mode:        DatacenterModeSplit,
+			want: map[string][]string{
+				"reviews.dc2": {"dc2", "dc2", "dc2"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := newTestArgs(ts.server.URL)
+			args.Datacenters = tt.datacenters
+			args.DatacenterMode = tt.mode
+			controller, err := NewController(args)
+			if err != nil {
+				t.Fatalf("could not create Consul Controller: %v", err)
+			}
+			serviceEntries, err := controller.ServiceEntriesOf("reviews")
+			if err != nil {
+				t.Fatalf("client encountered error during ServiceEntriesOf(): %v", err)
+			}
+
+			if len(serviceEntries) != len(tt.want) {
+				t.Fatalf("ServiceEntriesOf() returned %d ServiceEntries, want %d", len(serviceEntries), len(tt.want))
+			}
+			for _, serviceEntry := range serviceEntries {
+				localities, ok := tt.want[serviceEntry.Spec.Hosts[0]]
+				if !ok {
+					t.Fatalf("ServiceEntriesOf() returned unexpected host %s", serviceEntry.Spec.Hosts[0])
+				}
+				if serviceEntry.Service != "reviews" {
+					t.Errorf("ServiceEntriesOf() returned service %s, want reviews", serviceEntry.Service)
+				}
+				if len(serviceEntry.Spec.Endpoints) != len(localities) {
+					t.Fatalf("ServiceEntriesOf() get %v endpoints, want %v",
+						len(serviceEntry.Spec.Endpoints), len(localities))
+				}
+				for i, endpoint := range serviceEntry.Spec.Endpoints {
+					if endpoint.Locality != localities[i] {
+						t.Errorf("endpoint %d locality => %s, want %s", i, endpoint.Locality, localities[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestServiceEntriesEnterprise(t *testing.T) {
+	type want struct {
+		host      string
+		namespace string
+		labels    map[string]string
+	}
+	tests := []struct {
+		name           string
+		partitions     []string
+		namespaces     []string
+		mode           string
+		want           map[string]want
+		wantPartitions []string
+	}{
+		{
+			name:       "all namespaces in hostname",
+			namespaces: []string{AllNamespaces},
+			mode:       NamespaceModeHostname,
+			want: map[string]want{
+				"default/default/reviews": {
+					host:   "reviews.default",
+					labels: map[string]string{constants.ConsulNamespaceLabel: "default"},
+				},
+				"default/team-a/reviews": {
+					host:   "reviews.team-a",
+					labels: map[string]string{constants.ConsulNamespaceLabel: "team-a"},
+				},
+			},
+		},
+		{
+			name:       "default namespace of a partition",
+			partitions: []string{"ap1"},
+			mode:       NamespaceModeHostname,
+			want: map[string]want{
+				"ap1/default/reviews": {
+					host: "reviews.default.ap1",
+					labels: map[string]string{
+						constants.ConsulNamespaceLabel: "default",
+						constants.ConsulPartitionLabel: "ap1",
+					},
+				},
+			},
+			wantPartitions: []string{"ap1"},
+		},
+		{
+			name:       "all partitions",
+			partitions: []string{AllPartitions},
+			namespaces: []string{"team-a"},
+			mode:       NamespaceModeHostname,
+			want: map[string]want{
+				"default/team-a/reviews": {
+					host: "reviews.team-a.default",
+					labels: map[string]string{
+						constants.ConsulNamespaceLabel: "team-a",
+						constants.ConsulPartitionLabel: "default",
+					},
+				},
+				"ap1/team-a/reviews": {
+					host: "reviews.team-a.ap1",
+					labels: map[string]string{
+						constants.ConsulNamespaceLabel: "team-a",
+						constants.ConsulPartitionLabel: "ap1",
+					},
+				},
+			},
+			wantPartitions: []string{"default", "ap1"},
+		},
+		{
+			name:       "namespace mapped to kubernetes namespace",
+			namespaces: []string{"team-a"},
+			mode:       NamespaceModeKubernetes,
+			want: map[string]want{
+				"default/team-a/reviews": {
+					host:      "reviews",
+					namespace: "team-a",
+					labels:    map[string]string{constants.ConsulNamespaceLabel: "team-a"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newServer()
+			defer ts.server.Close()
+			args := newTestArgs(ts.server.URL)
+			args.ConsulPartitions = tt.partitions
+			args.ConsulNamespaces = tt.namespaces
+			args.NamespaceMode = tt.mode
+			controller, err := NewController(args)
+			if err != nil {
+				t.Fatalf("could not create Consul Controller: %v", err)
+			}
+			serviceEntries, err := controller.ServiceEntries()
+			if err != nil {
+				t.Fatalf("client encountered error during ServiceEntries(): %v", err)
+			}
+
+			got := 0
+			for _, serviceEntry := range serviceEntries {
+				host := serviceEntry.Spec.Hosts[0]
+				if host != "reviews" && !strings.HasPrefix(host, "reviews.") {
+					continue
+				}
+				got++
+				w, ok := tt.want[serviceEntry.Service]
+				if !ok {
+					t.Fatalf("ServiceEntries() returned unexpected service %s", serviceEntry.Service)
+				}
+				if host != w.host {
+					t.Errorf("service %s host => %s, want %s", serviceEntry.Service, host, w.host)
+				}
+				if serviceEntry.Namespace != w.namespace {
+					t.Errorf("service %s namespace => %q, want %q", serviceEntry.Service, serviceEntry.Namespace,
+						w.namespace)
+				}
+				if !reflect.DeepEqual(serviceEntry.Labels, w.labels) {
+					t.Errorf("service %s labels => %v, want %v", serviceEntry.Service, serviceEntry.Labels, w.labels)
+				}
+			}
+			if got != len(tt.want) {
+				t.Errorf("ServiceEntries() returned %d ServiceEntries of reviews, want %d", got, len(tt.want))
+			}
+
+			ts.lock.Lock()
+			defer ts.lock.Unlock()
+			if len(ts.seenPartitions) != len(tt.wantPartitions) {
+				t.Errorf("queried partitions %v, want %v", ts.seenPartitions, tt.wantPartitions)
+			}
+			for _, partition := range tt.wantPartitions {
+				if !ts.seenPartitions[partition] {
+					t.Errorf("partition %s is not queried", partition)
+				}
+			}
+		})
+	}
+}
+
+func TestServiceEntriesFilter(t *testing.T) {
+	tests := []struct {
+		name         string
+		include      string
+		exclude      string
+		requiredTags []string
+		requiredMeta []string
+		filter       string
+		ignored      string
+		wantHosts    []string
+	}{
+		{
+			name:      "no filter",
+			wantHosts: []string{"productpage", "rating", "reviews"},
+		},
+		{
+			name:      "include and exclude by name",
+			include:   "^(productpage|reviews|rating)$",
+			exclude:   "^rat",
+			wantHosts: []string{"productpage", "reviews"},
+		},
+		{
+			name:         "required tags",
+			requiredTags: []string{"version|v2"},
+			wantHosts:    []string{"reviews"},
+		},
+		{
+			name:      "ignore tag",
+			ignored:   "productpage",
+			wantHosts: []string{"rating", "reviews"},
+		},
+		{
+			name:         "required meta",
+			requiredMeta: []string{protocolTagName + "=tcp"},
+			wantHosts:    []string{"reviews"},
+		},
+		{
+			name:      "consul filter expression",
+			filter:    `ServiceTags contains "version|v1"`,
+			wantHosts: []string{"productpage", "rating", "reviews"},
+		},
+		{
+			name:      "consul filter expression without match",
+			filter:    `ServiceTags contains "version|v3"`,
+			wantHosts: []string{"reviews"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newServer()
+			defer ts.server.Close()
+			if tt.ignored != "" {
+				ts.services[tt.ignored] = append(ts.services[tt.ignored], IgnoreTag)
+			}
+			args := newTestArgs(ts.server.URL)
+			args.IncludeServices = tt.include
+			args.ExcludeServices = tt.exclude
+			args.RequiredTags = tt.requiredTags
+			args.RequiredMeta = tt.requiredMeta
+			args.Filter = tt.filter
+			controller, err := NewController(args)
+			if err != nil {
+				t.Fatalf("could not create Consul Controller: %v", err)
+			}
+			serviceEntries, err := controller.ServiceEntries()
+			if err != nil {
+				t.Fatalf("client encountered error during ServiceEntries(): %v", err)
+			}
+
+			hosts := make([]string, 0, len(serviceEntries))
+			for _, serviceEntry := range serviceEntries {
+				hosts = append(hosts, serviceEntry.Spec.Hosts[0])
+			}
+			sort.Strings(hosts)
+			if !reflect.DeepEqual(hosts, tt.wantHosts) {
+				t.Errorf("ServiceEntries() returned hosts %v, want %v", hosts, tt.wantHosts)
+			}
+
+			ts.lock.Lock()
+			defer ts.lock.Unlock()
+			if tt.filter != "" && !ts.seenFilters[tt.filter] {
+				t.Errorf("filter expression %s is not passed to Consul", tt.filter)
+			}
+		})
+	}
+
+	if _, err := NewController(&BootStrapArgs{IncludeServices: "("}); err == nil {
+		t.Errorf("NewController() should fail with an invalid regular expression")
+	}
+}
+
+func TestServiceEntriesWithOverrides(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+	ts.kv["consul2istio/overrides/reviews"] = `{
+		"protocols": {"9080": "http", "9081": "grpc"},
+		"location": "MESH_EXTERNAL",
+		"resolution": "DNS",
+		"exportTo": ["."],
+		"hosts": ["reviews.example.com"],
+		"namespace": "bookinfo"
+	}`
+	ts.kv["consul2istio/overrides/rating"] = `{"location": "NOWHERE"}`
+	args := newTestArgs(ts.server.URL)
+	args.OverridePrefix = "consul2istio/overrides/"
+	controller, err := NewController(args)
+	if err != nil {
+		t.Fatalf("could not create Consul Controller: %v", err)
+	}
+
+	serviceEntries, err := controller.ServiceEntriesOf("reviews")
+	if err != nil {
+		t.Fatalf("client encountered error during ServiceEntriesOf(): %v", err)
+	}
+	if len(serviceEntries) != 1 {
+		t.Fatalf("ServiceEntriesOf() returned %d ServiceEntries, want 1", len(serviceEntries))
+	}
+	serviceEntry := serviceEntries[0]
+	if serviceEntry.Namespace != "bookinfo" {
+		t.Errorf("namespace => %q, want bookinfo", serviceEntry.Namespace)
+	}
+	spec := serviceEntry.Spec
+	if !reflect.DeepEqual(spec.Hosts, []string{"reviews", "reviews.example.com"}) {
+		t.Errorf("hosts => %v, want the extra host", spec.Hosts)
+	}
+	if spec.Location != istio.ServiceEntry_MESH_EXTERNAL || spec.Resolution != istio.ServiceEntry_DNS {
+		t.Errorf("location and resolution => %v %v, want MESH_EXTERNAL DNS", spec.Location, spec.Resolution)
+	}
+	if !reflect.DeepEqual(spec.ExportTo, []string{"."}) {
+		t.Errorf("exportTo => %v, want [.]", spec.ExportTo)
+	}
+	protocols := make(map[uint32]string)
+	for _, port := range spec.Ports {
+		protocols[port.Number] = port.Protocol
+	}
+	if !reflect.DeepEqual(protocols, map[uint32]string{9080: "HTTP", 9081: "GRPC"}) {
+		t.Errorf("protocols => %v, want the overridden ones", protocols)
+	}
+
+	// The invalid override of rating is ignored
+	serviceEntries, err = controller.ServiceEntriesOf("rating")
+	if err != nil {
+		t.Fatalf("client encountered error during ServiceEntriesOf(): %v", err)
+	}
+	if len(serviceEntries) != 1 || serviceEntries[0].Spec.Location != istio.ServiceEntry_MESH_INTERNAL {
+		t.Errorf("ServiceEntriesOf(rating) => %v, want the invalid override ignored", serviceEntries)
+	}
+
+	var events []serviceregistry.ServiceEvent
+	controller.AppendServiceChangeHandler(func(event serviceregistry.ServiceEvent) {
+		events = append(events, event)
+	})
+	overrides := map[string]*serviceOverride{
+		"productpage": {ExportTo: []string{"*"}},
+	}
+	if err := controller.overridesChanged(overrides); err != nil {
+		t.Fatalf("overridesChanged() => %v", err)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Service < events[j].Service
+	})
+	want := []serviceregistry.ServiceEvent{
+		{Type: serviceregistry.EventUpdate, Service: "productpage"},
+		{Type: serviceregistry.EventUpdate, Service: "reviews"},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("overridesChanged() emits %v, want %v", events, want)
+	}
+}
+
+func TestServiceEntriesWithConfigEntryProtocols(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+	ts.configEntries[api.ServiceDefaults] = []configEntry{
+		{Kind: api.ServiceDefaults, Name: "reviews", Protocol: "http"},
+	}
+	ts.configEntries[api.ProxyDefaults] = []configEntry{
+		{Kind: api.ProxyDefaults, Name: api.ProxyConfigGlobal, Config: map[string]interface{}{"protocol": "grpc"}},
+	}
+	args := newTestArgs(ts.server.URL)
+	args.ConfigEntryProtocols = true
+	controller, err := NewController(args)
+	if err != nil {
+		t.Fatalf("could not create Consul Controller: %v", err)
+	}
+
+	protocols := func(service string) map[string]string {
+		serviceEntries, err := controller.ServiceEntriesOf(service)
+		if err != nil {
+			t.Fatalf("client encountered error during ServiceEntriesOf(): %v", err)
+		}
+		if len(serviceEntries) != 1 {
+			t.Fatalf("ServiceEntriesOf(%s) returned %d ServiceEntries, want 1", service, len(serviceEntries))
+		}
+		out := make(map[string]string)
+		for _, port := range serviceEntries[0].Spec.Ports {
+			out[port.Name] = port.Protocol
+		}
+		return out
+	}
+
+	// The protocol meta of an instance takes precedence over the service-defaults, which takes precedence over
+	// the proxy-defaults
+	wantProtocols := map[string]string{"http-9081": "HTTP", "tcp-9080": "TCP"}
+	if got := protocols("reviews"); !reflect.DeepEqual(got, wantProtocols) {
+		t.Errorf("protocols of reviews => %v, want %v", got, wantProtocols)
+	}
+	if got, want := protocols("rating"), map[string]string{"grpc-9080": "GRPC"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("protocols of rating => %v, want %v", got, want)
+	}
+
+	var events []serviceregistry.ServiceEvent
+	controller.AppendServiceChangeHandler(func(event serviceregistry.ServiceEvent) {
+		events = append(events, event)
+	})
+	defaults := newProtocolDefaults(ts.configEntries[api.ProxyDefaults])
+	if err := controller.protocolsChanged(defaults); err != nil {
+		t.Fatalf("protocolsChanged() => %v", err)
+	}
+	want := []serviceregistry.ServiceEvent{{Type: serviceregistry.EventUpdate, Service: "reviews"}}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("protocolsChanged() emits %v, want %v", events, want)
+	}
+	wantProtocols = map[string]string{"grpc-9081": "GRPC", "tcp-9080": "TCP"}
+	if got := protocols("reviews"); !reflect.DeepEqual(got, wantProtocols) {
+		t.Errorf("protocols of reviews => %v, want %v", got, wantProtocols)
+	}
+}
+
+func TestServiceEntriesConnect(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+	ts.services["reviews-sidecar-proxy"] = []string{}
+	ts.kinds["reviews-sidecar-proxy"] = api.ServiceKindConnectProxy
+	ts.extra["reviews-sidecar-proxy"] = []*api.CatalogService{
+		{
+			Node:           "istio-node",
+			Address:        "172.19.0.5",
+			ServiceID:      "reviews-id-sidecar-proxy",
+			ServiceName:    "reviews-sidecar-proxy",
+			ServiceAddress: "172.19.0.20",
+			ServicePort:    21000,
+			ServiceProxy: &api.AgentServiceConnectProxyConfig{
+				DestinationServiceName: "reviews",
+				DestinationServiceID:   "reviews-id",
+			},
+		},
+	}
+	ts.services["mesh-gateway"] = []string{}
+	ts.kinds["mesh-gateway"] = api.ServiceKindMeshGateway
+	ts.extra["mesh-gateway"] = []*api.CatalogService{
+		{
+			Node:           "istio-node",
+			Address:        "172.19.0.5",
+			ServiceID:      "mesh-gateway",
+			ServiceName:    "mesh-gateway",
+			ServiceAddress: "172.19.0.30",
+			ServicePort:    8443,
+		},
+	}
+
+	tests := []struct {
+		name           string
+		healthCheck    bool
+		syncGateways   bool
+		connectSidecar bool
+		wantHosts      []string
+		wantTargetPort uint32
+	}{
+		{
+			name:           "skip proxies and gateways",
+			wantHosts:      []string{"productpage", "rating", "reviews"},
+			wantTargetPort: 9081,
+		},
+		{
+			name:           "sync gateways",
+			healthCheck:    true,
+			syncGateways:   true,
+			wantHosts:      []string{"mesh-gateway", "productpage", "rating", "reviews"},
+			wantTargetPort: 9081,
+		},
+		{
+			name:           "point endpoints to sidecars",
+			connectSidecar: true,
+			wantHosts:      []string{"productpage", "rating", "reviews"},
+			wantTargetPort: 21000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := newTestArgs(ts.server.URL)
+			args.EnableHealthCheck = tt.healthCheck
+			args.SyncGateways = tt.syncGateways
+			args.ConnectSidecar = tt.connectSidecar
+			controller, err := NewController(args)
+			if err != nil {
+				t.Fatalf("could not create Consul Controller: %v", err)
+			}
+			serviceEntries, err := controller.ServiceEntries()
+			if err != nil {
+				t.Fatalf("client encountered error during ServiceEntries(): %v", err)
+			}
+
+			hosts := make([]string, 0, len(serviceEntries))
+			var reviews *istio.ServiceEntry
+			for _, serviceEntry := range serviceEntries {
+				hosts = append(hosts, serviceEntry.Spec.Hosts[0])
+				if serviceEntry.Spec.Hosts[0] == "reviews" {
+					reviews = serviceEntry.Spec
+				}
+			}
+			sort.Strings(hosts)
+			if !reflect.DeepEqual(hosts, tt.wantHosts) {
+				t.Fatalf("ServiceEntries() returned hosts %v, want %v", hosts, tt.wantHosts)
+			}
+
+			endpoint := reviews.Endpoints[0]
+			if port := endpoint.Ports["tcp-9081"]; port != tt.wantTargetPort {
+				t.Errorf("reviews endpoint target port => %d, want %d", port, tt.wantTargetPort)
+			}
+			if tt.connectSidecar && endpoint.Address != "172.19.0.20" {
+				t.Errorf("reviews endpoint address => %s, want the address of the sidecar", endpoint.Address)
+			}
+		})
+	}
+}
+
+func TestSidecarChangeEvents(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+	args := newTestArgs(ts.server.URL)
+	args.ConnectSidecar = true
+	controller, err := NewController(args)
+	if err != nil {
+		t.Fatalf("could not create Consul Controller: %v", err)
+	}
+
+	var events []serviceregistry.ServiceEvent
+	controller.AppendServiceChangeHandler(func(event serviceregistry.ServiceEvent) {
+		events = append(events, event)
+	})
+
+	sidecar := &api.CatalogService{
+		Node:           "istio-node",
+		ServiceID:      "reviews-id-sidecar-proxy",
+		ServiceName:    "reviews-sidecar-proxy",
+		ServiceAddress: "172.19.0.20",
+		ServicePort:    21000,
+		ServiceProxy: &api.AgentServiceConnectProxyConfig{
+			DestinationServiceName: "reviews",
+			DestinationServiceID:   "reviews-id",
+		},
+	}
+	tests := []struct {
+		name      string
+		service   string
+		index     uint64
+		endpoints []*api.CatalogService
+		want      []serviceregistry.ServiceEvent
+	}{
+		{
+			name:      "service without sidecar",
+			service:   "reviews",
+			index:     1,
+			endpoints: ts.reviews,
+			want:      []serviceregistry.ServiceEvent{{Type: serviceregistry.EventAdd, Service: "reviews"}},
+		},
+		{
+			name:      "sidecar added",
+			service:   "reviews-sidecar-proxy",
+			index:     1,
+			endpoints: []*api.CatalogService{sidecar},
+			want:      []serviceregistry.ServiceEvent{{Type: serviceregistry.EventUpdate, Service: "reviews"}},
+		},
+		{
+			name:    "sidecar removed",
+			service: "reviews-sidecar-proxy",
+			want:    []serviceregistry.ServiceEvent{{Type: serviceregistry.EventUpdate, Service: "reviews"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events = nil
+			if err := controller.serviceChanged(ServiceKey{Name: tt.service}, tt.index, tt.endpoints, nil); err != nil {
+				t.Fatalf("serviceChanged() => %v", err)
+			}
+			if !reflect.DeepEqual(events, tt.want) {
+				t.Errorf("serviceChanged() emits %v, want %v", events, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitServiceEntryNameCollision(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+	controller, err := NewController(newTestArgs(ts.server.URL))
+	if err != nil {
+		t.Fatalf("could not create Consul Controller: %v", err)
+	}
+	var events []serviceregistry.ServiceEvent
+	controller.AppendServiceChangeHandler(func(event serviceregistry.ServiceEvent) {
+		events = append(events, event)
+	})
+
+	instance := func(service, address, external string) *api.CatalogService {
+		endpoint := &api.CatalogService{ServiceName: service, ServiceAddress: address, ServicePort: 8080}
+		if external != "" {
+			endpoint.ServiceMeta = map[string]string{externalTagName: external}
+		}
+		return endpoint
+	}
+	names := func() []string {
+		out := make([]string, 0)
+		for _, serviceEntry := range controller.services["payment"].serviceEntries {
+			out = append(out, serviceEntry.Name)
+		}
+		return out
+	}
+	mustChange := func(service string, index uint64, endpoints []*api.CatalogService) {
+		events = nil
+		if err := controller.serviceChanged(ServiceKey{Name: service}, index, endpoints, nil); err != nil {
+			t.Fatalf("serviceChanged() => %v", err)
+		}
+	}
+
+	mustChange("payment", 1, []*api.CatalogService{
+		instance("payment", "10.0.0.1", ""),
+		instance("payment", "10.0.0.2", "legacy"),
+		instance("payment", "10.0.0.3", "pay.example.com"),
+	})
+	if got, want := names(), []string{"payment", "payment-legacy", "payment-pay-example-com"}; !reflect.DeepEqual(got,
+		want) {
+		t.Fatalf("ServiceEntries of payment => %v, want %v", got, want)
+	}
+
+	// A Consul service named like the split ServiceEntry keeps its name, the external instances are skipped
+	mustChange("payment-legacy", 1, []*api.CatalogService{instance("payment-legacy", "10.0.1.1", "")})
+	wantEvents := []serviceregistry.ServiceEvent{
+		{Type: serviceregistry.EventAdd, Service: "payment-legacy"},
+		{Type: serviceregistry.EventUpdate, Service: "payment"},
+	}
+	if !reflect.DeepEqual(events, wantEvents) {
+		t.Errorf("serviceChanged() emits %v, want %v", events, wantEvents)
+	}
+	if got, want := names(), []string{"payment", "payment-pay-example-com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ServiceEntries of payment => %v, want %v", got, want)
+	}
+
+	// The external instances are converted again once the service is removed
+	mustChange("payment-legacy", 0, nil)
+	if got, want := names(), []string{"payment", "payment-legacy", "payment-pay-example-com"}; !reflect.DeepEqual(got,
+		want) {
+		t.Errorf("ServiceEntries of payment => %v, want %v", got, want)
+	}
+}
+
+func TestServiceEntryName(t *testing.T) {
+	for host, want := range map[string]string{
+		"reviews.consul":   "reviews.consul",
+		"*.reviews.consul": "wildcard.reviews.consul",
+	} {
+		name := serviceEntryName(host)
+		if name != want || len(validation.IsDNS1123Subdomain(name)) > 0 {
+			t.Errorf("serviceEntryName(%s) => %s, want the valid name %s", host, name, want)
+		}
+	}
+}
@@ -16,33 +16,211 @@ package consul
 
 import (
 	"fmt"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"text/template"
 
 	"github.com/hashicorp/consul/api"
 	istio "istio.io/api/networking/v1alpha3"
-	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/protocol"
 	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/aeraki-framework/consul2istio/pkg/constants"
 )
 
 const (
 	protocolTagName    = "protocol"
 	externalTagName    = "external"
 	defaultServicePort = 80
+
+	// portMetaPrefix is the prefix of the meta keys which declare the additional ports of an instance,
+	// "port-<name>=<number>" declares a port named <name>
+	portMetaPrefix = "port-"
+	// portProtocolMetaPrefix is the prefix of the meta keys which declare the protocols of the additional ports,
+	// "protocol-<name>=<protocol>" declares the protocol of the port named <name>
+	portProtocolMetaPrefix = "protocol-"
+
+	// healthStatusLabel records the aggregated Consul health status of an instance
+	healthStatusLabel = "consul-health-status"
+
+	// dnsHostSuffix is appended to the name of a service which mixes IP and hostname addresses, the instances with
+	// hostname addresses are split into a ServiceEntry on the suffixed hostname
+	dnsHostSuffix = "-dns"
 )
 
-func convertServiceEntry(enableDefaultPort bool, fqdn, service string, endpoints []*api.CatalogService) *istio.ServiceEntry {
+// convertOptions controls how Consul services are converted to Istio ServiceEntries
+type convertOptions struct {
+	enableDefaultPort bool
+	fqdn              string
+	healthCheck       bool
+	warningPolicy     string
+	datacenterMode    string
+	namespaceMode     string
+	labels            labelOptions
+	locality          localityOptions
+	// hostnameResolution is the resolution of the ServiceEntries whose instances have hostname addresses
+	hostnameResolution istio.ServiceEntry_Resolution
+	// addressPreference are the address types of the instances in the order of preference, the WorkloadEntries
+	// record the chosen type in a label if it's set
+	addressPreference []string
+	// hostTemplates produce the hosts of the ServiceEntries, the default hostname is used if it's empty
+	hostTemplates []*template.Template
+	// tagHosts are the tags which get a ServiceEntry of the instances with the tag on "<tag>.<host>"
+	tagHosts []string
+	// defaultProtocol is the protocol of the instances without a "protocol" meta, which is declared by the config
+	// entries of the service being converted
+	defaultProtocol string
+	// localities are the Consul localities of the instances of the service being converted
+	localities instanceLocalities
+	// serviceExists tells whether a Consul service is synchronized in the partition and namespace of the service
+	// being converted, the ServiceEntries split off the service are skipped if a service takes their names
+	serviceExists func(name string) bool
+}
+
+func newConvertOptions(args *BootStrapArgs) (*convertOptions, error) {
+	hostTemplates, err := parseHostTemplates(args.HostTemplates)
+	if err != nil {
+		return nil, err
+	}
+	locality, err := newLocalityOptions(args)
+	if err != nil {
+		return nil, err
+	}
+	addressPreference, err := parseAddressPreference(args.AddressPreference)
+	if err != nil {
+		return nil, err
+	}
+	hostnameResolution := istio.ServiceEntry_DNS
+	switch args.HostnameResolution {
+	case "", istio.ServiceEntry_DNS.String():
+	case istio.ServiceEntry_DNS_ROUND_ROBIN.String():
+		hostnameResolution = istio.ServiceEntry_DNS_ROUND_ROBIN
+	default:
+		return nil, fmt.Errorf("unsupported hostname resolution %s", args.HostnameResolution)
+	}
+	switch args.WarningPolicy {
+	case "", WarningPolicyInclude, WarningPolicyExclude:
+	default:
+		return nil, fmt.Errorf("unsupported warning policy %s", args.WarningPolicy)
+	}
+	tagHosts := make([]string, 0, len(args.TagHosts))
+	for _, tag := range args.TagHosts {
+		tag = strings.ToLower(tag)
+		if errs := validation.IsDNS1123Label(tag); len(errs) > 0 {
+			return nil, fmt.Errorf("tag %s can't be a part of a host: %s", tag, strings.Join(errs, "; "))
+		}
+		tagHosts = append(tagHosts, tag)
+	}
+	return &convertOptions{
+		enableDefaultPort:  args.EnableDefaultPort,
+		fqdn:               args.FQDN,
+		healthCheck:        args.EnableHealthCheck,
+		warningPolicy:      args.WarningPolicy,
+		datacenterMode:     args.DatacenterMode,
+		namespaceMode:      args.NamespaceMode,
+		labels:             newLabelOptions(args),
+		hostTemplates:      hostTemplates,
+		locality:           locality,
+		addressPreference:  addressPreference,
+		hostnameResolution: hostnameResolution,
+		tagHosts:           tagHosts,
+	}, nil
+}
+
+// qualifiedName returns the name of a Consul service qualified with its namespace and partition, which is used to
+// build the hostname of the ServiceEntry. The namespace is left out if it's mapped to a Kubernetes namespace.
+func (o *convertOptions) qualifiedName(key ServiceKey) string {
+	name := key.Name
+	if key.Namespace != "" && o.namespaceMode != NamespaceModeKubernetes {
+		name = fmt.Sprintf("%s.%s", name, key.Namespace)
+	}
+	if key.Partition != "" {
+		name = fmt.Sprintf("%s.%s", name, key.Partition)
+	}
+	return name
+}
+
+// nameTaken tells whether the name of a ServiceEntry split off the service being converted is the name of a Consul
+// service, whose ServiceEntry would be overwritten by the split one
+func (o *convertOptions) nameTaken(name string) bool {
+	return o.serviceExists != nil && o.serviceExists(name)
+}
+
+// targetNamespace returns the Kubernetes namespace of the ServiceEntries of a Consul service,
+// empty for the namespace configured for consul2istio
+func (o *convertOptions) targetNamespace(key ServiceKey) string {
+	if o.namespaceMode != NamespaceModeKubernetes {
+		return ""
+	}
+	return key.Namespace
+}
+
+// isHealthy tells whether an instance should receive traffic according to its Consul health checks
+func (o *convertOptions) isHealthy(endpoint *api.CatalogService) bool {
+	if !o.healthCheck {
+		return true
+	}
+	switch endpoint.Checks.AggregatedStatus() {
+	case api.HealthPassing:
+		return true
+	case api.HealthWarning:
+		return o.warningPolicy != WarningPolicyExclude
+	default:
+		return false
+	}
+}
+
+// weight returns the weight of an instance, which is the warning weight if the health status of the instance is
+// warning, or the passing weight otherwise. It's 0 if the instance has no weights.
+func (o *convertOptions) weight(endpoint *api.CatalogService) uint32 {
+	weight := endpoint.ServiceWeights.Passing
+	if o.healthCheck && endpoint.Checks.AggregatedStatus() == api.HealthWarning {
+		weight = endpoint.ServiceWeights.Warning
+	}
+	if weight < 0 {
+		return 0
+	}
+	return uint32(weight)
+}
+
+// protocol returns the protocol of the main port of an instance, which is its "protocol" meta or the default protocol
+func (o *convertOptions) protocol(endpoint *api.CatalogService) string {
+	if protocol := endpoint.ServiceMeta[protocolTagName]; protocol != "" {
+		return protocol
+	}
+	return o.defaultProtocol
+}
+
+// convertServiceEntry converts the instances of a Consul service to a ServiceEntry, datacenter is only set when the
+// instances of the service in each datacenter are converted to a separate ServiceEntry.
+// The instances with a sidecar proxy in sidecars are reached through their sidecars.
+func convertServiceEntry(opts *convertOptions, service, datacenter string,
+	endpoints []*api.CatalogService, sidecars connectSidecars) *istio.ServiceEntry {
 	name := ""
 	location := istio.ServiceEntry_MESH_INTERNAL
 	resolution := istio.ServiceEntry_STATIC
 	ports := make(map[uint32]*istio.Port)
 	workloadEntries := make([]*istio.WorkloadEntry, 0)
+	hasHostname := false
 
 	for _, endpoint := range endpoints {
 		name = endpoint.ServiceName
+		if !opts.isHealthy(endpoint) {
+			log.Debugf("Instance %s of service %s is skipped since its health status is %s",
+				endpoint.ServiceID, name, endpoint.Checks.AggregatedStatus())
+			continue
+		}
+		// Istio treats a zero weight as the default one, the instances Consul gives no traffic are left out instead
+		if endpoint.ServiceWeights.Passing > 0 && opts.weight(endpoint) == 0 {
+			log.Debugf("Instance %s of service %s is skipped since its weight is 0 in health status %s",
+				endpoint.ServiceID, name, endpoint.Checks.AggregatedStatus())
+			continue
+		}
 
-		port := convertPort(endpoint.ServicePort, endpoint.ServiceMeta[protocolTagName])
+		port := convertPort(endpoint.ServicePort, opts.protocol(endpoint))
 
 		if svcPort, exists := ports[port.Number]; exists && svcPort.Protocol != port.Protocol {
 			log.Infof("Service %v has two instances on same port %v but different protocols (%v, %v)",
@@ -50,26 +228,67 @@ func convertServiceEntry(enableDefaultPort bool, fqdn, service string, endpoints
 		} else {
 			ports[port.Number] = port
 		}
-		if enableDefaultPort {
+		if opts.enableDefaultPort {
 			ports[defaultServicePort] = convertPort(defaultServicePort, "")
 		}
+		for _, namedPort := range convertNamedPorts(endpoint) {
+			if svcPort, exists := ports[namedPort.Number]; exists && svcPort.Name != namedPort.Name {
+				log.Infof("Port %v of service %v is declared as both %v and %v, the latter is ignored",
+					namedPort.Number, name, svcPort.Name, namedPort.Name)
+				continue
+			}
+			// The instances may listen on different numbers for the same port name, the WorkloadEntries map
+			// the port of the ServiceEntry to the number of each instance
+			if portNamed(ports, namedPort.Name) == nil {
+				ports[namedPort.Number] = namedPort
+			}
+		}
 
-		// TODO This will not work if service is a mix of external and local services
-		// or if a service has more than one external name
+		// The instances are split by convertServiceEntries so that they are either all internal or all external.
+		// The external instances keep the STATIC or DNS resolution, Istio rejects endpoints with NONE resolution.
 		if endpoint.ServiceMeta[externalTagName] != "" {
 			location = istio.ServiceEntry_MESH_EXTERNAL
-			resolution = istio.ServiceEntry_NONE
 		}
 
-		workloadEntries = append(workloadEntries, convertWorkloadEntry(enableDefaultPort, endpoint))
+		workloadEntry := convertWorkloadEntry(opts, endpoint, sidecars.of(endpoint))
+		hasHostname = hasHostname || isHostname(workloadEntry.Address)
+		workloadEntries = append(workloadEntries, workloadEntry)
+	}
+	// Istio only accepts IP addresses in the endpoints of a ServiceEntry with STATIC resolution,
+	// the DNS resolutions accept both hostnames and IP addresses
+	if hasHostname {
+		resolution = opts.hostnameResolution
+		// Istio only accepts a single endpoint in a ServiceEntry with DNS_ROUND_ROBIN resolution
+		if resolution == istio.ServiceEntry_DNS_ROUND_ROBIN && len(workloadEntries) > 1 {
+			log.Debugf("Service %s falls back to DNS resolution since it has %d instances with hostnames", name,
+				len(workloadEntries))
+			resolution = istio.ServiceEntry_DNS
+		}
 	}
 
 	svcPorts := make([]*istio.Port, 0, len(ports))
 	for _, port := range ports {
 		svcPorts = append(svcPorts, port)
 	}
+	// Sort the ports so the same service always produces the same ServiceEntry
+	sort.Slice(svcPorts, func(i, j int) bool {
+		return svcPorts[i].Number < svcPorts[j].Number
+	})
+	// Istio rejects an endpoint which maps a port the ServiceEntry doesn't define, so the ports dropped because of
+	// a conflict are dropped from the endpoints too
+	portNames := make(map[string]bool, len(svcPorts))
+	for _, port := range svcPorts {
+		portNames[port.Name] = true
+	}
+	for _, workloadEntry := range workloadEntries {
+		for name := range workloadEntry.Ports {
+			if !portNames[name] {
+				delete(workloadEntry.Ports, name)
+			}
+		}
+	}
 
-	hostname := serviceHostname(service, fqdn)
+	hostname := serviceHostname(service, datacenter, opts.fqdn)
 	out := &istio.ServiceEntry{
 		Hosts:      []string{hostname},
 		Ports:      svcPorts,
@@ -80,42 +299,239 @@ func convertServiceEntry(enableDefaultPort bool, fqdn, service string, endpoints
 	return out
 }
 
-func convertWorkloadEntry(enableDefaultPort bool, endpoint *api.CatalogService) *istio.WorkloadEntry {
-	svcLabels := convertLabels(endpoint.ServiceTags)
-	addr := endpoint.ServiceAddress
-	if addr == "" {
-		addr = endpoint.Address
+// convertedServiceEntry is a ServiceEntry converted from a group of instances of a Consul service
+type convertedServiceEntry struct {
+	spec *istio.ServiceEntry
+	// annotations are the annotations of the ServiceEntry resource
+	annotations map[string]string
+}
+
+// convertServiceEntries converts the instances of a Consul service to ServiceEntries. A ServiceEntry is either
+// internal or external to the mesh, so a service which mixes internal instances with external ones, or whose
+// external instances have several external names, is split into an internal ServiceEntry on the hostname of the
+// service and an external ServiceEntry for each external name. The conflict is logged and recorded in the
+// annotations of the ServiceEntries. The host templates and tag hosts apply to the ServiceEntry on the hostname of
+// the service.
+//
+// The external instances are always reachable on the same host "<service>-<external name>", so that their host
+// doesn't change when a conflict appears or goes away. A service whose instances all have the same external name is
+// also reachable on its own hostname.
+func convertServiceEntries(opts *convertOptions, key ServiceKey, datacenter string,
+	endpoints []*api.CatalogService, sidecars connectSidecars) []*convertedServiceEntry {
+	service := opts.qualifiedName(key)
+	internal := make([]*api.CatalogService, 0, len(endpoints))
+	external := make(map[string][]*api.CatalogService)
+	for _, endpoint := range endpoints {
+		if name := endpoint.ServiceMeta[externalTagName]; name != "" {
+			external[name] = append(external[name], endpoint)
+		} else {
+			internal = append(internal, endpoint)
+		}
+	}
+
+	externalNames := make([]string, 0, len(external))
+	for name := range external {
+		externalNames = append(externalNames, name)
+	}
+	sort.Strings(externalNames)
+
+	// A service with only one kind of instances is converted as a whole
+	if len(external) == 0 {
+		return convertServiceHosts(opts, key, datacenter, endpoints, sidecars, nil)
+	}
+	if len(internal) == 0 && len(external) == 1 {
+		serviceEntries := convertServiceHosts(opts, key, datacenter, endpoints, sidecars, nil)
+		if !opts.nameTaken(externalServiceName(key.Name, externalNames[0])) {
+			serviceEntries[0].spec.Hosts = append(serviceEntries[0].spec.Hosts,
+				externalHostname(externalNames[0], service, datacenter, opts.fqdn))
+		}
+		return serviceEntries
+	}
+
+	var conflict string
+	if len(internal) > 0 {
+		conflict = fmt.Sprintf("mixed internal and external instances, external names: %s",
+			strings.Join(externalNames, ","))
+	} else {
+		conflict = fmt.Sprintf("multiple external names: %s", strings.Join(externalNames, ","))
+	}
+	log.Warnf("Service %s has %s, it's split into a ServiceEntry for each external name", service, conflict)
+	annotations := map[string]string{
+		constants.ExternalConflictAnnotation: conflict,
+	}
+
+	serviceEntries := make([]*convertedServiceEntry, 0, len(external)+1)
+	if len(internal) > 0 {
+		serviceEntries = append(serviceEntries,
+			convertServiceHosts(opts, key, datacenter, internal, sidecars, annotations)...)
+	}
+	for _, name := range externalNames {
+		if taken := externalServiceName(key.Name, name); opts.nameTaken(taken) {
+			log.Warnf("External instances %s of service %s are skipped since their ServiceEntry would take the "+
+				"name of service %s", name, service, taken)
+			continue
+		}
+		serviceEntry := convertServiceEntry(opts, service, datacenter, external[name], sidecars)
+		serviceEntry.Hosts = []string{externalHostname(name, service, datacenter, opts.fqdn)}
+		serviceEntries = append(serviceEntries, &convertedServiceEntry{
+			spec:        serviceEntry,
+			annotations: annotations,
+		})
+	}
+	return serviceEntries
+}
+
+// convertServiceHosts converts the instances of a Consul service to a ServiceEntry on the hostname of the service,
+// and a ServiceEntry on "<tag>.<host>" for each configured tag which the instances have. A tag-scoped ServiceEntry
+// only contains the instances with the tag, like the tag lookups of Consul DNS.
+func convertServiceHosts(opts *convertOptions, key ServiceKey, datacenter string, endpoints []*api.CatalogService,
+	sidecars connectSidecars, annotations map[string]string) []*convertedServiceEntry {
+	ips, hostnames := splitAddresses(opts, endpoints, sidecars)
+	if len(ips) > 0 && len(hostnames) > 0 {
+		service := opts.qualifiedName(key)
+		log.Warnf("Service %s mixes IP and hostname addresses, the instances with hostnames are split into %s",
+			service, service+dnsHostSuffix)
+		conflictAnnotations := map[string]string{
+			constants.AddressConflictAnnotation: "mixed IP and hostname addresses",
+		}
+		for k, v := range annotations {
+			conflictAnnotations[k] = v
+		}
+		serviceEntries := convertServiceHosts(opts, key, datacenter, ips, sidecars, conflictAnnotations)
+		if taken := key.Name + dnsHostSuffix; opts.nameTaken(taken) {
+			log.Warnf("Instances with hostnames of service %s are skipped since their ServiceEntry would take the "+
+				"name of service %s", service, taken)
+			return serviceEntries
+		}
+		dnsServiceEntry := convertServiceEntry(opts, service, datacenter, hostnames, sidecars)
+		dnsServiceEntry.Hosts = []string{serviceHostname(service+dnsHostSuffix, datacenter, opts.fqdn)}
+		return append(serviceEntries, &convertedServiceEntry{
+			spec:        dnsServiceEntry,
+			annotations: conflictAnnotations,
+		})
+	}
+
+	serviceEntry := convertServiceEntry(opts, opts.qualifiedName(key), datacenter, endpoints, sidecars)
+	if hosts := opts.hostnames(key, datacenter, endpoints); hosts != nil {
+		serviceEntry.Hosts = hosts
+	}
+	serviceEntries := []*convertedServiceEntry{{spec: serviceEntry, annotations: annotations}}
+
+	for _, tag := range opts.tagHosts {
+		tagged := make([]*api.CatalogService, 0, len(endpoints))
+		for _, endpoint := range endpoints {
+			if hasTag(endpoint, tag) {
+				tagged = append(tagged, endpoint)
+			}
+		}
+		if len(tagged) == 0 {
+			continue
+		}
+		tagServiceEntry := convertServiceEntry(opts, opts.qualifiedName(key), datacenter, tagged, sidecars)
+		tagServiceEntry.Hosts = make([]string, 0, len(serviceEntry.Hosts))
+		for _, host := range serviceEntry.Hosts {
+			tagServiceEntry.Hosts = append(tagServiceEntry.Hosts, fmt.Sprintf("%s.%s", tag, host))
+		}
+		tagAnnotations := map[string]string{
+			constants.ConsulTagAnnotation: tag,
+		}
+		for k, v := range annotations {
+			tagAnnotations[k] = v
+		}
+		serviceEntries = append(serviceEntries, &convertedServiceEntry{
+			spec:        tagServiceEntry,
+			annotations: tagAnnotations,
+		})
+	}
+	return serviceEntries
+}
+
+// splitAddresses splits the instances of a service into the ones with IP addresses and the ones with hostnames
+func splitAddresses(opts *convertOptions, endpoints []*api.CatalogService,
+	sidecars connectSidecars) ([]*api.CatalogService, []*api.CatalogService) {
+	ips := make([]*api.CatalogService, 0, len(endpoints))
+	hostnames := make([]*api.CatalogService, 0)
+	for _, endpoint := range endpoints {
+		addressed := endpoint
+		if sidecar := sidecars.of(endpoint); sidecar != nil {
+			addressed = sidecar
+		}
+		if address, _, _ := selectAddress(opts.addressPreference, addressed); isHostname(address) {
+			hostnames = append(hostnames, endpoint)
+		} else {
+			ips = append(ips, endpoint)
+		}
+	}
+	return ips, hostnames
+}
+
+// isHostname tells whether an address is a hostname rather than an IP address
+func isHostname(address string) bool {
+	return address != "" && net.ParseIP(address) == nil
+}
+
+// hasTag tells whether an instance has a tag, tags are case-insensitive like in Consul DNS
+func hasTag(endpoint *api.CatalogService, tag string) bool {
+	for _, t := range endpoint.ServiceTags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// externalHostname produces the hostname of the external instances of a service with an external name
+func externalHostname(externalName, service, datacenter, fqdn string) string {
+	return serviceHostname(externalServiceName(service, externalName), datacenter, fqdn)
+}
+
+// externalServiceName names the external instances of a service with an external name, the dots of the external name
+// are replaced so that it stays a single label after the name of the service
+func externalServiceName(service, externalName string) string {
+	return fmt.Sprintf("%s-%s", service, strings.ToLower(strings.ReplaceAll(externalName, ".", "-")))
+}
+
+// convertWorkloadEntry converts an instance to a WorkloadEntry, the WorkloadEntry points to the Connect sidecar proxy
+// of the instance if sidecar is not nil
+func convertWorkloadEntry(opts *convertOptions, endpoint *api.CatalogService,
+	sidecar *api.CatalogService) *istio.WorkloadEntry {
+	svcLabels := convertLabels(opts.labels, endpoint)
+	if opts.healthCheck {
+		svcLabels[healthStatusLabel] = endpoint.Checks.AggregatedStatus()
 	}
 	ports := make(map[string]uint32, 0)
 
-	port := convertPort(endpoint.ServicePort, endpoint.ServiceMeta[protocolTagName])
-	ports[port.Name] = port.Number
+	port := convertPort(endpoint.ServicePort, opts.protocol(endpoint))
+	addressed := endpoint
+	if sidecar != nil {
+		addressed = sidecar
+	}
+	addr, addrPort, addrType := selectAddress(opts.addressPreference, addressed)
+	if len(opts.addressPreference) > 0 {
+		svcLabels[addressTypeLabel] = addrType
+	}
+	targetPort := uint32(addressed.ServicePort)
+	if addrPort != 0 {
+		targetPort = uint32(addrPort)
+	}
+	ports[port.Name] = targetPort
 
-	if enableDefaultPort {
+	if opts.enableDefaultPort {
 		defaultPort := convertPort(defaultServicePort, "")
-		ports[defaultPort.Name] = port.Number
+		ports[defaultPort.Name] = targetPort
+	}
+	// Connect sidecars only proxy the service port, so the additional ports keep the numbers of the instance
+	for _, namedPort := range convertNamedPorts(endpoint) {
+		ports[namedPort.Name] = namedPort.Number
 	}
 
 	return &istio.WorkloadEntry{
 		Address:  addr,
 		Ports:    ports,
 		Labels:   svcLabels,
-		Locality: endpoint.Datacenter,
-	}
-}
-
-func convertLabels(labelsStr []string) labels.Instance {
-	out := make(labels.Instance, len(labelsStr))
-	for _, tag := range labelsStr {
-		vals := strings.Split(tag, "|")
-		// Labels not of form "key|value" are ignored to avoid possible collisions
-		if len(vals) > 1 {
-			out[vals[0]] = vals[1]
-		} else {
-			log.Debugf("Tag %v ignored since it is not of form key|value", tag)
-		}
+		Locality: opts.locality.locality(endpoint, opts.localities.of(endpoint)),
+		Weight:   opts.weight(endpoint),
 	}
-	return out
 }
 
 func convertPort(port int, name string) *istio.Port {
@@ -133,10 +549,57 @@ func convertPort(port int, name string) *istio.Port {
 	}
 }
 
-// serviceHostname produces FQDN for a consul service
-func serviceHostname(name, fqdn string) string {
-	// TODO include datacenter in Hostname?
-	// consul DNS uses "redis.service.us-east-1.consul" -> "[<optional_tag>].<svc>.service.[<optional_datacenter>].consul"
+// convertNamedPorts converts the additional ports declared in the meta of an instance, the protocol of a port is
+// declared by "protocol-<name>", or inferred from the name like Istio does for Kubernetes services, e.g. "grpc-api"
+func convertNamedPorts(endpoint *api.CatalogService) []*istio.Port {
+	ports := make([]*istio.Port, 0)
+	for key, value := range endpoint.ServiceMeta {
+		if !strings.HasPrefix(key, portMetaPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(key, portMetaPrefix)
+		number, err := strconv.ParseUint(value, 10, 16)
+		if name == "" || err != nil || number == 0 {
+			log.Infof("Meta %s=%s of service %s is ignored since it's not a valid port", key, value,
+				endpoint.ServiceName)
+			continue
+		}
+
+		protocolName, ok := endpoint.ServiceMeta[portProtocolMetaPrefix+name]
+		if !ok {
+			protocolName = "tcp"
+			if p := protocol.Parse(strings.Split(name, "-")[0]); p != protocol.Unsupported {
+				protocolName = string(p)
+			}
+		}
+		ports = append(ports, &istio.Port{
+			Number:     uint32(number),
+			Protocol:   convertProtocol(protocolName),
+			Name:       name,
+			TargetPort: uint32(number),
+		})
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].Name < ports[j].Name
+	})
+	return ports
+}
+
+func portNamed(ports map[uint32]*istio.Port, name string) *istio.Port {
+	for _, port := range ports {
+		if port.Name == name {
+			return port
+		}
+	}
+	return nil
+}
+
+// serviceHostname produces FQDN for a consul service, the datacenter is included in the hostname if it's not empty
+// consul DNS uses "redis.service.us-east-1.consul" -> "[<optional_tag>].<svc>.service.[<optional_datacenter>].consul"
+func serviceHostname(name, datacenter, fqdn string) string {
+	if len(datacenter) > 0 {
+		name = fmt.Sprintf("%s.%s", name, datacenter)
+	}
 	if len(fqdn) > 0 {
 		return fmt.Sprintf("%s.%s", name, fqdn)
 	}
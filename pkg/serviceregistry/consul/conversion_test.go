@@ -15,13 +15,19 @@
 package consul
 
 import (
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/consul/api"
 	istio "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/protocol"
+
+	"github.com/aeraki-framework/consul2istio/pkg/constants"
 )
 
 var (
@@ -60,19 +66,94 @@ func TestConvertProtocol(t *testing.T) {
 }
 
 func TestConvertLabels(t *testing.T) {
-	out := convertLabels(goodLabels)
+	out := convertLabels(labelOptions{}, &api.CatalogService{ServiceTags: goodLabels})
 	if len(out) != len(goodLabels) {
 		t.Errorf("convertLabels(%q) => length %v, want %v", goodLabels, len(out), len(goodLabels))
 	}
 
-	out = convertLabels(badLabels)
+	out = convertLabels(labelOptions{}, &api.CatalogService{ServiceTags: badLabels})
 	if len(out) == len(badLabels) {
 		t.Errorf("convertLabels(%q) => length %v, want %v", badLabels, len(out), len(badLabels)-1)
 	}
 }
 
+func TestConvertLabelsWithOptions(t *testing.T) {
+	endpoint := &api.CatalogService{
+		ServiceTags: []string{"version=v1", "team|payments", "label:zone=east", "label:owner=a b", "plain"},
+		ServiceMeta: map[string]string{"version": "v2", "git-sha": "abc123", "build": "2021/01/01"},
+		NodeMeta:    map[string]string{"rack": "r1", "version": "v0", "os": "linux"},
+	}
+
+	tests := []struct {
+		name string
+		opts labelOptions
+		want labels.Instance
+	}{
+		{
+			name: "default separator",
+			want: labels.Instance{"team": "payments"},
+		},
+		{
+			name: "multiple separators",
+			opts: labelOptions{tagSeparators: []string{"=", "|"}},
+			want: labels.Instance{"version": "v1", "team": "payments", "label-zone": "east", "label-owner": "a-b"},
+		},
+		{
+			name: "strip tag prefix",
+			opts: labelOptions{tagSeparators: []string{"="}, tagPrefixes: []string{"label:"}, stripTagPrefix: true},
+			want: labels.Instance{"zone": "east", "owner": "a-b"},
+		},
+		{
+			name: "meta takes precedence over tags and node meta",
+			opts: labelOptions{
+				tagSeparators: []string{"="},
+				tagPrefixes:   []string{"version"},
+				metaKeys:      []string{"version", "build"},
+				nodeMetaKeys:  []string{"rack", "version"},
+			},
+			want: labels.Instance{"version": "v2", "build": "2021-01-01", "rack": "r1"},
+		},
+		{
+			name: "all meta",
+			opts: labelOptions{tagPrefixes: []string{"none"}, metaKeys: []string{AllMetaKeys}},
+			want: labels.Instance{"version": "v2", "git-sha": "abc123", "build": "2021-01-01"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := convertLabels(tt.opts, endpoint)
+			if !reflect.DeepEqual(out, tt.want) {
+				t.Errorf("convertLabels() => %v, want %v", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeLabels(t *testing.T) {
+	tests := []struct {
+		key, value string
+		want       labels.Instance
+	}{
+		{"version", "v1", labels.Instance{"version": "v1"}},
+		{"app.kubernetes.io/name", "web", labels.Instance{"app.kubernetes.io/name": "web"}},
+		{"team name", "-payments!", labels.Instance{"team-name": "payments"}},
+		{"long", strings.Repeat("a", 70), labels.Instance{"long": strings.Repeat("a", 63)}},
+		{"bad prefix!/name", "v1", labels.Instance{}},
+		{"!!!", "v1", labels.Instance{}},
+	}
+
+	for _, tt := range tests {
+		out := labels.Instance{}
+		addLabel(out, tt.key, tt.value)
+		if !reflect.DeepEqual(out, tt.want) {
+			t.Errorf("addLabel(%q, %q) => %v, want %v", tt.key, tt.value, out, tt.want)
+		}
+	}
+}
+
 func TestServiceHostname(t *testing.T) {
-	out := serviceHostname("productpage", "")
+	out := serviceHostname("productpage", "", "")
 
 	if out != "productpage" {
 		t.Errorf("serviceHostname() => %q, want %q", out, "productpage")
@@ -104,7 +185,7 @@ func TestConvertWorkloadEntry(t *testing.T) {
 		ServiceMeta:    map[string]string{protocolTagName: p},
 	}
 
-	out := convertWorkloadEntry(false, &consulServiceInst)
+	out := convertWorkloadEntry(&convertOptions{}, &consulServiceInst, nil)
 
 	if out.Ports[p+"-"+strconv.Itoa(9080)] != 9080 {
 		t.Errorf("convertWorkloadEntry() => %v, want %v", out.Ports[p], protocol.UDP)
@@ -160,7 +241,7 @@ func TestConverServiceEntry(t *testing.T) {
 		},
 	}
 
-	out := convertServiceEntry(false, "", name, consulServiceInsts)
+	out := convertServiceEntry(&convertOptions{}, name, "", consulServiceInsts, nil)
 
 	if len(out.Endpoints) != 2 {
 		t.Errorf("converServiceEntry() len(Endpoints) => %v, want %v", len(out.Endpoints), 2)
@@ -174,9 +255,9 @@ func TestConverServiceEntry(t *testing.T) {
 		t.Errorf("converServiceEntry() len(Hosts) => %v, want %v", len(out.Hosts), 0)
 	}
 
-	if out.Hosts[0] != serviceHostname(name, "") {
+	if out.Hosts[0] != serviceHostname(name, "", "") {
 		t.Errorf("converServiceEntry() bad hostname => %q, want %q",
-			out.Hosts[0], serviceHostname(name, ""))
+			out.Hosts[0], serviceHostname(name, "", ""))
 	}
 
 	if out.Resolution != istio.ServiceEntry_STATIC {
@@ -197,3 +278,715 @@ func TestConverServiceEntry(t *testing.T) {
 		t.Errorf("converServiceEntry() => %v, want %v", out.Ports[0].Number, protocol.UDP)
 	}
 }
+
+func TestConvertServiceEntries(t *testing.T) {
+	instance := func(address, external string) *api.CatalogService {
+		endpoint := &api.CatalogService{
+			ServiceName:    "payment",
+			ServiceAddress: address,
+			ServicePort:    8080,
+		}
+		if external != "" {
+			endpoint.ServiceMeta = map[string]string{externalTagName: external}
+		}
+		return endpoint
+	}
+
+	type want struct {
+		hosts      []string
+		location   istio.ServiceEntry_Location
+		resolution istio.ServiceEntry_Resolution
+		endpoints  int
+	}
+	tests := []struct {
+		name         string
+		endpoints    []*api.CatalogService
+		want         []want
+		wantConflict bool
+	}{
+		{
+			name:      "internal instances",
+			endpoints: []*api.CatalogService{instance("10.0.0.1", ""), instance("10.0.0.2", "")},
+			want:      []want{{[]string{"payment"}, istio.ServiceEntry_MESH_INTERNAL, istio.ServiceEntry_STATIC, 2}},
+		},
+		{
+			name:      "external instances with one external name",
+			endpoints: []*api.CatalogService{instance("10.0.0.1", "legacy"), instance("10.0.0.2", "legacy")},
+			want: []want{
+				{[]string{"payment", "payment-legacy"}, istio.ServiceEntry_MESH_EXTERNAL, istio.ServiceEntry_STATIC, 2},
+			},
+		},
+		{
+			name:      "mixed internal and external instances",
+			endpoints: []*api.CatalogService{instance("10.0.0.1", ""), instance("10.0.0.2", "legacy")},
+			want: []want{
+				{[]string{"payment"}, istio.ServiceEntry_MESH_INTERNAL, istio.ServiceEntry_STATIC, 1},
+				{[]string{"payment-legacy"}, istio.ServiceEntry_MESH_EXTERNAL, istio.ServiceEntry_STATIC, 1},
+			},
+			wantConflict: true,
+		},
+		{
+			name: "multiple external names",
+			endpoints: []*api.CatalogService{
+				instance("10.0.0.1", "legacy"),
+				instance("10.0.0.2", "pay.example.com"),
+				instance("10.0.0.3", "legacy"),
+			},
+			want: []want{
+				{[]string{"payment-legacy"}, istio.ServiceEntry_MESH_EXTERNAL, istio.ServiceEntry_STATIC, 2},
+				{
+					[]string{"payment-pay-example-com"}, istio.ServiceEntry_MESH_EXTERNAL, istio.ServiceEntry_STATIC,
+					1,
+				},
+			},
+			wantConflict: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := convertServiceEntries(&convertOptions{}, ServiceKey{Name: "payment"}, "", tt.endpoints, nil)
+			if len(out) != len(tt.want) {
+				t.Fatalf("convertServiceEntries() returned %d ServiceEntries, want %d", len(out), len(tt.want))
+			}
+			for i, w := range tt.want {
+				if !reflect.DeepEqual(out[i].spec.Hosts, w.hosts) {
+					t.Errorf("ServiceEntry %d hosts => %v, want %v", i, out[i].spec.Hosts, w.hosts)
+				}
+				if out[i].spec.Location != w.location {
+					t.Errorf("ServiceEntry %d location => %v, want %v", i, out[i].spec.Location, w.location)
+				}
+				if out[i].spec.Resolution != w.resolution {
+					t.Errorf("ServiceEntry %d resolution => %v, want %v", i, out[i].spec.Resolution, w.resolution)
+				}
+				if len(out[i].spec.Endpoints) != w.endpoints {
+					t.Errorf("ServiceEntry %d has %d endpoints, want %d", i, len(out[i].spec.Endpoints), w.endpoints)
+				}
+				if _, ok := out[i].annotations[constants.ExternalConflictAnnotation]; ok != tt.wantConflict {
+					t.Errorf("ServiceEntry %d annotations => %v, want conflict %v", i, out[i].annotations,
+						tt.wantConflict)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertServiceEntriesWithHostTemplates(t *testing.T) {
+	endpoints := []*api.CatalogService{
+		{
+			ServiceName:    "payment",
+			Datacenter:     "dc1",
+			ServiceTags:    []string{"primary", "v1"},
+			ServiceMeta:    map[string]string{"team": "billing", "alias": "pay"},
+			ServiceAddress: "10.0.0.1",
+			ServicePort:    8080,
+		},
+		{
+			ServiceName:    "payment",
+			Datacenter:     "dc1",
+			ServiceTags:    []string{"v2"},
+			ServiceMeta:    map[string]string{"team": "billing"},
+			ServiceAddress: "10.0.0.2",
+			ServicePort:    8080,
+		},
+	}
+
+	tests := []struct {
+		name      string
+		key       ServiceKey
+		templates []string
+		want      []string
+	}{
+		{
+			name: "default hostname",
+			key:  ServiceKey{Name: "payment"},
+			want: []string{"payment"},
+		},
+		{
+			name: "consul dns names",
+			key:  ServiceKey{Name: "payment"},
+			templates: []string{
+				"{{.Name}}.service.consul",
+				"{{.Name}}.service.{{.Datacenter}}.consul",
+			},
+			want: []string{"payment.service.consul", "payment.service.dc1.consul"},
+		},
+		{
+			name: "namespace, tags and common meta",
+			key:  ServiceKey{Name: "payment", Namespace: "Team-A"},
+			templates: []string{
+				"{{.Name}}.{{lower .Namespace}}.{{.Meta.team}}",
+				"{{join .Tags \"-\"}}.{{.Name}}",
+			},
+			want: []string{"payment.team-a.billing", "primary-v1-v2.payment"},
+		},
+		{
+			name: "conditional, duplicated and invalid hosts are skipped",
+			key:  ServiceKey{Name: "payment"},
+			templates: []string{
+				"{{.Name}}.consul",
+				"{{with .Meta.alias}}{{.}}.consul{{end}}",
+				"{{.Name}}.consul",
+				"{{.Name}}_invalid",
+			},
+			want: []string{"payment.consul"},
+		},
+		{
+			name:      "no valid host",
+			key:       ServiceKey{Name: "payment"},
+			templates: []string{"{{.Meta.alias}}"},
+			want:      []string{"payment"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := NewConsulBootStrapArgs()
+			args.HostTemplates = tt.templates
+			opts, err := newConvertOptions(args)
+			if err != nil {
+				t.Fatalf("newConvertOptions() => %v", err)
+			}
+			out := convertServiceEntries(opts, tt.key, "", endpoints, nil)
+			if len(out) != 1 {
+				t.Fatalf("convertServiceEntries() returned %d ServiceEntries, want 1", len(out))
+			}
+			if !reflect.DeepEqual(out[0].spec.Hosts, tt.want) {
+				t.Errorf("convertServiceEntries() hosts => %v, want %v", out[0].spec.Hosts, tt.want)
+			}
+		})
+	}
+
+	args := NewConsulBootStrapArgs()
+	args.HostTemplates = []string{"{{.Name"}
+	if _, err := newConvertOptions(args); err == nil {
+		t.Errorf("newConvertOptions() should fail with an invalid host template")
+	}
+}
+
+func TestConvertServiceEntriesWithTagHosts(t *testing.T) {
+	instance := func(address string, tags ...string) *api.CatalogService {
+		return &api.CatalogService{
+			ServiceName:    "redis",
+			ServiceTags:    tags,
+			ServiceAddress: address,
+			ServicePort:    6379,
+		}
+	}
+	endpoints := []*api.CatalogService{
+		instance("10.0.0.1", "Primary", "v1"),
+		instance("10.0.0.2", "replica", "v1"),
+		instance("10.0.0.3", "replica"),
+	}
+
+	args := NewConsulBootStrapArgs()
+	args.HostTemplates = []string{"{{.Name}}.service.consul", "{{.Name}}.service.dc1.consul"}
+	args.TagHosts = []string{"primary", "Replica", "canary"}
+	opts, err := newConvertOptions(args)
+	if err != nil {
+		t.Fatalf("newConvertOptions() => %v", err)
+	}
+	out := convertServiceEntries(opts, ServiceKey{Name: "redis"}, "", endpoints, nil)
+
+	want := []struct {
+		hosts     []string
+		tag       string
+		addresses []string
+	}{
+		{
+			hosts:     []string{"redis.service.consul", "redis.service.dc1.consul"},
+			addresses: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		},
+		{
+			hosts:     []string{"primary.redis.service.consul", "primary.redis.service.dc1.consul"},
+			tag:       "primary",
+			addresses: []string{"10.0.0.1"},
+		},
+		{
+			hosts:     []string{"replica.redis.service.consul", "replica.redis.service.dc1.consul"},
+			tag:       "replica",
+			addresses: []string{"10.0.0.2", "10.0.0.3"},
+		},
+	}
+	if len(out) != len(want) {
+		t.Fatalf("convertServiceEntries() returned %d ServiceEntries, want %d", len(out), len(want))
+	}
+	for i, w := range want {
+		if !reflect.DeepEqual(out[i].spec.Hosts, w.hosts) {
+			t.Errorf("ServiceEntry %d hosts => %v, want %v", i, out[i].spec.Hosts, w.hosts)
+		}
+		if tag := out[i].annotations[constants.ConsulTagAnnotation]; tag != w.tag {
+			t.Errorf("ServiceEntry %d tag => %q, want %q", i, tag, w.tag)
+		}
+		addresses := make([]string, 0, len(out[i].spec.Endpoints))
+		for _, endpoint := range out[i].spec.Endpoints {
+			addresses = append(addresses, endpoint.Address)
+		}
+		if !reflect.DeepEqual(addresses, w.addresses) {
+			t.Errorf("ServiceEntry %d addresses => %v, want %v", i, addresses, w.addresses)
+		}
+	}
+
+	args.TagHosts = []string{"version|v1"}
+	if _, err := newConvertOptions(args); err == nil {
+		t.Errorf("newConvertOptions() should fail with a tag which can't be a part of a host")
+	}
+}
+
+func TestConvertLocality(t *testing.T) {
+	locality := `{"Region": "us-east-1", "Zone": "us-east-1a"}`
+	var catalogEntry catalogServiceWithKind
+	if err := json.Unmarshal([]byte(`{"ServiceName": "web", "ServiceLocality": `+locality+`}`),
+		&catalogEntry); err != nil {
+		t.Fatalf("could not decode the catalog entry: %v", err)
+	}
+	var healthEntry healthEntryWithLocality
+	if err := json.Unmarshal([]byte(`{"Service": {"Service": "web", "Locality": `+locality+`}}`),
+		&healthEntry); err != nil {
+		t.Fatalf("could not decode the health entry: %v", err)
+	}
+	healthEntry.ServiceEntry.Service = &healthEntry.Service.AgentService
+	for name, consul := range map[string]*consulLocality{
+		"catalog": catalogEntry.ServiceLocality,
+		"health":  healthEntry.Service.Locality,
+	} {
+		opts := localityOptions{
+			region: []localitySource{{kind: LocalitySourceLocality}},
+			zone:   []localitySource{{kind: LocalitySourceLocality}},
+		}
+		if locality := opts.locality(&api.CatalogService{}, consul); locality != "us-east-1/us-east-1a" {
+			t.Errorf("%s locality => %q, want %q", name, locality, "us-east-1/us-east-1a")
+		}
+	}
+
+	// The locality is carried next to the instance, its meta is left untouched
+	args := NewConsulBootStrapArgs()
+	args.LocalityRegion = []string{"locality"}
+	args.LocalityZone = []string{"locality"}
+	opts, err := newConvertOptions(args)
+	if err != nil {
+		t.Fatalf("newConvertOptions() => %v", err)
+	}
+	located := &api.CatalogService{ServiceName: "web", ServiceMeta: map[string]string{"version": "v1"}}
+	opts.localities = instanceLocalities{located: catalogEntry.ServiceLocality}
+	if out := convertWorkloadEntry(opts, located, nil); out.Locality != "us-east-1/us-east-1a" {
+		t.Errorf("convertWorkloadEntry() locality => %q, want %q", out.Locality, "us-east-1/us-east-1a")
+	}
+	if len(located.ServiceMeta) != 1 {
+		t.Errorf("convertWorkloadEntry() modifies the meta of the instance: %v", located.ServiceMeta)
+	}
+
+	endpoint := &api.CatalogService{
+		Datacenter:  "dc1",
+		NodeMeta:    map[string]string{"region": "eu-west-1", "zone": "eu-west-1b"},
+		ServiceMeta: map[string]string{"rack": "r1/a"},
+	}
+	tests := []struct {
+		name    string
+		region  []string
+		zone    []string
+		subzone []string
+		want    string
+	}{
+		{
+			name: "datacenter by default",
+			want: "dc1",
+		},
+		{
+			name:    "node meta and service meta",
+			region:  []string{"node-meta:region"},
+			zone:    []string{"node-meta:zone"},
+			subzone: []string{"service-meta:rack"},
+			want:    "eu-west-1/eu-west-1b/r1-a",
+		},
+		{
+			name:   "first non-empty source",
+			region: []string{"locality", "service-meta:region", "datacenter"},
+			zone:   []string{"locality", "node-meta:zone"},
+			want:   "dc1/eu-west-1b",
+		},
+		{
+			name:    "levels after a missing one",
+			zone:    []string{"service-meta:zone"},
+			subzone: []string{"service-meta:rack"},
+			want:    "dc1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := NewConsulBootStrapArgs()
+			args.LocalityRegion = tt.region
+			args.LocalityZone = tt.zone
+			args.LocalitySubzone = tt.subzone
+			opts, err := newConvertOptions(args)
+			if err != nil {
+				t.Fatalf("newConvertOptions() => %v", err)
+			}
+			if out := convertWorkloadEntry(opts, endpoint, nil); out.Locality != tt.want {
+				t.Errorf("convertWorkloadEntry() locality => %q, want %q", out.Locality, tt.want)
+			}
+		})
+	}
+
+	for _, sources := range [][]string{{"node-meta"}, {"datacenter:dc"}, {"rack"}} {
+		args := NewConsulBootStrapArgs()
+		args.LocalityZone = sources
+		if _, err := newConvertOptions(args); err == nil {
+			t.Errorf("newConvertOptions() should fail with locality sources %v", sources)
+		}
+	}
+}
+
+func TestConvertWeights(t *testing.T) {
+	tests := []struct {
+		name        string
+		weights     api.Weights
+		status      string
+		healthCheck bool
+		want        uint32
+		wantSkipped bool
+	}{
+		{
+			name: "no weights",
+			want: 0,
+		},
+		{
+			name:        "passing weight",
+			weights:     api.Weights{Passing: 10, Warning: 1},
+			status:      api.HealthPassing,
+			healthCheck: true,
+			want:        10,
+		},
+		{
+			name:        "warning weight",
+			weights:     api.Weights{Passing: 10, Warning: 1},
+			status:      api.HealthWarning,
+			healthCheck: true,
+			want:        1,
+		},
+		{
+			name:    "passing weight without health check",
+			weights: api.Weights{Passing: 10, Warning: 1},
+			status:  api.HealthWarning,
+			want:    10,
+		},
+		{
+			name:        "zero warning weight",
+			weights:     api.Weights{Passing: 10, Warning: 0},
+			status:      api.HealthWarning,
+			healthCheck: true,
+			wantSkipped: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint := &api.CatalogService{
+				ServiceName:    "web",
+				ServiceAddress: "10.0.0.1",
+				ServicePort:    8080,
+				ServiceWeights: tt.weights,
+			}
+			if tt.status != "" {
+				endpoint.Checks = api.HealthChecks{{Status: tt.status}}
+			}
+			opts := &convertOptions{healthCheck: tt.healthCheck}
+			out := convertServiceEntry(opts, "web", "", []*api.CatalogService{endpoint}, nil)
+			if tt.wantSkipped {
+				if len(out.Endpoints) != 0 {
+					t.Errorf("convertServiceEntry() returned %d endpoints, want 0", len(out.Endpoints))
+				}
+				return
+			}
+			if len(out.Endpoints) != 1 {
+				t.Fatalf("convertServiceEntry() returned %d endpoints, want 1", len(out.Endpoints))
+			}
+			if out.Endpoints[0].Weight != tt.want {
+				t.Errorf("convertServiceEntry() weight => %d, want %d", out.Endpoints[0].Weight, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertAddressPreference(t *testing.T) {
+	endpoint := &api.CatalogService{
+		ServiceName:    "web",
+		Address:        "10.0.0.1",
+		ServiceAddress: "172.16.0.1",
+		ServicePort:    8080,
+		TaggedAddresses: map[string]string{
+			"lan_ipv4": "10.0.0.1",
+			"wan":      "203.0.113.1",
+			"lan_ipv6": "fd00::1",
+		},
+		ServiceTaggedAddresses: map[string]api.ServiceAddress{
+			"wan": {Address: "203.0.113.10", Port: 18080},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		preference []string
+		want       string
+		wantPort   uint32
+		wantType   string
+	}{
+		{
+			name:     "service address by default",
+			want:     "172.16.0.1",
+			wantPort: 8080,
+		},
+		{
+			name:       "service tagged address with its own port",
+			preference: []string{"wan", "lan_ipv4"},
+			want:       "203.0.113.10",
+			wantPort:   18080,
+			wantType:   "wan",
+		},
+		{
+			name:       "node tagged address",
+			preference: []string{"wan_ipv6", "lan_ipv6"},
+			want:       "fd00::1",
+			wantPort:   8080,
+			wantType:   "lan_ipv6",
+		},
+		{
+			name:       "node address",
+			preference: []string{"node"},
+			want:       "10.0.0.1",
+			wantPort:   8080,
+			wantType:   AddressTypeNode,
+		},
+		{
+			name:       "fall back to the service address",
+			preference: []string{"wan_ipv4"},
+			want:       "172.16.0.1",
+			wantPort:   8080,
+			wantType:   AddressTypeService,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := NewConsulBootStrapArgs()
+			args.AddressPreference = tt.preference
+			opts, err := newConvertOptions(args)
+			if err != nil {
+				t.Fatalf("newConvertOptions() => %v", err)
+			}
+			out := convertWorkloadEntry(opts, endpoint, nil)
+			if out.Address != tt.want {
+				t.Errorf("convertWorkloadEntry() address => %s, want %s", out.Address, tt.want)
+			}
+			if port := out.Ports["tcp-8080"]; port != tt.wantPort {
+				t.Errorf("convertWorkloadEntry() port => %d, want %d", port, tt.wantPort)
+			}
+			if addressType := out.Labels[addressTypeLabel]; addressType != tt.wantType {
+				t.Errorf("convertWorkloadEntry() address type => %q, want %q", addressType, tt.wantType)
+			}
+		})
+	}
+
+	args := NewConsulBootStrapArgs()
+	args.AddressPreference = []string{"lan_ipv5"}
+	if _, err := newConvertOptions(args); err == nil {
+		t.Errorf("newConvertOptions() should fail with an unknown address type")
+	}
+}
+
+func TestConvertHostnameAddresses(t *testing.T) {
+	instance := func(address, external string) *api.CatalogService {
+		endpoint := &api.CatalogService{
+			ServiceName:    "payment",
+			ServiceAddress: address,
+			ServicePort:    8080,
+		}
+		if external != "" {
+			endpoint.ServiceMeta = map[string]string{externalTagName: external}
+		}
+		return endpoint
+	}
+
+	type want struct {
+		host       string
+		resolution istio.ServiceEntry_Resolution
+		addresses  []string
+	}
+	tests := []struct {
+		name         string
+		resolution   string
+		endpoints    []*api.CatalogService
+		want         []want
+		wantConflict bool
+	}{
+		{
+			name:      "ip addresses",
+			endpoints: []*api.CatalogService{instance("10.0.0.1", ""), instance("fd00::1", "")},
+			want:      []want{{"payment", istio.ServiceEntry_STATIC, []string{"10.0.0.1", "fd00::1"}}},
+		},
+		{
+			name:      "hostnames",
+			endpoints: []*api.CatalogService{instance("pay-1.example.com", ""), instance("pay-2.example.com", "")},
+			want: []want{
+				{"payment", istio.ServiceEntry_DNS, []string{"pay-1.example.com", "pay-2.example.com"}},
+			},
+		},
+		{
+			name:       "hostnames with round robin resolution",
+			resolution: "DNS_ROUND_ROBIN",
+			endpoints:  []*api.CatalogService{instance("pay.example.com", "")},
+			want:       []want{{"payment", istio.ServiceEntry_DNS_ROUND_ROBIN, []string{"pay.example.com"}}},
+		},
+		{
+			name:       "several hostnames with round robin resolution",
+			resolution: "DNS_ROUND_ROBIN",
+			endpoints:  []*api.CatalogService{instance("pay-1.example.com", ""), instance("pay-2.example.com", "")},
+			want: []want{
+				{"payment", istio.ServiceEntry_DNS, []string{"pay-1.example.com", "pay-2.example.com"}},
+			},
+		},
+		{
+			name:      "external hostnames",
+			endpoints: []*api.CatalogService{instance("pay.example.com", "legacy")},
+			want:      []want{{"payment", istio.ServiceEntry_DNS, []string{"pay.example.com"}}},
+		},
+		{
+			name: "mixed ip addresses and hostnames",
+			endpoints: []*api.CatalogService{
+				instance("10.0.0.1", ""),
+				instance("pay.example.com", ""),
+				instance("10.0.0.2", ""),
+			},
+			want: []want{
+				{"payment", istio.ServiceEntry_STATIC, []string{"10.0.0.1", "10.0.0.2"}},
+				{"payment-dns", istio.ServiceEntry_DNS, []string{"pay.example.com"}},
+			},
+			wantConflict: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := NewConsulBootStrapArgs()
+			args.HostnameResolution = tt.resolution
+			opts, err := newConvertOptions(args)
+			if err != nil {
+				t.Fatalf("newConvertOptions() => %v", err)
+			}
+			out := convertServiceEntries(opts, ServiceKey{Name: "payment"}, "", tt.endpoints, nil)
+			if len(out) != len(tt.want) {
+				t.Fatalf("convertServiceEntries() returned %d ServiceEntries, want %d", len(out), len(tt.want))
+			}
+			for i, w := range tt.want {
+				if out[i].spec.Hosts[0] != w.host {
+					t.Errorf("ServiceEntry %d host => %s, want %s", i, out[i].spec.Hosts[0], w.host)
+				}
+				if out[i].spec.Resolution != w.resolution {
+					t.Errorf("ServiceEntry %d resolution => %v, want %v", i, out[i].spec.Resolution, w.resolution)
+				}
+				addresses := make([]string, 0, len(out[i].spec.Endpoints))
+				for _, endpoint := range out[i].spec.Endpoints {
+					addresses = append(addresses, endpoint.Address)
+				}
+				if !reflect.DeepEqual(addresses, w.addresses) {
+					t.Errorf("ServiceEntry %d addresses => %v, want %v", i, addresses, w.addresses)
+				}
+				if _, ok := out[i].annotations[constants.AddressConflictAnnotation]; ok != tt.wantConflict {
+					t.Errorf("ServiceEntry %d annotations => %v, want conflict %v", i, out[i].annotations,
+						tt.wantConflict)
+				}
+			}
+		})
+	}
+
+	// The instances with hostnames are skipped if a Consul service takes the name of their ServiceEntry
+	opts, err := newConvertOptions(NewConsulBootStrapArgs())
+	if err != nil {
+		t.Fatalf("newConvertOptions() => %v", err)
+	}
+	opts.serviceExists = func(name string) bool {
+		return name == "payment-dns"
+	}
+	out := convertServiceEntries(opts, ServiceKey{Name: "payment"}, "",
+		[]*api.CatalogService{instance("10.0.0.1", ""), instance("pay.example.com", "")}, nil)
+	if len(out) != 1 || out[0].spec.Hosts[0] != "payment" || len(out[0].spec.Endpoints) != 1 {
+		t.Errorf("convertServiceEntries() => %v, want the ServiceEntry of the IP addresses only", out)
+	}
+
+	args := NewConsulBootStrapArgs()
+	args.HostnameResolution = "STATIC"
+	if _, err := newConvertOptions(args); err == nil {
+		t.Errorf("newConvertOptions() should fail with an unsupported hostname resolution")
+	}
+}
+
+func TestConvertNamedPorts(t *testing.T) {
+	endpoints := []*api.CatalogService{
+		{
+			ServiceName:    "productpage",
+			ServiceAddress: "10.0.0.1",
+			ServicePort:    9080,
+			ServiceMeta: map[string]string{
+				"port-http-web":    "8080",
+				"port-grpc":        "9090",
+				"port-metrics":     "9102",
+				"protocol-metrics": "http",
+				"port-invalid":     "http",
+				"port-status":      "9102",
+			},
+		},
+		{
+			ServiceName:    "productpage",
+			ServiceAddress: "10.0.0.2",
+			ServicePort:    9080,
+			ServiceMeta: map[string]string{
+				"port-http-web": "8081",
+			},
+		},
+	}
+
+	out := convertServiceEntry(&convertOptions{}, "productpage", "", endpoints, nil)
+
+	want := []struct {
+		name     string
+		number   uint32
+		protocol protocol.Instance
+	}{
+		{"http-web", 8080, protocol.HTTP},
+		{"tcp-9080", 9080, protocol.TCP},
+		{"grpc", 9090, protocol.GRPC},
+		{"metrics", 9102, protocol.HTTP},
+	}
+	if len(out.Ports) != len(want) {
+		t.Fatalf("convertServiceEntry() returned ports %v, want %d ports", out.Ports, len(want))
+	}
+	for i, w := range want {
+		port := out.Ports[i]
+		if port.Name != w.name || port.Number != w.number || port.Protocol != string(w.protocol) {
+			t.Errorf("port %d => %s/%d/%s, want %s/%d/%s", i, port.Name, port.Number, port.Protocol,
+				w.name, w.number, w.protocol)
+		}
+	}
+
+	if port := out.Endpoints[0].Ports["grpc"]; port != 9090 {
+		t.Errorf("endpoint 0 port grpc => %d, want 9090", port)
+	}
+	if port := out.Endpoints[1].Ports["http-web"]; port != 8081 {
+		t.Errorf("endpoint 1 port http-web => %d, want 8081", port)
+	}
+	// The port dropped from the ServiceEntry because of its conflicting number isn't mapped by the endpoint
+	if port, ok := out.Endpoints[0].Ports["status"]; ok {
+		t.Errorf("endpoint 0 maps port status to %d, want it dropped", port)
+	}
+
+	// The additional ports aren't proxied by a Connect sidecar, they keep the numbers of the instance
+	sidecar := &api.CatalogService{ServiceName: "productpage-sidecar-proxy", ServiceAddress: "10.0.0.1",
+		ServicePort: 21000}
+	workloadEntry := convertWorkloadEntry(&convertOptions{}, endpoints[0], sidecar)
+	if port := workloadEntry.Ports["tcp-9080"]; port != 21000 {
+		t.Errorf("sidecar port tcp-9080 => %d, want 21000", port)
+	}
+	if port := workloadEntry.Ports["grpc"]; port != 9090 {
+		t.Errorf("sidecar port grpc => %d, want 9090", port)
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"istio.io/pkg/log"
+
+	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry"
+)
+
+// discoveryChainKinds are the kinds of the config entries which make up the discovery chains of services
+var discoveryChainKinds = []string{api.ServiceResolver, api.ServiceSplitter, api.ServiceRouter}
+
+// discoveryChainEntry is a service-resolver, service-splitter or service-router config entry. The config entries are
+// decoded on their own since the vendored Consul client doesn't support admin partitions and the newer fields.
+type discoveryChainEntry struct {
+	Kind      string
+	Name      string
+	Partition string
+	Namespace string
+
+	// DefaultSubset, Subsets, Redirect, ConnectTimeout, LoadBalancer and Failover are the fields of a
+	// service-resolver
+	DefaultSubset  string
+	Subsets        map[string]resolverSubset
+	Redirect       *resolverRedirect
+	ConnectTimeout consulDuration
+	LoadBalancer   *resolverLoadBalancer
+	Failover       map[string]resolverFailover
+
+	// Splits are the splits of a service-splitter
+	Splits []serviceSplit
+
+	// Routes are the routes of a service-router
+	Routes []serviceRoute
+}
+
+type resolverSubset struct {
+	Filter      string
+	OnlyPassing bool
+}
+
+type resolverRedirect struct {
+	Service       string
+	ServiceSubset string
+	Namespace     string
+	Partition     string
+	Datacenter    string
+}
+
+// wildcardSubset keys the failover of all the subsets of a service-resolver
+const wildcardSubset = "*"
+
+type resolverFailover struct {
+	Service       string
+	ServiceSubset string
+	Namespace     string
+	Datacenters   []string
+	Targets       []failoverTarget
+}
+
+type failoverTarget struct {
+	Service       string
+	ServiceSubset string
+	Namespace     string
+	Partition     string
+	Datacenter    string
+	Peer          string
+}
+
+type resolverLoadBalancer struct {
+	Policy         string
+	RingHashConfig *struct {
+		MinimumRingSize uint64
+	}
+	HashPolicies []hashPolicy
+}
+
+type hashPolicy struct {
+	Field        string
+	FieldValue   string
+	CookieConfig *struct {
+		Session bool
+		TTL     consulDuration
+		Path    string
+	}
+	SourceIP bool
+}
+
+type serviceSplit struct {
+	Weight          float32
+	Service         string
+	ServiceSubset   string
+	Namespace       string
+	Partition       string
+	RequestHeaders  *headerModifiers
+	ResponseHeaders *headerModifiers
+}
+
+type headerModifiers struct {
+	Add    map[string]string
+	Set    map[string]string
+	Remove []string
+}
+
+type serviceRoute struct {
+	Match *struct {
+		HTTP *routeHTTPMatch
+	}
+	Destination *routeDestination
+}
+
+type routeHTTPMatch struct {
+	PathExact  string
+	PathPrefix string
+	PathRegex  string
+	Header     []headerMatch
+	QueryParam []queryParamMatch
+	Methods    []string
+}
+
+type headerMatch struct {
+	Name    string
+	Present bool
+	Exact   string
+	Prefix  string
+	Suffix  string
+	Regex   string
+	Invert  bool
+}
+
+type queryParamMatch struct {
+	Name    string
+	Present bool
+	Exact   string
+	Regex   string
+}
+
+type routeDestination struct {
+	Service               string
+	ServiceSubset         string
+	Namespace             string
+	Partition             string
+	PrefixRewrite         string
+	RequestTimeout        consulDuration
+	NumRetries            uint32
+	RetryOnConnectFailure bool
+	RetryOnStatusCodes    []uint32
+	RetryOn               []string
+	RequestHeaders        *headerModifiers
+	ResponseHeaders       *headerModifiers
+}
+
+// consulDuration is a duration in a config entry, which Consul encodes as a string like "15s"
+type consulDuration time.Duration
+
+func (d *consulDuration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case nil:
+		*d = 0
+	case float64:
+		*d = consulDuration(time.Duration(v))
+	case string:
+		duration, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = consulDuration(duration)
+	default:
+		return fmt.Errorf("invalid duration %s", string(data))
+	}
+	return nil
+}
+
+// DiscoveryChainController converts the service-resolver, service-splitter and service-router config entries,
+// which make up the discovery chains of Consul services, to DestinationRules and VirtualServices
+type DiscoveryChainController struct {
+	*configEntryStore
+	options *convertOptions
+	// failover converts the failovers of the service-resolvers to the locality failover between datacenters
+	failover bool
+	// datacenters are the synchronized datacenters which the failovers may target, nil until they are resolved. They
+	// are resolved outside the mutex of the store since listing all datacenters is a Consul query.
+	datacenters []string
+}
+
+// NewDiscoveryChainController creates a controller of the discovery chains of Consul services
+func NewDiscoveryChainController(args *BootStrapArgs) (*DiscoveryChainController, error) {
+	client, err := newConsulClient(args)
+	if err != nil {
+		return nil, err
+	}
+	options, err := newConvertOptions(args)
+	if err != nil {
+		return nil, err
+	}
+	c := &DiscoveryChainController{options: options, failover: args.SyncFailover}
+	c.configEntryStore = newConfigEntryStore(client, newScopeConfig(args), discoveryChainKinds, c.convert)
+	// Only all the datacenters need to be listed from Consul
+	if !contains(c.scopes.datacenters, AllDatacenters) {
+		c.datacenters, _ = resolveDatacenters(client, c.scopes.datacenters)
+	}
+	return c, nil
+}
+
+// Run until a stop signal is received
+func (c *DiscoveryChainController) Run(stop <-chan struct{}) {
+	c.configEntryStore.Run(stop)
+	if c.failover && c.datacenters == nil {
+		go c.watchDatacenters(stop)
+	}
+}
+
+// watchDatacenters lists the datacenters periodically, since Consul doesn't support blocking queries on the
+// datacenter list, and converts the config entries again when they change
+func (c *DiscoveryChainController) watchDatacenters(stop <-chan struct{}) {
+	for {
+		interval := scopeRefreshInterval
+		datacenters, err := resolveDatacenters(c.client, c.scopes.datacenters)
+		if err != nil {
+			log.Warnf("Could not fetch datacenters to convert the failovers: %v", err)
+			interval = time.Second
+		} else {
+			c.mutex.Lock()
+			changed := false
+			if !reflect.DeepEqual(c.datacenters, datacenters) {
+				c.datacenters = datacenters
+				changed = c.convertEntries()
+			}
+			c.mutex.Unlock()
+			if changed {
+				c.notify()
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Kinds implements a config store operation
+func (c *DiscoveryChainController) Kinds() []string {
+	return []string{"DestinationRule", "VirtualService"}
+}
+
+// convert decodes the config entries of the discovery chains and converts them, the caller must hold the mutex
+func (c *DiscoveryChainController) convert(
+	sources map[configEntrySource][]json.RawMessage) []*serviceregistry.ConfigWrapper {
+	entries := make([]*discoveryChainEntry, 0)
+	for source, sourceEntries := range sources {
+		for _, data := range sourceEntries {
+			entry := &discoveryChainEntry{}
+			if err := json.Unmarshal(data, entry); err != nil {
+				log.Warnf("Could not decode %s config entry: %v", source.kind, err)
+				continue
+			}
+			// The kind is omitted by some Consul versions
+			entry.Kind = source.kind
+			entries = append(entries, entry)
+		}
+	}
+	chains := newDiscoveryChains(c.options, c.scopes, entries)
+	// The failovers are skipped until the datacenters are resolved
+	if c.failover {
+		chains.datacenters = c.datacenters
+	}
+	return chains.convert()
+}
@@ -0,0 +1,332 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	istio "istio.io/api/networking/v1alpha3"
+
+	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry"
+)
+
+const (
+	testResolvers = `[
+  {"Kind": "service-resolver", "Name": "reviews", "DefaultSubset": "v1", "ConnectTimeout": "5s",
+   "Subsets": {
+     "v1": {"Filter": "Service.Meta.version == v1"},
+     "v2": {"Filter": "\"version|v2\" in Service.Tags"},
+     "prod": {"Filter": "Service.Meta.env == prod"}
+   },
+   "LoadBalancer": {"Policy": "ring_hash", "HashPolicies": [{"Field": "header", "FieldValue": "x-user"}]}},
+  {"Kind": "service-resolver", "Name": "rating", "Redirect": {"Service": "ratings"}}
+]`
+	testSplitters = `[
+  {"Kind": "service-splitter", "Name": "reviews",
+   "Splits": [{"Weight": 90, "ServiceSubset": "v1"}, {"Weight": 10, "ServiceSubset": "v2"}]}
+]`
+	testRouters = `[
+  {"Kind": "service-router", "Name": "reviews",
+   "Routes": [{
+     "Match": {"HTTP": {"PathPrefix": "/api", "Header": [{"Name": "X-Debug", "Exact": "1"}]}},
+     "Destination": {"ServiceSubset": "v2", "PrefixRewrite": "/", "RequestTimeout": "3s", "NumRetries": 2,
+       "RetryOnConnectFailure": true}
+   }]}
+]`
+)
+
+func TestDiscoveryChains(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+	ts.rawConfigEntries = map[string]string{
+		api.ServiceResolver: testResolvers,
+		api.ServiceSplitter: testSplitters,
+		api.ServiceRouter:   testRouters,
+	}
+
+	args := newTestArgs(ts.server.URL)
+	args.MetaLabels = []string{"version"}
+	controller, err := NewDiscoveryChainController(args)
+	if err != nil {
+		t.Fatalf("could not create discovery chain controller: %v", err)
+	}
+	changes := 0
+	controller.AppendConfigChangeHandler(func() {
+		changes++
+	})
+
+	configs, err := controller.Configs()
+	if err != nil {
+		t.Fatalf("Configs() => %v", err)
+	}
+	want := []struct {
+		service string
+		name    string
+		spec    proto.Message
+	}{
+		{
+			service: "rating",
+			name:    "rating",
+			spec: &istio.VirtualService{
+				Hosts: []string{"rating"},
+				Http: []*istio.HTTPRoute{{
+					Route: []*istio.HTTPRouteDestination{{Destination: &istio.Destination{Host: "ratings"}}},
+				}},
+			},
+		},
+		{
+			service: "reviews",
+			name:    "reviews",
+			spec: &istio.DestinationRule{
+				Host: "reviews",
+				Subsets: []*istio.Subset{
+					{Name: "v1", Labels: map[string]string{"version": "v1"}},
+					{Name: "v2", Labels: map[string]string{"version": "v2"}},
+				},
+				TrafficPolicy: &istio.TrafficPolicy{
+					ConnectionPool: &istio.ConnectionPoolSettings{
+						Tcp: &istio.ConnectionPoolSettings_TCPSettings{
+							ConnectTimeout: durationpb.New(5 * time.Second),
+						},
+					},
+					LoadBalancer: &istio.LoadBalancerSettings{
+						LbPolicy: &istio.LoadBalancerSettings_ConsistentHash{
+							ConsistentHash: &istio.LoadBalancerSettings_ConsistentHashLB{
+								HashKey: &istio.LoadBalancerSettings_ConsistentHashLB_HttpHeaderName{
+									HttpHeaderName: "x-user",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			service: "reviews",
+			name:    "reviews",
+			spec: &istio.VirtualService{
+				Hosts: []string{"reviews"},
+				Http: []*istio.HTTPRoute{
+					{
+						Match: []*istio.HTTPMatchRequest{{
+							Uri: &istio.StringMatch{MatchType: &istio.StringMatch_Prefix{Prefix: "/api"}},
+							Headers: map[string]*istio.StringMatch{
+								"x-debug": {MatchType: &istio.StringMatch_Exact{Exact: "1"}},
+							},
+						}},
+						Route: []*istio.HTTPRouteDestination{
+							{Destination: &istio.Destination{Host: "reviews", Subset: "v2"}},
+						},
+						Rewrite: &istio.HTTPRewrite{Uri: "/"},
+						Timeout: durationpb.New(3 * time.Second),
+						Retries: &istio.HTTPRetry{Attempts: 2, RetryOn: "connect-failure"},
+					},
+					{
+						Route: []*istio.HTTPRouteDestination{
+							{Destination: &istio.Destination{Host: "reviews", Subset: "v1"}, Weight: 90},
+							{Destination: &istio.Destination{Host: "reviews", Subset: "v2"}, Weight: 10},
+						},
+					},
+				},
+			},
+		},
+	}
+	if len(configs) != len(want) {
+		t.Fatalf("Configs() => %d configs, want %d", len(configs), len(want))
+	}
+	for i, config := range configs {
+		if config.Service != want[i].service || config.Name != want[i].name || !proto.Equal(config.Spec, want[i].spec) {
+			t.Errorf("Configs()[%d] => %s %s %v, want %s %s %v", i, config.Service, config.Name, config.Spec,
+				want[i].service, want[i].name, want[i].spec)
+		}
+	}
+
+	// Removing the splitter sends the default route to the default subset, and the handlers are only notified of
+	// actual changes
+	w := newWatcher(context.Background())
+	defer w.cancel()
+	controller.mutex.Lock()
+	controller.watchers[""] = w
+	controller.mutex.Unlock()
+	controller.refresh(w, configEntrySource{kind: api.ServiceSplitter}, nil)
+	controller.refresh(w, configEntrySource{kind: api.ServiceSplitter}, nil)
+	if changes != 1 {
+		t.Errorf("refresh() notifies %d times, want 1", changes)
+	}
+	configs, err = controller.Configs()
+	if err != nil {
+		t.Fatalf("Configs() => %v", err)
+	}
+	virtualService := configs[len(configs)-1].Spec.(*istio.VirtualService)
+	wantRoute := []*istio.HTTPRouteDestination{{Destination: &istio.Destination{Host: "reviews", Subset: "v1"}}}
+	if last := virtualService.Http[len(virtualService.Http)-1]; len(last.Route) != len(wantRoute) ||
+		!proto.Equal(last.Route[0], wantRoute[0]) {
+		t.Errorf("default route => %v, want %v", last.Route, wantRoute)
+	}
+}
+
+func TestSplitWeights(t *testing.T) {
+	cases := []struct {
+		weights []float32
+		want    []int32
+	}{
+		{weights: []float32{90, 10}, want: []int32{90, 10}},
+		{weights: []float32{33.33, 33.33, 33.34}, want: []int32{33, 33, 34}},
+		{weights: []float32{50.5, 49.5}, want: []int32{51, 49}},
+		{weights: []float32{1, 1, 1}, want: []int32{34, 33, 33}},
+		{weights: []float32{0, 0}, want: []int32{0, 0}},
+	}
+	for _, c := range cases {
+		splits := make([]serviceSplit, 0, len(c.weights))
+		for _, weight := range c.weights {
+			splits = append(splits, serviceSplit{Weight: weight})
+		}
+		if got := splitWeights(splits); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("splitWeights(%v) => %v, want %v", c.weights, got, c.want)
+		}
+	}
+}
+
+func TestSubsetLabels(t *testing.T) {
+	opts, err := newConvertOptions(&BootStrapArgs{MetaLabels: []string{"version"}})
+	if err != nil {
+		t.Fatalf("newConvertOptions() => %v", err)
+	}
+	chains := newDiscoveryChains(opts, scopeConfig{}, nil)
+	cases := []struct {
+		filter  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{filter: "", want: map[string]string{}},
+		{filter: `Service.Meta.version == "v1"`, want: map[string]string{"version": "v1"}},
+		{filter: `Service.Meta.version == v1 and Service.Tags contains "zone|a"`,
+			want: map[string]string{"version": "v1", "zone": "a"}},
+		{filter: `Service.Meta.env == prod`, wantErr: true},
+		{filter: `Service.Meta.version == v1 or Service.Meta.version == v2`, wantErr: true},
+		{filter: `"canary" in Service.Tags`, wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := chains.subsetLabels(c.filter)
+		if (err != nil) != c.wantErr {
+			t.Errorf("subsetLabels(%q) => error %v, want error %v", c.filter, err, c.wantErr)
+			continue
+		}
+		if !c.wantErr && !reflect.DeepEqual(got, c.want) {
+			t.Errorf("subsetLabels(%q) => %v, want %v", c.filter, got, c.want)
+		}
+	}
+}
+
+func TestConfigEntryStorePartitions(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+	client, err := api.NewClient(&api.Config{Address: ts.server.URL})
+	if err != nil {
+		t.Fatalf("could not create Consul client: %v", err)
+	}
+	partitions := make(chan []string, 10)
+	convert := func(entries map[configEntrySource][]json.RawMessage) []*serviceregistry.ConfigWrapper {
+		converted := make([]string, 0, len(entries))
+		for source := range entries {
+			converted = append(converted, source.partition)
+		}
+		sort.Strings(converted)
+		partitions <- converted
+		return nil
+	}
+	store := newConfigEntryStore(client, scopeConfig{partitions: []string{AllPartitions}},
+		[]string{api.ServiceResolver}, convert)
+	store.refreshInterval = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.watch(ctx)
+
+	waitPartitions := func(want []string) {
+		t.Helper()
+		for {
+			select {
+			case got := <-partitions:
+				if reflect.DeepEqual(got, want) {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("config entries of partitions %v are never converted", want)
+			}
+		}
+	}
+	waitPartitions([]string{"ap1", "default"})
+
+	// The partitions are resolved again, a removed partition is no longer watched and its config entries are dropped
+	ts.lock.Lock()
+	ts.partitions = []string{"default"}
+	ts.lock.Unlock()
+	waitPartitions([]string{"default"})
+	store.mutex.Lock()
+	watched := make([]string, 0, len(store.watchers))
+	for partition := range store.watchers {
+		watched = append(watched, partition)
+	}
+	store.mutex.Unlock()
+	if !reflect.DeepEqual(watched, []string{"default"}) {
+		t.Errorf("watched partitions => %v, want [default]", watched)
+	}
+
+	// A new partition is watched once it's resolved
+	ts.lock.Lock()
+	ts.partitions = []string{"default", "ap2"}
+	ts.lock.Unlock()
+	waitPartitions([]string{"ap2", "default"})
+}
+
+func TestDiscoveryChainDatacenters(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+	args := newTestArgs(ts.server.URL)
+	args.SyncFailover = true
+	args.Datacenters = []string{AllDatacenters}
+	controller, err := NewDiscoveryChainController(args)
+	if err != nil {
+		t.Fatalf("could not create discovery chain controller: %v", err)
+	}
+	if controller.datacenters != nil {
+		t.Fatalf("datacenters => %v before Run(), want them listed by the watcher", controller.datacenters)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	controller.Run(stop)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		controller.mutex.Lock()
+		datacenters := controller.datacenters
+		controller.mutex.Unlock()
+		if reflect.DeepEqual(datacenters, []string{"dc1", "dc2"}) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("datacenters => %v, want [dc1 dc2]", datacenters)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"istio.io/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/aeraki-framework/consul2istio/pkg/constants"
+)
+
+const (
+	// DefaultExportNode is the default name of the synthetic Consul node of the exported Kubernetes services
+	DefaultExportNode = "consul2istio-k8s"
+
+	// exportedServiceMeta marks the instances exported from Kubernetes with the namespace/name of their Service, the
+	// instances with it are never synchronized back to Istio
+	exportedServiceMeta = "consul2istio-k8s-service"
+	// exportNodeAddress is the address of the synthetic node, the instances have the addresses of the pods
+	exportNodeAddress = "127.0.0.1"
+	// exportResyncInterval is the interval to register the Kubernetes services again, which repairs the catalog if
+	// Consul has lost or changed the registrations
+	exportResyncInterval = time.Minute
+)
+
+// ExportController registers the Kubernetes services in the Consul catalog under a synthetic node, so that the
+// workloads outside the mesh which resolve the services through Consul can reach the services in Kubernetes.
+// Each ready endpoint of a Service becomes an instance of the Consul service with the same name.
+type ExportController struct {
+	client     *api.Client
+	kubeClient kubernetes.Interface
+	node       string
+	// namespaces are the Kubernetes namespaces to export, all the namespaces but kube-system if it's empty
+	namespaces []string
+	services   corelisters.ServiceLister
+	slices     discoverylisters.EndpointSliceLister
+	// changed receives the changes of the Services and EndpointSlices
+	changed chan struct{}
+}
+
+// NewExportController creates a controller which exports the Kubernetes services to Consul
+func NewExportController(args *BootStrapArgs, kubeClient kubernetes.Interface) (*ExportController, error) {
+	client, err := newConsulClient(args)
+	if err != nil {
+		return nil, err
+	}
+	node := args.ExportNode
+	if node == "" {
+		node = DefaultExportNode
+	}
+	return &ExportController{
+		client:     client,
+		kubeClient: kubeClient,
+		node:       node,
+		namespaces: args.ExportNamespaces,
+		changed:    make(chan struct{}, 1),
+	}, nil
+}
+
+// Run until a stop signal is received
+func (c *ExportController) Run(stop <-chan struct{}) {
+	factory := informers.NewSharedInformerFactory(c.kubeClient, 0)
+	services := factory.Core().V1().Services()
+	slices := factory.Discovery().V1().EndpointSlices()
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) {
+			c.notify()
+		},
+		UpdateFunc: func(interface{}, interface{}) {
+			c.notify()
+		},
+		DeleteFunc: func(interface{}) {
+			c.notify()
+		},
+	}
+	services.Informer().AddEventHandler(handler)
+	slices.Informer().AddEventHandler(handler)
+	c.services = services.Lister()
+	c.slices = slices.Lister()
+	factory.Start(stop)
+	go c.watch(stop, factory)
+}
+
+// notify triggers a sync without blocking, a pending sync covers all the changes
+func (c *ExportController) notify() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// watch syncs the Kubernetes services to Consul after the changes have settled, and periodically
+func (c *ExportController) watch(stop <-chan struct{}, factory informers.SharedInformerFactory) {
+	for informer, synced := range factory.WaitForCacheSync(stop) {
+		if !synced {
+			log.Errorf("Could not sync the cache of %v to export Kubernetes services", informer)
+			return
+		}
+	}
+	resync := time.NewTicker(exportResyncInterval)
+	defer resync.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-c.changed:
+			time.Sleep(constants.DebounceAfter)
+		case <-resync.C:
+		}
+		if err := c.sync(); err != nil {
+			log.Warnf("Could not export Kubernetes services to Consul: %v", err)
+		}
+	}
+}
+
+// sync registers the endpoints of the Kubernetes services in Consul, and deregisters the stale instances of the
+// synthetic node
+func (c *ExportController) sync() error {
+	services, err := c.services.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	slices, err := c.slices.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	return c.register(c.exportedInstances(services, slices))
+}
+
+// exportedInstances converts the ready endpoints of the Kubernetes services to Consul instances keyed by their IDs
+func (c *ExportController) exportedInstances(services []*corev1.Service,
+	slices []*discoveryv1.EndpointSlice) map[string]*api.AgentService {
+	exported := make(map[string]*corev1.Service, len(services))
+	for _, service := range services {
+		// The Services without a selector, like the one of the API server, don't point to workloads
+		if !c.exportNamespace(service.Namespace) || service.Annotations[constants.ExportAnnotation] == "false" ||
+			len(service.Spec.Selector) == 0 || len(service.Spec.Ports) == 0 {
+			continue
+		}
+		exported[kubeServiceKey(service.Namespace, service.Name)] = service
+	}
+
+	instances := make(map[string]*api.AgentService)
+	for _, slice := range slices {
+		if slice.AddressType == discoveryv1.AddressTypeFQDN {
+			continue
+		}
+		service, ok := exported[kubeServiceKey(slice.Namespace, slice.Labels[discoveryv1.LabelServiceName])]
+		if !ok {
+			continue
+		}
+		// A Consul instance has a single port, which is the first port of the Service
+		var port int32
+		for _, slicePort := range slice.Ports {
+			if slicePort.Name != nil && *slicePort.Name == service.Spec.Ports[0].Name && slicePort.Port != nil {
+				port = *slicePort.Port
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		name := service.Name
+		if override := service.Annotations[constants.ExportServiceAnnotation]; override != "" {
+			name = override
+		}
+		for _, endpoint := range slice.Endpoints {
+			if len(endpoint.Addresses) == 0 ||
+				(endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready) {
+				continue
+			}
+			address := endpoint.Addresses[0]
+			id := fmt.Sprintf("%s-%s-%s", service.Name, service.Namespace, address)
+			instances[id] = &api.AgentService{
+				ID:      id,
+				Service: name,
+				Address: address,
+				Port:    int(port),
+				Tags:    []string{"k8s"},
+				Meta: map[string]string{
+					"external-source":   "kubernetes",
+					exportedServiceMeta: kubeServiceKey(service.Namespace, service.Name),
+				},
+			}
+		}
+	}
+	return instances
+}
+
+// exportNamespace tells whether the services in a Kubernetes namespace are exported
+func (c *ExportController) exportNamespace(namespace string) bool {
+	if len(c.namespaces) == 0 {
+		return namespace != "kube-system"
+	}
+	return contains(c.namespaces, namespace)
+}
+
+// register makes the instances of the synthetic node identical to the exported ones
+func (c *ExportController) register(instances map[string]*api.AgentService) error {
+	node, _, err := c.client.Catalog().Node(c.node, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %v", c.node, err)
+	}
+	registered := make(map[string]*api.AgentService)
+	if node != nil {
+		registered = node.Services
+	}
+
+	ids := make([]string, 0, len(instances))
+	for id := range instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		instance := instances[id]
+		if old, ok := registered[id]; ok && instanceEqual(old, instance) {
+			continue
+		}
+		log.Infof("Registering Kubernetes service %s in Consul: %s %s:%d", instance.Meta[exportedServiceMeta],
+			instance.Service, instance.Address, instance.Port)
+		if _, err = c.client.Catalog().Register(&api.CatalogRegistration{
+			Node:     c.node,
+			Address:  exportNodeAddress,
+			NodeMeta: map[string]string{"external-source": "kubernetes"},
+			Service:  instance,
+		}, nil); err != nil {
+			return fmt.Errorf("failed to register instance %s: %v", id, err)
+		}
+	}
+	for id, old := range registered {
+		if _, ok := instances[id]; ok {
+			continue
+		}
+		log.Infof("Deregistering Kubernetes service %s from Consul: %s %s:%d", old.Meta[exportedServiceMeta],
+			old.Service, old.Address, old.Port)
+		if _, err = c.client.Catalog().Deregister(&api.CatalogDeregistration{
+			Node:      c.node,
+			ServiceID: id,
+		}, nil); err != nil {
+			return fmt.Errorf("failed to deregister instance %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// instanceEqual tells whether a registered instance is identical to an exported one
+func instanceEqual(registered, exported *api.AgentService) bool {
+	return registered.Service == exported.Service && registered.Address == exported.Address &&
+		registered.Port == exported.Port && reflect.DeepEqual(registered.Tags, exported.Tags) &&
+		reflect.DeepEqual(registered.Meta, exported.Meta)
+}
+
+// kubeServiceKey returns the namespace/name of a Kubernetes Service
+func kubeServiceKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// isExported tells whether an instance has been exported from Kubernetes, so that it's never synchronized back
+func isExported(endpoint *api.CatalogService) bool {
+	_, ok := endpoint.ServiceMeta[exportedServiceMeta]
+	return ok
+}
@@ -0,0 +1,141 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/aeraki-framework/consul2istio/pkg/constants"
+)
+
+func kubeService(namespace, name string, annotations map[string]string, ports ...string) *corev1.Service {
+	service := &corev1.Service{
+		ObjectMeta: v1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": name}},
+	}
+	for _, port := range ports {
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Name: port})
+	}
+	return service
+}
+
+func endpointSlice(namespace, service string, ports map[string]int32,
+	ready map[string]bool) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: namespace,
+			Name:      service + "-abcde",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+	}
+	for name, port := range ports {
+		name, port := name, port
+		slice.Ports = append(slice.Ports, discoveryv1.EndpointPort{Name: &name, Port: &port})
+	}
+	for address, isReady := range ready {
+		isReady := isReady
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{address},
+			Conditions: discoveryv1.EndpointConditions{Ready: &isReady},
+		})
+	}
+	return slice
+}
+
+func TestExportServices(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+	controller, err := NewExportController(newTestArgs(ts.server.URL), nil)
+	if err != nil {
+		t.Fatalf("could not create export controller: %v", err)
+	}
+
+	services := []*corev1.Service{
+		kubeService("shop", "cart", nil, "http", "metrics"),
+		kubeService("shop", "checkout", map[string]string{constants.ExportServiceAnnotation: "payments"}, ""),
+		kubeService("shop", "internal", map[string]string{constants.ExportAnnotation: "false"}, "http"),
+		kubeService("kube-system", "kube-dns", nil, "dns"),
+	}
+	slices := []*discoveryv1.EndpointSlice{
+		endpointSlice("shop", "cart", map[string]int32{"http": 8080, "metrics": 9090},
+			map[string]bool{"10.0.0.1": true, "10.0.0.2": false}),
+		endpointSlice("shop", "checkout", map[string]int32{"": 8443}, map[string]bool{"10.0.0.3": true}),
+		endpointSlice("shop", "internal", map[string]int32{"http": 8080}, map[string]bool{"10.0.0.4": true}),
+		endpointSlice("kube-system", "kube-dns", map[string]int32{"dns": 53}, map[string]bool{"10.0.0.5": true}),
+	}
+	if err := controller.register(controller.exportedInstances(services, slices)); err != nil {
+		t.Fatalf("register() => %v", err)
+	}
+
+	// Only the ready endpoints are registered with the first port of their Services
+	instances := func() []string {
+		ts.lock.Lock()
+		defer ts.lock.Unlock()
+		out := make([]string, 0)
+		for id, instance := range ts.nodeServices[DefaultExportNode] {
+			out = append(out, id+" "+instance.Service+" "+instance.Meta[exportedServiceMeta])
+		}
+		sort.Strings(out)
+		return out
+	}
+	want := []string{
+		"cart-shop-10.0.0.1 cart shop/cart",
+		"checkout-shop-10.0.0.3 payments shop/checkout",
+	}
+	if got := instances(); !reflect.DeepEqual(got, want) {
+		t.Errorf("registered instances => %v, want %v", got, want)
+	}
+
+	// The instances of a deleted Service are deregistered
+	if err := controller.register(controller.exportedInstances(services[:1], slices)); err != nil {
+		t.Fatalf("register() => %v", err)
+	}
+	want = want[:1]
+	if got := instances(); !reflect.DeepEqual(got, want) {
+		t.Errorf("registered instances => %v, want %v", got, want)
+	}
+}
+
+func TestExportedInstancesSkipped(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+	ts.extra = map[string][]*api.CatalogService{
+		"cart": {{Node: DefaultExportNode, ServiceID: "cart-shop-10.0.0.1", ServiceName: "cart",
+			ServiceAddress: "10.0.0.1", ServicePort: 8080,
+			ServiceMeta: map[string]string{exportedServiceMeta: "shop/cart"}}},
+	}
+	client, err := newConsulClient(newTestArgs(ts.server.URL))
+	if err != nil {
+		t.Fatalf("newConsulClient() => %v", err)
+	}
+
+	// The instances exported from Kubernetes are never synchronized back
+	endpoints, _, _, err := getServiceInstances(client, newInstanceQuery(newTestArgs(ts.server.URL)), "cart",
+		&api.QueryOptions{})
+	if err != nil {
+		t.Fatalf("getServiceInstances() => %v", err)
+	}
+	if endpoints != nil {
+		t.Errorf("getServiceInstances() => %v, want the service skipped", endpoints)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	istio "istio.io/api/networking/v1alpha3"
+)
+
+const (
+	// failoverConsecutiveErrors, failoverInterval and failoverEjectionTime configure the outlier detection which
+	// ejects the unhealthy endpoints, Istio only fails over to another locality with outlier detection
+	failoverConsecutiveErrors = 5
+	failoverInterval          = 10 * time.Second
+	failoverEjectionTime      = 30 * time.Second
+)
+
+// failoverPolicy returns the traffic policy which fails over between the datacenters like Consul does: the traffic
+// from each synchronized datacenter goes to the first of the failover targets other than itself once its own
+// endpoints are ejected. It's nil if there is nothing to fail over to.
+//
+// The datacenters are the regions of the endpoints, so the failover requires the instances in all the datacenters
+// to be in one ServiceEntry, and the region of the locality to be the datacenter.
+func (o *convertOptions) failoverPolicy(datacenters, targets []string) (*istio.TrafficPolicy, error) {
+	if len(o.locality.region) > 0 && o.locality.region[0].kind != LocalitySourceDatacenter {
+		return nil, fmt.Errorf("the region of the locality is not the datacenter")
+	}
+
+	synchronized := make(map[string]bool, len(datacenters))
+	for _, datacenter := range datacenters {
+		synchronized[datacenter] = true
+	}
+	froms := make([]string, 0, len(datacenters))
+	for _, datacenter := range datacenters {
+		if datacenter != "" {
+			froms = append(froms, datacenter)
+		}
+	}
+	sort.Strings(froms)
+
+	failover := make([]*istio.LocalityLoadBalancerSetting_Failover, 0, len(froms))
+	for _, from := range froms {
+		for _, to := range targets {
+			if to != from && synchronized[to] {
+				failover = append(failover, &istio.LocalityLoadBalancerSetting_Failover{From: from, To: to})
+				break
+			}
+		}
+	}
+	if len(failover) == 0 {
+		return nil, fmt.Errorf("none of the failover datacenters %v is synchronized", targets)
+	}
+	return &istio.TrafficPolicy{
+		LoadBalancer: &istio.LoadBalancerSettings{
+			LocalityLbSetting: &istio.LocalityLoadBalancerSetting{Failover: failover},
+		},
+		OutlierDetection: &istio.OutlierDetection{
+			Consecutive_5XxErrors: wrapperspb.UInt32(failoverConsecutiveErrors),
+			Interval:              durationpb.New(failoverInterval),
+			BaseEjectionTime:      durationpb.New(failoverEjectionTime),
+		},
+	}, nil
+}
+
+// withFailover adds the failover to a traffic policy, the load balancer of the traffic policy is kept
+func withFailover(policy, failover *istio.TrafficPolicy) *istio.TrafficPolicy {
+	out := &istio.TrafficPolicy{}
+	if policy != nil {
+		out = proto.Clone(policy).(*istio.TrafficPolicy)
+	}
+	if out.LoadBalancer == nil {
+		out.LoadBalancer = &istio.LoadBalancerSettings{}
+	}
+	out.LoadBalancer.LocalityLbSetting = failover.LoadBalancer.LocalityLbSetting
+	out.OutlierDetection = failover.OutlierDetection
+	return out
+}
@@ -0,0 +1,98 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	istio "istio.io/api/networking/v1alpha3"
+
+	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry"
+)
+
+func testFailoverPolicy(failover ...*istio.LocalityLoadBalancerSetting_Failover) *istio.TrafficPolicy {
+	return &istio.TrafficPolicy{
+		LoadBalancer: &istio.LoadBalancerSettings{
+			LocalityLbSetting: &istio.LocalityLoadBalancerSetting{Failover: failover},
+		},
+		OutlierDetection: &istio.OutlierDetection{
+			Consecutive_5XxErrors: wrapperspb.UInt32(failoverConsecutiveErrors),
+			Interval:              durationpb.New(failoverInterval),
+			BaseEjectionTime:      durationpb.New(failoverEjectionTime),
+		},
+	}
+}
+
+func TestResolverFailover(t *testing.T) {
+	opts, err := newConvertOptions(&BootStrapArgs{MetaLabels: []string{"version"}})
+	if err != nil {
+		t.Fatalf("newConvertOptions() => %v", err)
+	}
+	resolver := &discoveryChainEntry{
+		Kind: api.ServiceResolver,
+		Name: "reviews",
+		Subsets: map[string]resolverSubset{
+			"v1": {Filter: `Service.Meta.version == v1`},
+		},
+		Failover: map[string]resolverFailover{
+			"*":  {Datacenters: []string{"dc2", "dc3"}},
+			"v1": {Targets: []failoverTarget{{Datacenter: "dc3"}}},
+		},
+	}
+	chains := newDiscoveryChains(opts, scopeConfig{}, []*discoveryChainEntry{resolver})
+	chains.datacenters = []string{"dc1", "dc2", "dc3"}
+	configs := chains.convert()
+
+	// Each datacenter fails over to the first other one, and the subset keeps the load balancer of the service
+	want := &istio.DestinationRule{
+		Host: "reviews",
+		TrafficPolicy: testFailoverPolicy(
+			&istio.LocalityLoadBalancerSetting_Failover{From: "dc1", To: "dc2"},
+			&istio.LocalityLoadBalancerSetting_Failover{From: "dc2", To: "dc3"},
+			&istio.LocalityLoadBalancerSetting_Failover{From: "dc3", To: "dc2"},
+		),
+		Subsets: []*istio.Subset{{
+			Name:   "v1",
+			Labels: map[string]string{"version": "v1"},
+			TrafficPolicy: testFailoverPolicy(
+				&istio.LocalityLoadBalancerSetting_Failover{From: "dc1", To: "dc3"},
+				&istio.LocalityLoadBalancerSetting_Failover{From: "dc2", To: "dc3"},
+			),
+		}},
+	}
+	if len(configs) != 1 || !proto.Equal(configs[0].Spec, want) {
+		t.Fatalf("convert() => %v, want %v", configSpecs(configs), want)
+	}
+
+	// Nothing fails over if the failover datacenters are not synchronized
+	chains = newDiscoveryChains(opts, scopeConfig{}, []*discoveryChainEntry{resolver})
+	chains.datacenters = []string{""}
+	configs = chains.convert()
+	if len(configs) != 1 || configs[0].Spec.(*istio.DestinationRule).TrafficPolicy != nil {
+		t.Errorf("convert() => %v, want no failover", configSpecs(configs))
+	}
+}
+
+func configSpecs(configs []*serviceregistry.ConfigWrapper) []proto.Message {
+	specs := make([]proto.Message, 0, len(configs))
+	for _, config := range configs {
+		specs = append(specs, config.Spec)
+	}
+	return specs
+}
@@ -0,0 +1,107 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// IgnoreTag opts a service out of the synchronization if any instance of the service has it
+const IgnoreTag = "consul2istio-ignore"
+
+// serviceFilter selects the services to synchronize by their names and tags
+type serviceFilter struct {
+	include      *regexp.Regexp
+	exclude      *regexp.Regexp
+	requiredTags []string
+}
+
+func newServiceFilter(args *BootStrapArgs) (*serviceFilter, error) {
+	f := &serviceFilter{
+		requiredTags: args.RequiredTags,
+	}
+	var err error
+	if args.IncludeServices != "" {
+		if f.include, err = regexp.Compile(args.IncludeServices); err != nil {
+			return nil, fmt.Errorf("invalid regular expression of the services to include: %v", err)
+		}
+	}
+	if args.ExcludeServices != "" {
+		if f.exclude, err = regexp.Compile(args.ExcludeServices); err != nil {
+			return nil, fmt.Errorf("invalid regular expression of the services to exclude: %v", err)
+		}
+	}
+	return f, nil
+}
+
+// match tells whether a service is synchronized, tags are the tags of all the instances of the service
+func (f *serviceFilter) match(name string, tags []string) bool {
+	if contains(tags, IgnoreTag) {
+		return false
+	}
+	if f.include != nil && !f.include.MatchString(name) {
+		return false
+	}
+	if f.exclude != nil && f.exclude.MatchString(name) {
+		return false
+	}
+	for _, tag := range f.requiredTags {
+		if !contains(tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// filter returns the services to synchronize in a service list of the catalog API
+func (f *serviceFilter) filter(services map[string][]string) map[string][]string {
+	filtered := make(map[string][]string, len(services))
+	for name, tags := range services {
+		if f.match(name, tags) {
+			filtered[name] = tags
+		}
+	}
+	return filtered
+}
+
+// parseRequiredMeta parses the required meta in the "key=value" format, a key without a value only requires the
+// key to be present
+func parseRequiredMeta(meta []string) map[string]*string {
+	required := make(map[string]*string, len(meta))
+	for _, item := range meta {
+		if i := strings.Index(item, "="); i >= 0 {
+			value := item[i+1:]
+			required[item[:i]] = &value
+		} else {
+			required[item] = nil
+		}
+	}
+	return required
+}
+
+// matchMeta tells whether an instance has the required meta
+func matchMeta(endpoint *api.CatalogService, required map[string]*string) bool {
+	for key, value := range required {
+		actual, ok := endpoint.ServiceMeta[key]
+		if !ok || (value != nil && actual != *value) {
+			return false
+		}
+	}
+	return true
+}
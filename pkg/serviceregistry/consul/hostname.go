@@ -0,0 +1,149 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/consul/api"
+	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// hostnameFuncs are the functions available to the hostname templates besides the builtin ones
+var hostnameFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"replace": strings.ReplaceAll,
+	"join":    strings.Join,
+}
+
+// hostnameData is the data of a Consul service which the hostname templates are executed with
+type hostnameData struct {
+	// Name is the name of the Consul service
+	Name string
+	// Datacenter is the datacenter of the ServiceEntry when the datacenters are split, otherwise the datacenter of
+	// the instances if they're all in the same datacenter
+	Datacenter string
+	// Namespace and Partition are the Consul Enterprise namespace and admin partition of the service
+	Namespace string
+	Partition string
+	// FQDN is the domain suffix configured for consul2istio
+	FQDN string
+	// Tags are the tags of all the instances
+	Tags []string
+	// Meta is the service meta which all the instances have in common
+	Meta map[string]string
+}
+
+// parseHostTemplates parses the Go templates of the hostnames of the ServiceEntries
+func parseHostTemplates(texts []string) ([]*template.Template, error) {
+	templates := make([]*template.Template, 0, len(texts))
+	for i, text := range texts {
+		tmpl, err := template.New(fmt.Sprintf("host-%d", i)).Funcs(hostnameFuncs).
+			Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host template %q: %v", text, err)
+		}
+		templates = append(templates, tmpl)
+	}
+	return templates, nil
+}
+
+func newHostnameData(opts *convertOptions, key ServiceKey, datacenter string,
+	endpoints []*api.CatalogService) *hostnameData {
+	data := &hostnameData{
+		Name:       key.Name,
+		Datacenter: datacenter,
+		Namespace:  key.Namespace,
+		Partition:  key.Partition,
+		FQDN:       opts.fqdn,
+		Tags:       make([]string, 0),
+		Meta:       make(map[string]string),
+	}
+
+	tags := make(map[string]bool)
+	for i, endpoint := range endpoints {
+		if i == 0 {
+			if datacenter == "" {
+				data.Datacenter = endpoint.Datacenter
+			}
+			for k, v := range endpoint.ServiceMeta {
+				data.Meta[k] = v
+			}
+		}
+		if data.Datacenter != endpoint.Datacenter {
+			data.Datacenter = ""
+		}
+		for k, v := range data.Meta {
+			if value, ok := endpoint.ServiceMeta[k]; !ok || value != v {
+				delete(data.Meta, k)
+			}
+		}
+		for _, tag := range endpoint.ServiceTags {
+			if !tags[tag] {
+				tags[tag] = true
+				data.Tags = append(data.Tags, tag)
+			}
+		}
+	}
+	sort.Strings(data.Tags)
+	return data
+}
+
+// hostnames executes the host templates for the instances of a service. A template which produces an empty string
+// is skipped, so that a host can be conditional, e.g. `{{with .Meta.alias}}{{.}}.consul{{end}}`. The invalid hosts
+// are dropped, and nil is returned if there's no valid host so that the default hostname is used.
+func (o *convertOptions) hostnames(key ServiceKey, datacenter string, endpoints []*api.CatalogService) []string {
+	data := newHostnameData(o, key, datacenter, endpoints)
+	hosts := make([]string, 0, len(o.hostTemplates))
+	seen := make(map[string]bool, len(o.hostTemplates))
+	for _, tmpl := range o.hostTemplates {
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, data); err != nil {
+			log.Warnf("Host template %s of service %s is skipped: %v", tmpl.Root.String(), key.Name, err)
+			continue
+		}
+		host := strings.ToLower(strings.TrimSpace(sb.String()))
+		if host == "" || seen[host] {
+			continue
+		}
+		if errs := validation.IsDNS1123Subdomain(strings.TrimPrefix(host, "*.")); len(errs) > 0 {
+			log.Warnf("Host %s of service %s is dropped since it's invalid: %s", host, key.Name,
+				strings.Join(errs, "; "))
+			continue
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		if len(o.hostTemplates) > 0 {
+			log.Warnf("Host templates produce no valid host for service %s, the default hostname is used", key.Name)
+		}
+		return nil
+	}
+	return hosts
+}
+
+// serviceHost returns the host of the ServiceEntry of a service whose instances are not at hand, e.g. the destination
+// of a route, so the host templates are rendered without the tags and meta of the instances
+func (o *convertOptions) serviceHost(key ServiceKey) string {
+	if hosts := o.hostnames(key, "", nil); len(hosts) > 0 {
+		return hosts[0]
+	}
+	return serviceHostname(o.qualifiedName(key), "", o.fqdn)
+}
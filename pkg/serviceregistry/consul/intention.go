@@ -0,0 +1,157 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"istio.io/pkg/log"
+
+	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry"
+)
+
+const (
+	// IntentionActionAllow allows the requests which match no intention, like the "allow" default ACL policy
+	IntentionActionAllow = "allow"
+	// IntentionActionDeny denies the requests which match no intention, like the "deny" default ACL policy
+	IntentionActionDeny = "deny"
+	// DefaultIntentionSelectorLabel is the label which selects the workloads of a Consul service by its name
+	DefaultIntentionSelectorLabel = "app"
+)
+
+// serviceIntentions is the kind of the config entries of the intentions, which the vendored Consul client predates
+const serviceIntentions = "service-intentions"
+
+// intentionEntry is a service-intentions config entry, which holds the intentions to a destination service
+type intentionEntry struct {
+	Name      string
+	Partition string
+	Namespace string
+	Sources   []*intentionSource
+	// JWT is the JWT requirement of all the requests to the destination
+	JWT interface{}
+}
+
+type intentionSource struct {
+	Name          string
+	Partition     string
+	Namespace     string
+	Peer          string
+	SamenessGroup string
+	// Action is the action of an L4 intention, it's empty if the intention has permissions
+	Action      string
+	Permissions []*intentionPermission
+}
+
+type intentionPermission struct {
+	Action string
+	HTTP   *intentionHTTPMatch
+	JWT    interface{}
+}
+
+type intentionHTTPMatch struct {
+	PathExact  string
+	PathPrefix string
+	PathRegex  string
+	Header     []headerMatch
+	Methods    []string
+}
+
+// IntentionController converts the intentions of Consul Connect to AuthorizationPolicies
+type IntentionController struct {
+	*configEntryStore
+	options       *convertOptions
+	defaultAction string
+	selectorLabel string
+	dryRun        bool
+	// report lists the intentions which couldn't be converted the last time
+	report []string
+}
+
+// NewIntentionController creates a controller of the intentions of Consul services
+func NewIntentionController(args *BootStrapArgs) (*IntentionController, error) {
+	if args.IntentionDefaultAction != IntentionActionAllow && args.IntentionDefaultAction != IntentionActionDeny {
+		return nil, fmt.Errorf("unsupported intention default action %s", args.IntentionDefaultAction)
+	}
+	client, err := newConsulClient(args)
+	if err != nil {
+		return nil, err
+	}
+	options, err := newConvertOptions(args)
+	if err != nil {
+		return nil, err
+	}
+	selectorLabel := args.IntentionSelectorLabel
+	if selectorLabel == "" {
+		selectorLabel = DefaultIntentionSelectorLabel
+	}
+	c := &IntentionController{
+		options:       options,
+		defaultAction: args.IntentionDefaultAction,
+		selectorLabel: selectorLabel,
+		dryRun:        args.IntentionsDryRun,
+	}
+	c.configEntryStore = newConfigEntryStore(client, newScopeConfig(args), []string{serviceIntentions}, c.convert)
+	return c, nil
+}
+
+// Kinds implements a config store operation, nothing is pushed in the dry run
+func (c *IntentionController) Kinds() []string {
+	if c.dryRun {
+		return nil
+	}
+	return []string{"AuthorizationPolicy"}
+}
+
+// convert decodes the intentions and converts them, the intentions which can't be expressed are reported, so are
+// the AuthorizationPolicies in the dry run. The caller must hold the mutex.
+func (c *IntentionController) convert(
+	sources map[configEntrySource][]json.RawMessage) []*serviceregistry.ConfigWrapper {
+	entries := make([]*intentionEntry, 0)
+	for source, sourceEntries := range sources {
+		for _, data := range sourceEntries {
+			entry := &intentionEntry{}
+			if err := json.Unmarshal(data, entry); err != nil {
+				log.Warnf("Could not decode %s config entry: %v", source.kind, err)
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	converter := &intentions{
+		opts:          c.options,
+		scopes:        c.scopes,
+		defaultAction: c.defaultAction,
+		selectorLabel: c.selectorLabel,
+	}
+	configs := converter.convert(entries)
+	if !reflect.DeepEqual(converter.report, c.report) {
+		for _, line := range converter.report {
+			log.Warnf("Intention not converted: %s", line)
+		}
+		c.report = converter.report
+	}
+	if c.dryRun && !serviceregistry.ConfigsEqual(c.configs, configs) {
+		log.Infof("Dry run of the intentions: %d AuthorizationPolicies", len(configs))
+		for _, config := range configs {
+			log.Infof("Dry run of the intentions: AuthorizationPolicy %s in namespace %q: %v", config.Name,
+				config.Namespace, config.Spec)
+		}
+	}
+	return configs
+}
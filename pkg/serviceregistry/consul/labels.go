@@ -0,0 +1,160 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// DefaultTagSeparator separates the key and the value of a tag which is converted to a label
+	DefaultTagSeparator = "|"
+
+	// AllMetaKeys copies all the meta of an instance to the labels
+	AllMetaKeys = "*"
+)
+
+// invalidLabelChars matches the characters which are not allowed in label names and values
+var invalidLabelChars = regexp.MustCompile(`[^-A-Za-z0-9_.]`)
+
+// labelOptions controls how the tags and meta of Consul instances are converted to the labels of WorkloadEntries
+type labelOptions struct {
+	// tagSeparators separate the key and the value of a tag, the first one found in a tag is used
+	tagSeparators []string
+	// tagPrefixes select the tags to convert by their prefixes, all the tags are converted if it's empty
+	tagPrefixes []string
+	// stripTagPrefix removes the matched prefix from the label key
+	stripTagPrefix bool
+	// metaKeys are the service meta keys to copy to the labels
+	metaKeys []string
+	// nodeMetaKeys are the node meta keys to copy to the labels
+	nodeMetaKeys []string
+}
+
+func newLabelOptions(args *BootStrapArgs) labelOptions {
+	return labelOptions{
+		tagSeparators:  args.TagSeparators,
+		tagPrefixes:    args.TagPrefixes,
+		stripTagPrefix: args.StripTagPrefix,
+		metaKeys:       args.MetaLabels,
+		nodeMetaKeys:   args.NodeMetaLabels,
+	}
+}
+
+// convertLabels converts the tags, service meta and node meta of an instance to labels, the service meta takes
+// precedence over the tags, which take precedence over the node meta
+func convertLabels(opts labelOptions, endpoint *api.CatalogService) labels.Instance {
+	out := make(labels.Instance, len(endpoint.ServiceTags))
+	copyMeta(out, endpoint.NodeMeta, opts.nodeMetaKeys)
+	for _, tag := range endpoint.ServiceTags {
+		key, value, ok := opts.splitTag(tag)
+		if !ok {
+			// Labels not of form "key|value" are ignored to avoid possible collisions
+			log.Debugf("Tag %v ignored since it is not of form key%svalue", tag, opts.separators()[0])
+			continue
+		}
+		addLabel(out, key, value)
+	}
+	copyMeta(out, endpoint.ServiceMeta, opts.metaKeys)
+	return out
+}
+
+func (o labelOptions) separators() []string {
+	if len(o.tagSeparators) == 0 {
+		return []string{DefaultTagSeparator}
+	}
+	return o.tagSeparators
+}
+
+// splitTag splits a tag into a label key and value, it returns false if the tag is not converted
+func (o labelOptions) splitTag(tag string) (string, string, bool) {
+	if len(o.tagPrefixes) > 0 {
+		matched := false
+		for _, prefix := range o.tagPrefixes {
+			if strings.HasPrefix(tag, prefix) {
+				matched = true
+				if o.stripTagPrefix {
+					tag = strings.TrimPrefix(tag, prefix)
+				}
+				break
+			}
+		}
+		if !matched {
+			return "", "", false
+		}
+	}
+
+	for _, separator := range o.separators() {
+		if i := strings.Index(tag, separator); i > 0 {
+			return tag[:i], tag[i+len(separator):], true
+		}
+	}
+	return "", "", false
+}
+
+func copyMeta(out labels.Instance, meta map[string]string, keys []string) {
+	for _, key := range keys {
+		if key == AllMetaKeys {
+			for k, v := range meta {
+				addLabel(out, k, v)
+			}
+			continue
+		}
+		if value, ok := meta[key]; ok {
+			addLabel(out, key, value)
+		}
+	}
+}
+
+// addLabel adds a label after sanitizing its key and value, the label is dropped if it's still invalid
+func addLabel(out labels.Instance, key, value string) {
+	sanitizedKey, sanitizedValue := sanitizeLabelKey(key), sanitizeLabelValue(value)
+	if errs := validation.IsQualifiedName(sanitizedKey); len(errs) > 0 {
+		log.Warnf("Label %s=%s is dropped since the key is invalid: %s", key, value, strings.Join(errs, "; "))
+		return
+	}
+	if errs := validation.IsValidLabelValue(sanitizedValue); len(errs) > 0 {
+		log.Warnf("Label %s=%s is dropped since the value is invalid: %s", key, value, strings.Join(errs, "; "))
+		return
+	}
+	if sanitizedKey != key || sanitizedValue != value {
+		log.Debugf("Label %s=%s is sanitized to %s=%s", key, value, sanitizedKey, sanitizedValue)
+	}
+	out[sanitizedKey] = sanitizedValue
+}
+
+// sanitizeLabelKey sanitizes the name of a label key, the prefix is kept as is
+func sanitizeLabelKey(key string) string {
+	prefix := ""
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		prefix, key = key[:i+1], key[i+1:]
+	}
+	return prefix + sanitizeLabelValue(key)
+}
+
+// sanitizeLabelValue replaces the invalid characters with "-", and trims the value to the valid length and bounds
+func sanitizeLabelValue(value string) string {
+	value = invalidLabelChars.ReplaceAllString(value, "-")
+	if len(value) > validation.LabelValueMaxLength {
+		value = value[:validation.LabelValueMaxLength]
+	}
+	return strings.Trim(value, "-_.")
+}
@@ -0,0 +1,159 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// LocalitySourceDatacenter reads a locality level from the datacenter of an instance
+	LocalitySourceDatacenter = "datacenter"
+	// LocalitySourceLocality reads a locality level from the locality of an instance, which Consul supports since
+	// 1.17, only the region and the zone are available
+	LocalitySourceLocality = "locality"
+	// LocalitySourceNodeMeta reads a locality level from a node meta key, e.g. "node-meta:zone"
+	LocalitySourceNodeMeta = "node-meta"
+	// LocalitySourceServiceMeta reads a locality level from a service meta key, e.g. "service-meta:zone"
+	LocalitySourceServiceMeta = "service-meta"
+)
+
+// consulLocality is the locality of a Consul instance
+type consulLocality struct {
+	Region string
+	Zone   string
+}
+
+// instanceLocalities indexes the Consul localities of instances by the instance. The vendored Consul client doesn't
+// decode the locality, so it's carried next to the instances rather than in them.
+type instanceLocalities map[*api.CatalogService]*consulLocality
+
+// add records the locality of an instance, an empty locality isn't recorded
+func (l instanceLocalities) add(endpoint *api.CatalogService, locality *consulLocality) {
+	if locality != nil && (locality.Region != "" || locality.Zone != "") {
+		l[endpoint] = locality
+	}
+}
+
+// of returns the locality of an instance, or nil if it has none
+func (l instanceLocalities) of(endpoint *api.CatalogService) *consulLocality {
+	return l[endpoint]
+}
+
+// localitySource is where a locality level of an instance is read from
+type localitySource struct {
+	kind string
+	key  string
+}
+
+// localityOptions controls how the locality of a WorkloadEntry is built, the sources of each level are tried in
+// order and the first non-empty value is used
+type localityOptions struct {
+	region  []localitySource
+	zone    []localitySource
+	subzone []localitySource
+}
+
+func newLocalityOptions(args *BootStrapArgs) (localityOptions, error) {
+	var opts localityOptions
+	var err error
+	if opts.region, err = parseLocalitySources(args.LocalityRegion); err != nil {
+		return opts, fmt.Errorf("invalid locality region: %v", err)
+	}
+	if opts.zone, err = parseLocalitySources(args.LocalityZone); err != nil {
+		return opts, fmt.Errorf("invalid locality zone: %v", err)
+	}
+	if opts.subzone, err = parseLocalitySources(args.LocalitySubzone); err != nil {
+		return opts, fmt.Errorf("invalid locality subzone: %v", err)
+	}
+	return opts, nil
+}
+
+// parseLocalitySources parses the sources of a locality level in the "<kind>[:<key>]" format
+func parseLocalitySources(sources []string) ([]localitySource, error) {
+	out := make([]localitySource, 0, len(sources))
+	for _, source := range sources {
+		kind, key := source, ""
+		if i := strings.Index(source, ":"); i >= 0 {
+			kind, key = source[:i], source[i+1:]
+		}
+		switch kind {
+		case LocalitySourceDatacenter, LocalitySourceLocality:
+			if key != "" {
+				return nil, fmt.Errorf("source %s doesn't take a key", source)
+			}
+		case LocalitySourceNodeMeta, LocalitySourceServiceMeta:
+			if key == "" {
+				return nil, fmt.Errorf("source %s requires a key", source)
+			}
+		default:
+			return nil, fmt.Errorf("unknown source %s", source)
+		}
+		out = append(out, localitySource{kind: kind, key: key})
+	}
+	return out, nil
+}
+
+// locality returns the Istio locality "region/zone/subzone" of an instance whose Consul locality is consul. The
+// region defaults to the datacenter, and the levels after a missing one are left out since the locality is
+// hierarchical.
+func (o localityOptions) locality(endpoint *api.CatalogService, consul *consulLocality) string {
+	region := o.region
+	if len(region) == 0 {
+		region = []localitySource{{kind: LocalitySourceDatacenter}}
+	}
+	levels := make([]string, 0, 3)
+	for i, sources := range [][]localitySource{region, o.zone, o.subzone} {
+		value := localityLevel(endpoint, consul, sources, i)
+		if value == "" {
+			break
+		}
+		levels = append(levels, value)
+	}
+	return strings.Join(levels, "/")
+}
+
+// localityLevel reads a locality level of an instance, level is 0 for the region, 1 for the zone and 2 for the subzone
+func localityLevel(endpoint *api.CatalogService, consul *consulLocality, sources []localitySource, level int) string {
+	for _, source := range sources {
+		var value string
+		switch source.kind {
+		case LocalitySourceDatacenter:
+			value = endpoint.Datacenter
+		case LocalitySourceLocality:
+			if consul == nil {
+				break
+			}
+			switch level {
+			case 0:
+				value = consul.Region
+			case 1:
+				value = consul.Zone
+			}
+		case LocalitySourceNodeMeta:
+			value = endpoint.NodeMeta[source.key]
+		case LocalitySourceServiceMeta:
+			value = endpoint.ServiceMeta[source.key]
+		}
+		// "/" separates the levels, so it can't be a part of a level
+		if value = strings.ReplaceAll(strings.TrimSpace(value), "/", "-"); value != "" {
+			return value
+		}
+	}
+	return ""
+}
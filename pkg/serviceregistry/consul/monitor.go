@@ -15,6 +15,8 @@
 package consul
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
@@ -25,67 +27,461 @@ import (
 type Monitor interface {
 	Start(<-chan struct{})
 	AppendServiceChangeHandler(ServiceChangeHandler)
+	AppendOverrideChangeHandler(OverrideChangeHandler)
+	AppendProtocolChangeHandler(ProtocolChangeHandler)
 }
 
-// ServiceChangeHandler processes service change events
-// It's just a notification, we don't need to pass the changed services
-type ServiceChangeHandler func() error
+// ServiceKey identifies a Consul service in a namespace of an admin partition in a datacenter
+type ServiceKey struct {
+	// Datacenter is empty for the local datacenter of the Consul agent
+	Datacenter string
+	// Partition is empty if admin partitions are not synchronized
+	Partition string
+	// Namespace is empty if namespaces are not synchronized
+	Namespace string
+	Name      string
+}
+
+func (k ServiceKey) scope() scope {
+	return scope{Datacenter: k.Datacenter, Partition: k.Partition, Namespace: k.Namespace}
+}
+
+// serviceID identifies the service in the registry, the instances of a service in multiple datacenters are
+// identified as the same service
+func (k ServiceKey) serviceID() string {
+	if k.Partition == "" && k.Namespace == "" {
+		return k.Name
+	}
+	return enterpriseName(k.Partition) + "/" + enterpriseName(k.Namespace) + "/" + k.Name
+}
+
+// enterpriseName returns the name of a Consul Enterprise namespace or partition, empty stands for the default one
+func enterpriseName(name string) string {
+	if name == "" {
+		return defaultEnterpriseName
+	}
+	return name
+}
+
+// ServiceChangeHandler processes the change of a single service.
+// index is the Consul ModifyIndex of the service instances, and endpoints are the latest instances of the service,
+// endpoints is nil if the service has been removed from Consul or is not synchronized because of its kind. localities
+// are the Consul localities of the endpoints.
+type ServiceChangeHandler func(key ServiceKey, index uint64, endpoints []*api.CatalogService,
+	localities instanceLocalities) error
+
+// OverrideChangeHandler processes the change of the overrides in Consul KV, overrides are all the overrides keyed
+// by the IDs of the services
+type OverrideChangeHandler func(overrides map[string]*serviceOverride) error
+
+// ProtocolChangeHandler processes the change of the service-defaults and proxy-defaults config entries, defaults
+// are the protocols declared by all the config entries
+type ProtocolChangeHandler func(defaults *protocolDefaults) error
+
+// configEntrySource identifies the config entries of a kind in an admin partition
+type configEntrySource struct {
+	partition string
+	kind      string
+}
 
 type consulMonitor struct {
 	discovery             *api.Client
+	query                 instanceQuery
+	filter                *serviceFilter
+	scopes                scopeConfig
+	overridePrefix        string
+	configEntryProtocols  bool
 	ServiceChangeHandlers []ServiceChangeHandler
+	// OverrideChangeHandlers are notified when the overrides change
+	OverrideChangeHandlers []OverrideChangeHandler
+	// ProtocolChangeHandlers are notified when the config entries change
+	ProtocolChangeHandlers []ProtocolChangeHandler
+
+	// semaphore bounds the number of concurrent initial fetches of service instances, it's never held across a
+	// blocking query
+	semaphore chan struct{}
+	// mutex protects the watchers and serializes the calls to the handlers
+	mutex sync.Mutex
+	// scopeWatchers watch the service list of each scope
+	scopeWatchers map[scope]*watcher
+	// serviceWatchers watch the instances of each service
+	serviceWatchers map[ServiceKey]*watcher
+	// configWatchers watch the config entries of each admin partition
+	configWatchers map[string]*watcher
+	// configEntries are the latest config entries of each kind in each admin partition
+	configEntries map[configEntrySource][]configEntry
+}
+
+// watcher keeps a blocking query on a Consul resource until it's cancelled
+type watcher struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newWatcher(ctx context.Context) *watcher {
+	watcherCtx, cancel := context.WithCancel(ctx)
+	return &watcher{
+		ctx:    watcherCtx,
+		cancel: cancel,
+	}
 }
 
-const blockQueryWaitTime time.Duration = 10 * time.Minute
+const (
+	blockQueryWaitTime time.Duration = 10 * time.Minute
+
+	// scopeRefreshInterval is the interval to refresh the datacenters, partitions and namespaces when all of them
+	// are watched, Consul doesn't support blocking queries on the datacenter list
+	scopeRefreshInterval = time.Minute
+
+	// DefaultWatchConcurrency is the default number of concurrent initial fetches of service instances
+	DefaultWatchConcurrency = 64
+)
 
 // NewConsulMonitor watches for changes in Consul services and CatalogServices
-func NewConsulMonitor(client *api.Client) Monitor {
+func NewConsulMonitor(client *api.Client, args *BootStrapArgs) (Monitor, error) {
+	filter, err := newServiceFilter(args)
+	if err != nil {
+		return nil, err
+	}
+	concurrency := args.WatchConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultWatchConcurrency
+	}
 	return &consulMonitor{
 		discovery:             client,
+		query:                 newInstanceQuery(args),
+		filter:                filter,
+		scopes:                newScopeConfig(args),
+		overridePrefix:        args.OverridePrefix,
+		configEntryProtocols:  args.ConfigEntryProtocols,
 		ServiceChangeHandlers: make([]ServiceChangeHandler, 0),
-	}
+		semaphore:             make(chan struct{}, concurrency),
+		scopeWatchers:         make(map[scope]*watcher),
+		serviceWatchers:       make(map[ServiceKey]*watcher),
+		configWatchers:        make(map[string]*watcher),
+		configEntries:         make(map[configEntrySource][]configEntry),
+	}, nil
 }
 
 func (m *consulMonitor) Start(stop <-chan struct{}) {
-	go m.watchConsul(stop)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	go m.watchScopes(ctx)
+	if m.overridePrefix != "" {
+		go m.watchOverrides(ctx)
+	}
+}
+
+// watchScopes starts or stops the watchers of the scopes which consul2istio synchronizes
+func (m *consulMonitor) watchScopes(ctx context.Context) {
+	for {
+		scopes, err := resolveScopes(m.discovery, m.scopes)
+		if err != nil {
+			log.Warnf("Could not fetch datacenters, partitions or namespaces: %v", err)
+		} else {
+			m.updateScopeWatchers(ctx, scopes)
+		}
+
+		// The scopes never change unless all datacenters, partitions or namespaces are watched
+		if err == nil && !m.scopes.dynamic() {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(scopeRefreshInterval):
+		}
+	}
+}
+
+// watchOverrides keeps a blocking query on the overrides in Consul KV
+func (m *consulMonitor) watchOverrides(ctx context.Context) {
+	var consulWaitIndex uint64
+
+	for {
+		queryOptions := (&api.QueryOptions{
+			WaitIndex: consulWaitIndex,
+			WaitTime:  blockQueryWaitTime,
+		}).WithContext(ctx)
+		overrides, queryMeta, err := getServiceOverrides(m.discovery, m.overridePrefix, queryOptions)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warnf("Could not fetch overrides under %s: %v", m.overridePrefix, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if consulWaitIndex != queryMeta.LastIndex {
+			consulWaitIndex = queryMeta.LastIndex
+			m.mutex.Lock()
+			for _, handler := range m.OverrideChangeHandlers {
+				if err := handler(overrides); err != nil {
+					log.Warnf("Error executing override handler function: %v", err)
+				}
+			}
+			m.mutex.Unlock()
+		}
+	}
+}
+
+func (m *consulMonitor) updateScopeWatchers(ctx context.Context, scopes []scope) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	desired := make(map[scope]bool, len(scopes))
+	for _, s := range scopes {
+		desired[s] = true
+	}
+
+	for s, w := range m.scopeWatchers {
+		if !desired[s] {
+			log.Infof("Stop watching %v since it has been removed from consul", s)
+			w.cancel()
+			delete(m.scopeWatchers, s)
+			m.removeServiceWatchers(s, nil)
+		}
+	}
+
+	for s := range desired {
+		if _, ok := m.scopeWatchers[s]; !ok {
+			w := newWatcher(ctx)
+			m.scopeWatchers[s] = w
+			go m.watchConsul(w, s)
+		}
+	}
+
+	if m.configEntryProtocols {
+		m.updateConfigWatchers(ctx, desired)
+	}
+}
+
+// updateConfigWatchers starts or stops the watchers of the config entries in the admin partitions of the scopes,
+// the caller must hold the mutex
+func (m *consulMonitor) updateConfigWatchers(ctx context.Context, scopes map[scope]bool) {
+	partitions := make(map[string]bool)
+	for s := range scopes {
+		partitions[s.Partition] = true
+	}
+
+	removed := false
+	for partition, w := range m.configWatchers {
+		if !partitions[partition] {
+			w.cancel()
+			delete(m.configWatchers, partition)
+			for _, kind := range configEntryKinds {
+				delete(m.configEntries, configEntrySource{partition: partition, kind: kind})
+			}
+			removed = true
+		}
+	}
+	for partition := range partitions {
+		if _, ok := m.configWatchers[partition]; !ok {
+			w := newWatcher(ctx)
+			m.configWatchers[partition] = w
+			for _, kind := range configEntryKinds {
+				go m.watchConfigEntries(w, partition, kind)
+			}
+		}
+	}
+	if removed {
+		m.notifyProtocols()
+	}
+}
+
+// watchConfigEntries keeps a blocking query on the config entries of a kind in an admin partition
+func (m *consulMonitor) watchConfigEntries(w *watcher, partition, kind string) {
+	var consulWaitIndex uint64
+
+	for {
+		queryOptions := configEntryQueryOptions(w.ctx, m.scopes, partition)
+		queryOptions.WaitIndex = consulWaitIndex
+		queryOptions.WaitTime = blockQueryWaitTime
+		entries, queryMeta, err := getConfigEntries(m.discovery, kind, queryOptions)
+		if w.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warnf("Could not fetch %s config entries of partition %s: %v", kind, enterpriseName(partition), err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if consulWaitIndex != queryMeta.LastIndex {
+			consulWaitIndex = queryMeta.LastIndex
+			m.updateConfigEntries(w, configEntrySource{partition: partition, kind: kind}, entries)
+		}
+	}
+}
+
+func (m *consulMonitor) updateConfigEntries(w *watcher, source configEntrySource, entries []configEntry) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// The partition may have been removed while the query was in flight
+	if m.configWatchers[source.partition] != w {
+		return
+	}
+	m.configEntries[source] = entries
+	m.notifyProtocols()
+}
+
+// notifyProtocols calls the handlers with the protocols declared by all the config entries, the handlers are not
+// called until the config entries of every kind in every partition have been fetched, so that a partial result
+// doesn't flip the protocols of services back and forth. The caller must hold the mutex.
+func (m *consulMonitor) notifyProtocols() {
+	if len(m.configEntries) < len(m.configWatchers)*len(configEntryKinds) {
+		return
+	}
+	entries := make([]configEntry, 0)
+	for _, sourceEntries := range m.configEntries {
+		entries = append(entries, sourceEntries...)
+	}
+	defaults := newProtocolDefaults(entries)
+	for _, handler := range m.ProtocolChangeHandlers {
+		if err := handler(defaults); err != nil {
+			log.Warnf("Error executing protocol handler function: %v", err)
+		}
+	}
 }
 
-func (m *consulMonitor) watchConsul(stop <-chan struct{}) {
+// watchConsul watches the service list of a scope, and starts or stops the watchers of individual services
+func (m *consulMonitor) watchConsul(w *watcher, s scope) {
 	var consulWaitIndex uint64
 
 	for {
 		select {
-		case <-stop:
+		case <-w.ctx.Done():
 			return
 		default:
-			queryOptions := api.QueryOptions{
-				WaitIndex: consulWaitIndex,
-				WaitTime:  blockQueryWaitTime,
-			}
+			queryOptions := s.queryOptions(w.ctx)
+			queryOptions.WaitIndex = consulWaitIndex
+			queryOptions.WaitTime = blockQueryWaitTime
 			// This Consul REST API will block until service changes or timeout
 			// https://www.consul.io/api/features/blocking
-			_, queryMeta, err := m.discovery.Catalog().Services(&queryOptions)
+			services, queryMeta, err := m.discovery.Catalog().Services(queryOptions)
 			if err != nil {
-				log.Warnf("Could not fetch services: %v", err)
-				time.Sleep(time.Second)
+				if w.ctx.Err() == nil {
+					log.Warnf("Could not fetch services of %v: %v", s, err)
+					time.Sleep(time.Second)
+				}
 			} else if consulWaitIndex != queryMeta.LastIndex {
 				consulWaitIndex = queryMeta.LastIndex
-				m.updateServiceRecord()
+				m.updateServiceWatchers(w, s, services)
 			}
 		}
 	}
 }
 
-func (m *consulMonitor) updateServiceRecord() {
-	for _, f := range m.ServiceChangeHandlers {
-		go func(handler ServiceChangeHandler) {
-			if err := handler(); err != nil {
-				log.Warnf("Error executing service handler function: %v", err)
+func (m *consulMonitor) updateServiceWatchers(scopeWatcher *watcher, s scope, services map[string][]string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// The scope may have been removed while the query was in flight
+	if m.scopeWatchers[s] != scopeWatcher {
+		return
+	}
+
+	// The services which stop matching the filter are removed like the ones removed from Consul
+	services = m.filter.filter(services)
+	m.removeServiceWatchers(s, services)
+	for name := range services {
+		key := ServiceKey{Datacenter: s.Datacenter, Partition: s.Partition, Namespace: s.Namespace, Name: name}
+		if _, ok := m.serviceWatchers[key]; !ok {
+			w := newWatcher(scopeWatcher.ctx)
+			m.serviceWatchers[key] = w
+			go m.watchService(w, key)
+		}
+	}
+}
+
+// removeServiceWatchers stops watching the services of a scope which are not in the service list,
+// the caller must hold the mutex
+func (m *consulMonitor) removeServiceWatchers(s scope, services map[string][]string) {
+	for key, w := range m.serviceWatchers {
+		if key.scope() != s {
+			continue
+		}
+		if _, ok := services[key.Name]; !ok {
+			log.Infof("Stop watching service %s of %v since it has been removed from consul", key.Name, s)
+			w.cancel()
+			delete(m.serviceWatchers, key)
+			m.notify(key, 0, nil, nil)
+		}
+	}
+}
+
+// watchService keeps a blocking query on the instances of a service, so the changes of the instances are detected
+// even if they don't change the service list. Only the fetches which return immediately take a slot of the
+// semaphore, so the idle blocking queries never hold up the watchers of the other services.
+func (m *consulMonitor) watchService(w *watcher, key ServiceKey) {
+	var consulWaitIndex uint64
+
+	for {
+		blocking := consulWaitIndex != 0
+		if !blocking {
+			select {
+			case <-w.ctx.Done():
+				return
+			case m.semaphore <- struct{}{}:
 			}
-		}(f)
+		}
+
+		queryOptions := key.scope().queryOptions(w.ctx)
+		queryOptions.WaitIndex = consulWaitIndex
+		queryOptions.WaitTime = blockQueryWaitTime
+		endpoints, localities, queryMeta, err := getServiceInstances(m.discovery, m.query, key.Name, queryOptions)
+		if !blocking {
+			<-m.semaphore
+		}
+
+		if w.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warnf("Could not fetch instances of service %s of %v: %v", key.Name, key.scope(), err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if consulWaitIndex != queryMeta.LastIndex {
+			consulWaitIndex = queryMeta.LastIndex
+			m.updateServiceRecord(w, key, queryMeta.LastIndex, endpoints, localities)
+		}
+	}
+}
+
+func (m *consulMonitor) updateServiceRecord(w *watcher, key ServiceKey, index uint64,
+	endpoints []*api.CatalogService, localities instanceLocalities) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// The service may have been removed while the query was in flight
+	if m.serviceWatchers[key] != w {
+		return
+	}
+	m.notify(key, index, endpoints, localities)
+}
+
+// notify calls the handlers in the order they are appended, the caller must hold the mutex
+func (m *consulMonitor) notify(key ServiceKey, index uint64, endpoints []*api.CatalogService,
+	localities instanceLocalities) {
+	for _, handler := range m.ServiceChangeHandlers {
+		if err := handler(key, index, endpoints, localities); err != nil {
+			log.Warnf("Error executing service handler function: %v", err)
+		}
 	}
 }
 
 func (m *consulMonitor) AppendServiceChangeHandler(h ServiceChangeHandler) {
 	m.ServiceChangeHandlers = append(m.ServiceChangeHandlers, h)
 }
+
+func (m *consulMonitor) AppendOverrideChangeHandler(h OverrideChangeHandler) {
+	m.OverrideChangeHandlers = append(m.OverrideChangeHandlers, h)
+}
+
+func (m *consulMonitor) AppendProtocolChangeHandler(h ProtocolChangeHandler) {
+	m.ProtocolChangeHandlers = append(m.ProtocolChangeHandlers, h)
+}
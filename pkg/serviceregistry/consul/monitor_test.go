@@ -23,6 +23,11 @@ import (
 
 const notifyThreshold = 2 * time.Second
 
+type serviceNotification struct {
+	service   string
+	endpoints []*api.CatalogService
+}
+
 func TestController(t *testing.T) {
 	ts := newServer()
 	defer ts.server.Close()
@@ -34,11 +39,15 @@ func TestController(t *testing.T) {
 		t.Errorf("could not create Consul Controller: %v", err)
 	}
 
-	updateChannel := make(chan struct{}, 10)
+	updateChannel := make(chan serviceNotification, 10)
 
-	ctl := NewConsulMonitor(cl)
-	ctl.AppendServiceChangeHandler(func() error {
-		updateChannel <- struct{}{}
+	ctl, err := NewConsulMonitor(cl, newTestArgs(ts.server.URL))
+	if err != nil {
+		t.Fatalf("could not create Consul Monitor: %v", err)
+	}
+	ctl.AppendServiceChangeHandler(func(key ServiceKey, index uint64, endpoints []*api.CatalogService,
+		_ instanceLocalities) error {
+		updateChannel <- serviceNotification{service: key.Name, endpoints: endpoints}
 		return nil
 	})
 
@@ -46,11 +55,16 @@ func TestController(t *testing.T) {
 	go ctl.Start(stop)
 	defer close(stop)
 
-	expectNotify := func(t *testing.T, times int) {
+	expectNotify := func(t *testing.T, times int) map[string]serviceNotification {
 		t.Helper()
+		notifications := make(map[string]serviceNotification)
 		for i := 0; i <= times; i++ {
 			select {
-			case <-updateChannel:
+			case n := <-updateChannel:
+				if i == times {
+					t.Fatalf("got more than %d notifications from controller, extra one for %s", times, n.service)
+				}
+				notifications[n.service] = n
 				continue
 			case <-time.After(notifyThreshold):
 				if i != times {
@@ -58,17 +72,118 @@ func TestController(t *testing.T) {
 				}
 			}
 		}
+		return notifications
 	}
 
-	//The first query from monitor to Consul always doesn't block because the index is 0
-	expectNotify(t, 1)
+	//The first query of each service always doesn't block because the index is 0
+	notifications := expectNotify(t, 3)
+	if len(notifications["reviews"].endpoints) != 3 {
+		t.Errorf("got %d endpoints of reviews, want 3", len(notifications["reviews"].endpoints))
+	}
 
 	//There won't be any notifications if X-Consul-Index doesn't change
 	expectNotify(t, 0)
 
-	//X-Consul-Index change means that the Consul Catalog changes, so there will be notifications
+	//X-Consul-Index change means that the Consul Catalog changes, so there will be notifications for all services
+	ts.lock.Lock()
+	ts.consulIndex++
+	ts.lock.Unlock()
+	expectNotify(t, 3)
+
+	//Instance changes of a service only notify that service, even if the service list doesn't change
+	ts.lock.Lock()
+	ts.serviceIndex["reviews"]++
+	ts.lock.Unlock()
+	notifications = expectNotify(t, 1)
+	if _, ok := notifications["reviews"]; !ok {
+		t.Errorf("got notifications %v, want reviews", notifications)
+	}
+
+	//Removing a service from the service list notifies the service with nil endpoints
 	ts.lock.Lock()
+	delete(ts.services, "rating")
+	ts.servicesIndex++
+	ts.lock.Unlock()
+	notifications = expectNotify(t, 1)
+	if n, ok := notifications["rating"]; !ok || n.endpoints != nil {
+		t.Errorf("got notifications %v, want rating removed", notifications)
+	}
+
+	//A service which stops matching the filter is notified like a removed one
+	ts.lock.Lock()
+	ts.services["reviews"] = append(ts.services["reviews"], IgnoreTag)
+	ts.servicesIndex++
+	ts.lock.Unlock()
+	notifications = expectNotify(t, 1)
+	if n, ok := notifications["reviews"]; !ok || n.endpoints != nil {
+		t.Errorf("got notifications %v, want reviews removed", notifications)
+	}
+}
+
+func TestMonitorConfigEntries(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+	ts.configEntries[api.ServiceDefaults] = []configEntry{
+		{Kind: api.ServiceDefaults, Name: "reviews", Protocol: "http"},
+	}
+	ts.configEntries[api.ProxyDefaults] = []configEntry{
+		{Kind: api.ProxyDefaults, Name: api.ProxyConfigGlobal, Config: map[string]interface{}{"protocol": "grpc"}},
+	}
+	conf := api.DefaultConfig()
+	conf.Address = ts.server.URL
+	cl, err := api.NewClient(conf)
+	if err != nil {
+		t.Fatalf("could not create Consul client: %v", err)
+	}
+
+	args := newTestArgs(ts.server.URL)
+	args.ConfigEntryProtocols = true
+	monitor, err := NewConsulMonitor(cl, args)
+	if err != nil {
+		t.Fatalf("could not create Consul Monitor: %v", err)
+	}
+	updateChannel := make(chan *protocolDefaults, 10)
+	monitor.AppendProtocolChangeHandler(func(defaults *protocolDefaults) error {
+		updateChannel <- defaults
+		return nil
+	})
+
+	stop := make(chan struct{})
+	go monitor.Start(stop)
+	defer close(stop)
+
+	// Both watchers notify the handlers when the index changes, so the notifications before the last one may not
+	// include the change yet
+	expectProtocols := func(t *testing.T, reviews, rating string) {
+		t.Helper()
+		for {
+			select {
+			case defaults := <-updateChannel:
+				if defaults.protocol(ServiceKey{Name: "reviews"}) == reviews &&
+					defaults.protocol(ServiceKey{Name: "rating"}) == rating {
+					return
+				}
+			case <-time.After(notifyThreshold):
+				t.Fatalf("got no notification of protocols %q of reviews and %q of rating", reviews, rating)
+			}
+		}
+	}
+
+	// The handlers are not notified until the config entries of both kinds have been fetched
+	select {
+	case defaults := <-updateChannel:
+		if got := defaults.protocol(ServiceKey{Name: "rating"}); got != "grpc" {
+			t.Errorf("protocol of rating => %q in the first notification, want grpc", got)
+		}
+	case <-time.After(notifyThreshold):
+		t.Fatalf("got no notification of the config entries")
+	}
+
+	ts.lock.Lock()
+	ts.configEntries[api.ProxyDefaults] = []configEntry{
+		{Kind: api.ProxyDefaults, Name: api.ProxyConfigGlobal, Config: map[string]interface{}{"protocol": "http2"}},
+	}
 	ts.consulIndex++
 	ts.lock.Unlock()
-	expectNotify(t, 1)
+	expectProtocols(t, "http", "http2")
 }
@@ -14,15 +14,169 @@
 
 package consul
 
+import (
+	"fmt"
+	"time"
+)
+
+// redactedValue replaces the secrets when the arguments are printed
+const redactedValue = "<redacted>"
+
+const (
+	// WarningPolicyInclude keeps instances with warning health checks in the ServiceEntry, as Consul DNS does
+	WarningPolicyInclude = "include"
+	// WarningPolicyExclude drops instances with warning health checks from the ServiceEntry
+	WarningPolicyExclude = "exclude"
+)
+
 // BootStrapArgs is a struct for passing arguments to the consul
 type BootStrapArgs struct {
-	ConsulAddress     string
+	ConsulAddress string
+	// Token is the ACL token of Consul
+	Token string
+	// TokenFile is the file containing the ACL token of Consul, it's reloaded when it changes
+	TokenFile string
+	// CAFile is the CA bundle to verify the certificate of Consul, it's reloaded when it changes
+	CAFile string
+	// CertFile and KeyFile are the client certificate and key for mTLS with Consul, they're reloaded when they change
+	CertFile string
+	KeyFile  string
+	// TLSServerName is the server name to verify the certificate of Consul
+	TLSServerName string
+	// InsecureSkipVerify disables the verification of the certificate of Consul
+	InsecureSkipVerify bool
+	// HTTPAuth is the HTTP basic auth of Consul in the "username[:password]" format
+	HTTPAuth          string
 	Namespace         string
 	FQDN              string
 	EnableDefaultPort bool
+	// EnableHealthCheck sources service instances from the Consul health API instead of the catalog,
+	// instances with critical health checks are dropped
+	EnableHealthCheck bool
+	// WarningPolicy decides how instances with warning health checks are treated when EnableHealthCheck is set
+	WarningPolicy string
+	// WatchConcurrency bounds the number of concurrent initial fetches of service instances, the blocking queries
+	// which follow them are not bounded
+	WatchConcurrency int
+	// Datacenters are the Consul datacenters to synchronize, "*" for all datacenters,
+	// only the local datacenter of the Consul agent is synchronized if it's empty
+	Datacenters []string
+	// DatacenterMode decides whether the instances of a service in multiple datacenters are merged into
+	// one ServiceEntry, or split into a ServiceEntry with a per-datacenter hostname for each datacenter
+	DatacenterMode string
+	// ConsulPartitions are the admin partitions of Consul Enterprise to synchronize, "*" for all partitions,
+	// partitions are not synchronized if it's empty
+	ConsulPartitions []string
+	// ConsulNamespaces are the namespaces of Consul Enterprise to synchronize, "*" for all namespaces,
+	// namespaces are not synchronized if it's empty
+	ConsulNamespaces []string
+	// TagSeparators separate the keys and values of the tags which are converted to labels, default to "|"
+	TagSeparators []string
+	// TagPrefixes select the tags converted to labels by their prefixes, all the tags are converted if it's empty
+	TagPrefixes []string
+	// StripTagPrefix removes the matched prefix of TagPrefixes from the label keys
+	StripTagPrefix bool
+	// MetaLabels are the service meta keys copied to labels, "*" for all the keys
+	MetaLabels []string
+	// NodeMetaLabels are the node meta keys copied to labels, "*" for all the keys
+	NodeMetaLabels []string
+	// HostTemplates are the Go templates of the hosts of a ServiceEntry, the first one produces the primary host
+	HostTemplates []string
+	// LocalityRegion, LocalityZone and LocalitySubzone are the sources of the locality levels of the instances in
+	// the "<source>[:<key>]" format, the first non-empty one is used. The region defaults to the datacenter.
+	LocalityRegion  []string
+	LocalityZone    []string
+	LocalitySubzone []string
+	// AddressPreference are the address types of the instances in the order of preference: the tagged addresses
+	// like lan_ipv4, wan or lan_ipv6, service or node. It defaults to the service address, then the node address.
+	AddressPreference []string
+	// HostnameResolution is the resolution of the ServiceEntries of the instances with hostname addresses,
+	// DNS or DNS_ROUND_ROBIN
+	HostnameResolution string
+	// OverridePrefix is the Consul KV prefix of the per-service overrides, "<prefix>/<service>" holds the override
+	// of a service. The overrides are disabled if it's empty.
+	OverridePrefix string
+	// TagHosts are the tags which get an additional ServiceEntry on "<tag>.<host>" of the instances with the tag
+	TagHosts []string
+	// IncludeServices is the regular expression of the names of the services to synchronize
+	IncludeServices string
+	// ExcludeServices is the regular expression of the names of the services not to synchronize
+	ExcludeServices string
+	// RequiredTags are the tags a service must have to be synchronized
+	RequiredTags []string
+	// RequiredMeta is the meta in the "key[=value]" format an instance must have to be synchronized
+	RequiredMeta []string
+	// Filter is the Consul filter expression of the instances to synchronize, it's evaluated by Consul
+	Filter string
+	// SyncGateways synchronizes the mesh, terminating and ingress gateways of Consul Connect as services,
+	// they are skipped by default like the sidecar proxies
+	SyncGateways bool
+	// ConnectSidecar points the endpoints of the instances with a Connect sidecar proxy to the sidecar,
+	// so that the traffic flows through the Consul service mesh
+	ConnectSidecar bool
+	// NamespaceMode decides whether the Consul namespace of a service is included in the hostname of its
+	// ServiceEntry, or used as the Kubernetes namespace of the ServiceEntry
+	NamespaceMode string
+	// ConfigEntryProtocols reads the protocols of services from the service-defaults and proxy-defaults config
+	// entries, which apply to the instances without a "protocol" meta
+	ConfigEntryProtocols bool
+	// SyncPreparedQueries converts the prepared queries of the local datacenter to ServiceEntries
+	SyncPreparedQueries bool
+	// PreparedQueryDomain is the domain of the hosts of the prepared queries, "<query>.<domain>"
+	PreparedQueryDomain string
+	// PreparedQueryInterval is the interval to execute the prepared queries if the catalog doesn't change
+	PreparedQueryInterval time.Duration
+	// SyncDiscoveryChains converts the service-resolver, service-splitter and service-router config entries to
+	// DestinationRules and VirtualServices
+	SyncDiscoveryChains bool
+	// SyncFailover converts the failovers of the service-resolvers and prepared queries to the locality failover
+	// between datacenters in DestinationRules
+	SyncFailover bool
+	// WorkloadEntries pushes a WorkloadEntry for each instance and a ServiceEntry with a workloadSelector instead of
+	// a ServiceEntry with all the instances as its endpoints
+	WorkloadEntries bool
+	// ExportServices registers the Kubernetes services in the Consul catalog under the synthetic node ExportNode
+	ExportServices bool
+	// ExportNode is the name of the synthetic Consul node of the exported Kubernetes services
+	ExportNode string
+	// ExportNamespaces are the Kubernetes namespaces whose services are exported, all the namespaces but kube-system
+	// if it's empty
+	ExportNamespaces []string
+	// SyncIntentions converts the intentions of Consul Connect to AuthorizationPolicies on the workloads selected by
+	// IntentionSelectorLabel
+	SyncIntentions bool
+	// IntentionsDryRun logs the AuthorizationPolicies converted from the intentions instead of pushing them
+	IntentionsDryRun bool
+	// IntentionDefaultAction is the action on the requests which match no intention, allow or deny like the default
+	// ACL policy of Consul
+	IntentionDefaultAction string
+	// IntentionSelectorLabel is the label whose value is the name of the Consul service of a workload
+	IntentionSelectorLabel string
 }
 
 // NewConsulBootStrapArgs constructs consulArgs with default value.
 func NewConsulBootStrapArgs() *BootStrapArgs {
-	return &BootStrapArgs{}
+	return &BootStrapArgs{
+		WarningPolicy:          WarningPolicyInclude,
+		WatchConcurrency:       DefaultWatchConcurrency,
+		DatacenterMode:         DatacenterModeMerge,
+		NamespaceMode:          NamespaceModeHostname,
+		PreparedQueryDomain:    DefaultPreparedQueryDomain,
+		PreparedQueryInterval:  DefaultPreparedQueryInterval,
+		IntentionDefaultAction: IntentionActionDeny,
+		IntentionSelectorLabel: DefaultIntentionSelectorLabel,
+		ExportNode:             DefaultExportNode,
+	}
+}
+
+// String prints the arguments with the secrets redacted
+func (a *BootStrapArgs) String() string {
+	redacted := *a
+	if redacted.Token != "" {
+		redacted.Token = redactedValue
+	}
+	if redacted.HTTPAuth != "" {
+		redacted.HTTPAuth = redactedValue
+	}
+	return fmt.Sprintf("%+v", redacted)
 }
@@ -0,0 +1,143 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	istio "istio.io/api/networking/v1alpha3"
+	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// serviceOverride tunes how a Consul service is converted, it's stored in Consul KV under
+// "<prefix>/<service>" as JSON, e.g.
+//
+//	{
+//	  "protocols": {"8080": "http", "grpc-api": "grpc"},
+//	  "location": "MESH_EXTERNAL",
+//	  "resolution": "DNS",
+//	  "exportTo": ["."],
+//	  "hosts": ["payment.example.com"],
+//	  "namespace": "payment"
+//	}
+type serviceOverride struct {
+	// Protocols are the protocols of the ports keyed by the port numbers or names
+	Protocols map[string]string `json:"protocols,omitempty"`
+	// Location is the location of the ServiceEntries, MESH_INTERNAL or MESH_EXTERNAL
+	Location string `json:"location,omitempty"`
+	// Resolution is the resolution of the ServiceEntries, e.g. STATIC or DNS
+	Resolution string `json:"resolution,omitempty"`
+	// ExportTo are the namespaces which the ServiceEntries are exported to
+	ExportTo []string `json:"exportTo,omitempty"`
+	// Hosts are the extra hosts of the ServiceEntry on the hostname of the service
+	Hosts []string `json:"hosts,omitempty"`
+	// Namespace is the Kubernetes namespace of the ServiceEntries
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// parseServiceOverride parses and validates the JSON of an override
+func parseServiceOverride(value []byte) (*serviceOverride, error) {
+	override := &serviceOverride{}
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(override); err != nil {
+		return nil, err
+	}
+	if _, ok := istio.ServiceEntry_Location_value[override.Location]; override.Location != "" && !ok {
+		return nil, fmt.Errorf("unknown location %s", override.Location)
+	}
+	if _, ok := istio.ServiceEntry_Resolution_value[override.Resolution]; override.Resolution != "" && !ok {
+		return nil, fmt.Errorf("unknown resolution %s", override.Resolution)
+	}
+	for _, host := range override.Hosts {
+		if errs := validation.IsDNS1123Subdomain(strings.TrimPrefix(host, "*.")); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid host %s: %s", host, strings.Join(errs, "; "))
+		}
+	}
+	if override.Namespace != "" {
+		if errs := validation.IsDNS1123Label(override.Namespace); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid namespace %s: %s", override.Namespace, strings.Join(errs, "; "))
+		}
+	}
+	return override, nil
+}
+
+// getServiceOverrides lists the overrides under a KV prefix keyed by the IDs of the services, the invalid ones
+// are logged and skipped
+func getServiceOverrides(client *api.Client, prefix string,
+	q *api.QueryOptions) (map[string]*serviceOverride, *api.QueryMeta, error) {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	pairs, queryMeta, err := client.KV().List(prefix, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	overrides := make(map[string]*serviceOverride, len(pairs))
+	for _, pair := range pairs {
+		id := strings.TrimPrefix(pair.Key, prefix)
+		// Folders end with "/" and have no value
+		if id == "" || strings.HasSuffix(id, "/") {
+			continue
+		}
+		override, err := parseServiceOverride(pair.Value)
+		if err != nil {
+			log.Warnf("Override %s is ignored since it's invalid: %v", pair.Key, err)
+			continue
+		}
+		overrides[id] = override
+	}
+	return overrides, queryMeta, nil
+}
+
+// apply applies the override to the ServiceEntries of a service, the extra hosts are only added to the first
+// ServiceEntry, which is on the hostname of the service
+func (o *serviceOverride) apply(serviceEntries []*convertedServiceEntry) {
+	if o == nil {
+		return
+	}
+	for i, serviceEntry := range serviceEntries {
+		spec := serviceEntry.spec
+		for _, port := range spec.Ports {
+			name, ok := o.Protocols[strconv.Itoa(int(port.Number))]
+			if !ok {
+				name, ok = o.Protocols[port.Name]
+			}
+			if ok {
+				port.Protocol = convertProtocol(name)
+			}
+		}
+		if o.Location != "" {
+			spec.Location = istio.ServiceEntry_Location(istio.ServiceEntry_Location_value[o.Location])
+		}
+		if o.Resolution != "" {
+			spec.Resolution = istio.ServiceEntry_Resolution(istio.ServiceEntry_Resolution_value[o.Resolution])
+		}
+		if len(o.ExportTo) > 0 {
+			spec.ExportTo = o.ExportTo
+		}
+		if i == 0 {
+			for _, host := range o.Hosts {
+				if !contains(spec.Hosts, host) {
+					spec.Hosts = append(spec.Hosts, host)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,410 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	istio "istio.io/api/networking/v1alpha3"
+	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry"
+)
+
+const (
+	// DefaultPreparedQueryDomain is the default domain of the hosts of prepared queries, like Consul DNS
+	DefaultPreparedQueryDomain = "query.consul"
+	// DefaultPreparedQueryInterval is the default interval to execute the prepared queries if the catalog
+	// doesn't change
+	DefaultPreparedQueryInterval = 30 * time.Second
+
+	// preparedQueryPrefix prefixes the names of the prepared queries in the registry, so they never collide with
+	// the names of Consul services
+	preparedQueryPrefix = "query/"
+)
+
+// PreparedQueryController converts Consul prepared queries to ServiceEntries whose endpoints are the results of the
+// queries. The queries are executed in the local datacenter, periodically and whenever the catalog changes.
+type PreparedQueryController struct {
+	client   *api.Client
+	options  *convertOptions
+	domain   string
+	interval time.Duration
+	// failover adds the instances in the failover datacenters of the prepared queries to their ServiceEntries,
+	// and fails over between the datacenters with DestinationRules
+	failover bool
+	// localDatacenter is the datacenter the prepared queries are executed in, it's looked up for the failover
+	localDatacenter string
+	// queries are the ServiceEntries of each prepared query, keyed by the name of the query in the registry
+	queries map[string][]*serviceregistry.ServiceEntryWrapper
+	// rules are the DestinationRules of the prepared queries which fail over, keyed like queries
+	rules    map[string]*serviceregistry.ConfigWrapper
+	initDone bool
+	// serviceChangeHandlers are notified after the cache has been refreshed
+	serviceChangeHandlers []func(event serviceregistry.ServiceEvent)
+	// configChangeHandlers are notified after the DestinationRules have changed
+	configChangeHandlers []func()
+	cacheMutex           sync.Mutex
+}
+
+// NewPreparedQueryController creates a controller of Consul prepared queries
+func NewPreparedQueryController(args *BootStrapArgs) (*PreparedQueryController, error) {
+	client, err := newConsulClient(args)
+	if err != nil {
+		return nil, err
+	}
+	options, err := newConvertOptions(args)
+	if err != nil {
+		return nil, err
+	}
+	domain := strings.Trim(args.PreparedQueryDomain, ".")
+	if domain == "" {
+		domain = DefaultPreparedQueryDomain
+	}
+	interval := args.PreparedQueryInterval
+	if interval <= 0 {
+		interval = DefaultPreparedQueryInterval
+	}
+	return &PreparedQueryController{
+		client:   client,
+		options:  options,
+		domain:   domain,
+		interval: interval,
+		failover: args.SyncFailover,
+		queries:  make(map[string][]*serviceregistry.ServiceEntryWrapper),
+		rules:    make(map[string]*serviceregistry.ConfigWrapper),
+	}, nil
+}
+
+// Run until a stop signal is received
+func (c *PreparedQueryController) Run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	go c.watch(ctx)
+}
+
+// watch executes the prepared queries whenever the catalog changes, the blocking query on the catalog times out
+// after the interval so the queries are executed periodically even if the catalog doesn't change
+func (c *PreparedQueryController) watch(ctx context.Context) {
+	var consulWaitIndex uint64
+	for {
+		queryOptions := (&api.QueryOptions{
+			WaitIndex: consulWaitIndex,
+			WaitTime:  c.interval,
+		}).WithContext(ctx)
+		_, queryMeta, err := c.client.Catalog().Services(queryOptions)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warnf("Could not fetch services to watch the catalog: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		consulWaitIndex = queryMeta.LastIndex
+		c.refresh()
+	}
+}
+
+// ServiceEntries lists the ServiceEntries of all the prepared queries
+func (c *PreparedQueryController) ServiceEntries() ([]*serviceregistry.ServiceEntryWrapper, error) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	if err := c.initCache(); err != nil {
+		return nil, err
+	}
+	serviceEntries := make([]*serviceregistry.ServiceEntryWrapper, 0, len(c.queries))
+	for _, queryServiceEntries := range c.queries {
+		serviceEntries = append(serviceEntries, queryServiceEntries...)
+	}
+	return serviceEntries, nil
+}
+
+// ServiceEntriesOf lists the ServiceEntries of a prepared query, it's empty if the service is not a prepared query
+func (c *PreparedQueryController) ServiceEntriesOf(service string) ([]*serviceregistry.ServiceEntryWrapper, error) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	if err := c.initCache(); err != nil {
+		return nil, err
+	}
+	serviceEntries, ok := c.queries[service]
+	if !ok {
+		return []*serviceregistry.ServiceEntryWrapper{}, nil
+	}
+	return serviceEntries, nil
+}
+
+// AppendServiceChangeHandler implements a service catalog operation
+func (c *PreparedQueryController) AppendServiceChangeHandler(
+	serviceChanged func(event serviceregistry.ServiceEvent)) {
+	c.serviceChangeHandlers = append(c.serviceChangeHandlers, serviceChanged)
+}
+
+// Configs lists the DestinationRules of the prepared queries which fail over
+func (c *PreparedQueryController) Configs() ([]*serviceregistry.ConfigWrapper, error) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	if err := c.initCache(); err != nil {
+		return nil, err
+	}
+	return sortedRules(c.rules), nil
+}
+
+// Kinds implements a config store operation, the DestinationRules are only managed with the failover
+func (c *PreparedQueryController) Kinds() []string {
+	if !c.failover {
+		return nil
+	}
+	return []string{"DestinationRule"}
+}
+
+// AppendConfigChangeHandler implements a config store operation
+func (c *PreparedQueryController) AppendConfigChangeHandler(configChanged func()) {
+	c.configChangeHandlers = append(c.configChangeHandlers, configChanged)
+}
+
+// initCache executes all the prepared queries if the cache hasn't been populated by the watch yet,
+// the caller must hold the mutex
+func (c *PreparedQueryController) initCache() error {
+	if c.initDone {
+		return nil
+	}
+	queries, rules, err := c.executeQueries(c.queries, c.rules)
+	if err != nil {
+		return err
+	}
+	c.queries = queries
+	c.rules = rules
+	c.initDone = true
+	return nil
+}
+
+// refresh executes all the prepared queries, and notifies the handlers of the queries whose ServiceEntries have
+// changed, and the config handlers if the DestinationRules have changed
+func (c *PreparedQueryController) refresh() {
+	c.cacheMutex.Lock()
+	queries, rules, err := c.executeQueries(c.queries, c.rules)
+	if err != nil {
+		c.cacheMutex.Unlock()
+		log.Warnf("Could not execute prepared queries: %v", err)
+		return
+	}
+	events := make([]serviceregistry.ServiceEvent, 0)
+	for name, serviceEntries := range queries {
+		old, exists := c.queries[name]
+		if !exists {
+			events = append(events, serviceregistry.ServiceEvent{Type: serviceregistry.EventAdd, Service: name})
+		} else if !serviceEntriesEqual(old, serviceEntries) {
+			events = append(events, serviceregistry.ServiceEvent{Type: serviceregistry.EventUpdate, Service: name})
+		}
+	}
+	for name := range c.queries {
+		if _, exists := queries[name]; !exists {
+			events = append(events, serviceregistry.ServiceEvent{Type: serviceregistry.EventDelete, Service: name})
+		}
+	}
+	rulesChanged := !serviceregistry.ConfigsEqual(sortedRules(c.rules), sortedRules(rules))
+	c.queries = queries
+	c.rules = rules
+	c.initDone = true
+	c.cacheMutex.Unlock()
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Service < events[j].Service
+	})
+	for _, event := range events {
+		log.Debugf("Prepared query %s changed: %s", event.Service, event.Type)
+		for _, handler := range c.serviceChangeHandlers {
+			handler(event)
+		}
+	}
+	if rulesChanged {
+		log.Debugf("DestinationRules of prepared queries changed")
+		for _, handler := range c.configChangeHandlers {
+			handler()
+		}
+	}
+}
+
+// executeQueries lists and executes the prepared queries. A query which fails to execute keeps its ServiceEntries
+// in old and its DestinationRule in oldRules, so that a transient error doesn't remove it from the mesh.
+func (c *PreparedQueryController) executeQueries(old map[string][]*serviceregistry.ServiceEntryWrapper,
+	oldRules map[string]*serviceregistry.ConfigWrapper) (map[string][]*serviceregistry.ServiceEntryWrapper,
+	map[string]*serviceregistry.ConfigWrapper, error) {
+	definitions, _, err := c.client.PreparedQuery().List(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	queries := make(map[string][]*serviceregistry.ServiceEntryWrapper, len(definitions))
+	rules := make(map[string]*serviceregistry.ConfigWrapper)
+	for _, definition := range definitions {
+		// A template matches the names by prefix or regular expression, there's no single host to convert it to
+		if definition.Template.Type != "" {
+			log.Debugf("Prepared query template %s is skipped", definition.Name)
+			continue
+		}
+		queryName := definition.Name
+		if queryName == "" {
+			queryName = definition.ID
+		}
+		host := fmt.Sprintf("%s.%s", strings.ToLower(queryName), c.domain)
+		if errs := validation.IsDNS1123Subdomain(host); len(errs) > 0 {
+			log.Warnf("Prepared query %s is skipped since its host %s is invalid: %s", queryName, host,
+				strings.Join(errs, "; "))
+			continue
+		}
+
+		name := preparedQueryPrefix + queryName
+		response, _, err := c.client.PreparedQuery().Execute(definition.ID, nil)
+		if err != nil {
+			log.Warnf("Could not execute prepared query %s: %v", queryName, err)
+			if serviceEntries, ok := old[name]; ok {
+				queries[name] = serviceEntries
+			}
+			if rule, ok := oldRules[name]; ok {
+				rules[name] = rule
+			}
+			continue
+		}
+		if c.failover && len(definition.Service.Failover.Datacenters) > 0 {
+			rule, err := c.failoverQuery(definition, name, host, response)
+			if err != nil {
+				log.Warnf("Failover of prepared query %s is skipped: %v", queryName, err)
+			} else {
+				rules[name] = rule
+			}
+		}
+		queries[name] = []*serviceregistry.ServiceEntryWrapper{c.convertQuery(name, host, response)}
+	}
+	return queries, rules, nil
+}
+
+// failoverQuery adds the healthy instances in the failover datacenters of a prepared query to its result, and
+// returns the DestinationRule which fails over between the datacenters in the order of the query
+func (c *PreparedQueryController) failoverQuery(definition *api.PreparedQueryDefinition, name, host string,
+	response *api.PreparedQueryExecuteResponse) (*serviceregistry.ConfigWrapper, error) {
+	if definition.Service.Failover.NearestN > 0 {
+		log.Warnf("Prepared query %s fails over to the nearest datacenters, only its explicit datacenters are "+
+			"converted", definition.Name)
+	}
+	if c.localDatacenter == "" {
+		self, err := c.client.Agent().Self()
+		if err != nil {
+			return nil, fmt.Errorf("could not look up the local datacenter: %v", err)
+		}
+		datacenter, _ := self["Config"]["Datacenter"].(string)
+		if datacenter == "" {
+			return nil, fmt.Errorf("the local datacenter is unknown")
+		}
+		c.localDatacenter = datacenter
+	}
+
+	seen := make(map[string]bool, len(response.Nodes))
+	instanceKey := func(entry *api.ServiceEntry) string {
+		return entry.Node.Datacenter + "/" + entry.Node.Node + "/" + entry.Service.ID
+	}
+	for i := range response.Nodes {
+		seen[instanceKey(&response.Nodes[i])] = true
+	}
+	datacenters := []string{c.localDatacenter}
+	for _, datacenter := range definition.Service.Failover.Datacenters {
+		if datacenter == c.localDatacenter {
+			continue
+		}
+		datacenters = append(datacenters, datacenter)
+		entries, _, err := c.client.Health().Service(definition.Service.Service, "", true,
+			&api.QueryOptions{Datacenter: datacenter})
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch the instances in datacenter %s: %v", datacenter, err)
+		}
+		for _, entry := range entries {
+			if entry.Node == nil || entry.Service == nil || !matchQueryTags(entry.Service.Tags,
+				definition.Service.Tags) || seen[instanceKey(entry)] {
+				continue
+			}
+			seen[instanceKey(entry)] = true
+			response.Nodes = append(response.Nodes, *entry)
+		}
+	}
+
+	policy, err := c.options.failoverPolicy(datacenters, definition.Service.Failover.Datacenters)
+	if err != nil {
+		return nil, err
+	}
+	return &serviceregistry.ConfigWrapper{
+		Service: name,
+		Name:    host,
+		Spec:    &istio.DestinationRule{Host: host, TrafficPolicy: policy},
+	}, nil
+}
+
+// matchQueryTags tells whether an instance has all the tags of a prepared query, a tag prefixed with "!" must be
+// absent instead
+func matchQueryTags(instanceTags, queryTags []string) bool {
+	for _, tag := range queryTags {
+		if strings.HasPrefix(tag, "!") {
+			if contains(instanceTags, strings.TrimPrefix(tag, "!")) {
+				return false
+			}
+		} else if !contains(instanceTags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedRules returns the DestinationRules of the prepared queries sorted by their names
+func sortedRules(rules map[string]*serviceregistry.ConfigWrapper) []*serviceregistry.ConfigWrapper {
+	out := make([]*serviceregistry.ConfigWrapper, 0, len(rules))
+	for _, rule := range rules {
+		out = append(out, rule)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// convertQuery converts the result of a prepared query to a ServiceEntry on the host of the query
+func (c *PreparedQueryController) convertQuery(name, host string,
+	response *api.PreparedQueryExecuteResponse) *serviceregistry.ServiceEntryWrapper {
+	endpoints := make([]*api.CatalogService, 0, len(response.Nodes))
+	for i := range response.Nodes {
+		if endpoint := healthEntryToCatalogService(&response.Nodes[i]); !isExported(endpoint) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	serviceEntry := convertServiceEntry(c.options, response.Service, "", endpoints, nil)
+	serviceEntry.Hosts = []string{host}
+	return &serviceregistry.ServiceEntryWrapper{
+		Service: name,
+		Name:    host,
+		Spec:    serviceEntry,
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/protobuf/proto"
+	istio "istio.io/api/networking/v1alpha3"
+
+	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry"
+)
+
+func queryResult(service string, addresses ...string) *api.PreparedQueryExecuteResponse {
+	response := &api.PreparedQueryExecuteResponse{Service: service, Datacenter: "dc1"}
+	for _, address := range addresses {
+		response.Nodes = append(response.Nodes, api.ServiceEntry{
+			Node: &api.Node{Node: "node-" + address, Address: address, Datacenter: "dc1"},
+			Service: &api.AgentService{
+				ID:      service + "-" + address,
+				Service: service,
+				Address: address,
+				Port:    8080,
+				Meta:    map[string]string{protocolTagName: "http"},
+			},
+		})
+	}
+	return response
+}
+
+func TestPreparedQueries(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+	ts.queries = []*api.PreparedQueryDefinition{
+		{ID: "id-1", Name: "reviews-nearest", Service: api.ServiceQuery{Service: "reviews"}},
+		{ID: "id-2", Service: api.ServiceQuery{Service: "rating"}},
+		{ID: "id-3", Name: "geo-", Template: api.QueryTemplate{Type: "name_prefix_match"}},
+		{ID: "id-4", Name: "broken"},
+	}
+	ts.queryResults["id-1"] = queryResult("reviews", "10.0.0.1", "10.0.0.2")
+	ts.queryResults["id-2"] = queryResult("rating", "10.0.0.3")
+
+	args := newTestArgs(ts.server.URL)
+	controller, err := NewPreparedQueryController(args)
+	if err != nil {
+		t.Fatalf("could not create prepared query controller: %v", err)
+	}
+	var events []serviceregistry.ServiceEvent
+	controller.AppendServiceChangeHandler(func(event serviceregistry.ServiceEvent) {
+		events = append(events, event)
+	})
+
+	serviceEntries, err := controller.ServiceEntries()
+	if err != nil {
+		t.Fatalf("ServiceEntries() => %v", err)
+	}
+	hosts := make(map[string][]string)
+	for _, serviceEntry := range serviceEntries {
+		addresses := make([]string, 0, len(serviceEntry.Spec.Endpoints))
+		for _, endpoint := range serviceEntry.Spec.Endpoints {
+			addresses = append(addresses, endpoint.Address)
+		}
+		hosts[serviceEntry.Service+" "+serviceEntry.Spec.Hosts[0]] = addresses
+	}
+	want := map[string][]string{
+		"query/reviews-nearest reviews-nearest.query.consul": {"10.0.0.1", "10.0.0.2"},
+		"query/id-2 id-2.query.consul":                       {"10.0.0.3"},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("ServiceEntries() => %v, want %v", hosts, want)
+	}
+
+	// A failover moves the query to other instances, and a removed query is deleted
+	ts.lock.Lock()
+	ts.queryResults["id-1"] = queryResult("reviews", "10.1.0.1")
+	ts.queries = ts.queries[:1]
+	ts.lock.Unlock()
+	controller.refresh()
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Service < events[j].Service
+	})
+	wantEvents := []serviceregistry.ServiceEvent{
+		{Type: serviceregistry.EventDelete, Service: "query/id-2"},
+		{Type: serviceregistry.EventUpdate, Service: "query/reviews-nearest"},
+	}
+	if !reflect.DeepEqual(events, wantEvents) {
+		t.Errorf("refresh() emits %v, want %v", events, wantEvents)
+	}
+	serviceEntries, err = controller.ServiceEntriesOf("query/reviews-nearest")
+	if err != nil {
+		t.Fatalf("ServiceEntriesOf() => %v", err)
+	}
+	if len(serviceEntries) != 1 || len(serviceEntries[0].Spec.Endpoints) != 1 ||
+		serviceEntries[0].Spec.Endpoints[0].Address != "10.1.0.1" {
+		t.Errorf("ServiceEntriesOf() => %v, want the failover instance", serviceEntries)
+	}
+
+	// The ServiceEntries are kept if the query fails to execute
+	events = nil
+	ts.lock.Lock()
+	delete(ts.queryResults, "id-1")
+	ts.lock.Unlock()
+	controller.refresh()
+	if len(events) != 0 {
+		t.Errorf("refresh() emits %v after a failed execution, want none", events)
+	}
+}
+
+func TestPreparedQueryFailover(t *testing.T) {
+	ts := newServer()
+	defer ts.server.Close()
+	ts.extra = map[string][]*api.CatalogService{
+		"payments": {
+			{Node: "node-1", ServiceID: "payments-1", ServiceName: "payments", ServiceAddress: "10.1.0.1",
+				ServicePort: 8080, ServiceMeta: map[string]string{protocolTagName: "http"}},
+			{Node: "node-2", ServiceID: "payments-2", ServiceName: "payments", ServiceAddress: "10.1.0.2",
+				ServicePort: 8080, ServiceTags: []string{"canary"},
+				ServiceMeta: map[string]string{protocolTagName: "http"}},
+		},
+	}
+	ts.queries = []*api.PreparedQueryDefinition{{
+		ID:   "id-1",
+		Name: "payments",
+		Service: api.ServiceQuery{
+			Service:  "payments",
+			Tags:     []string{"!canary"},
+			Failover: api.QueryDatacenterOptions{Datacenters: []string{"dc2", "dc3"}},
+		},
+	}}
+	ts.queryResults["id-1"] = queryResult("payments", "10.0.0.1")
+
+	args := newTestArgs(ts.server.URL)
+	args.SyncFailover = true
+	controller, err := NewPreparedQueryController(args)
+	if err != nil {
+		t.Fatalf("could not create prepared query controller: %v", err)
+	}
+	serviceEntries, err := controller.ServiceEntries()
+	if err != nil {
+		t.Fatalf("ServiceEntries() => %v", err)
+	}
+
+	// The instances in the failover datacenters are added, except the ones excluded by the tags of the query
+	localities := make([]string, 0)
+	for _, endpoint := range serviceEntries[0].Spec.Endpoints {
+		localities = append(localities, endpoint.Address+" "+endpoint.Locality)
+	}
+	sort.Strings(localities)
+	wantLocalities := []string{"10.0.0.1 dc1", "10.1.0.1 dc2", "10.1.0.1 dc3"}
+	if len(serviceEntries) != 1 || !reflect.DeepEqual(localities, wantLocalities) {
+		t.Errorf("ServiceEntries() => endpoints %v, want %v", localities, wantLocalities)
+	}
+
+	configs, err := controller.Configs()
+	if err != nil {
+		t.Fatalf("Configs() => %v", err)
+	}
+	want := &istio.DestinationRule{
+		Host: "payments.query.consul",
+		TrafficPolicy: testFailoverPolicy(
+			&istio.LocalityLoadBalancerSetting_Failover{From: "dc1", To: "dc2"},
+			&istio.LocalityLoadBalancerSetting_Failover{From: "dc2", To: "dc3"},
+			&istio.LocalityLoadBalancerSetting_Failover{From: "dc3", To: "dc2"},
+		),
+	}
+	if len(configs) != 1 || configs[0].Name != "payments.query.consul" || !proto.Equal(configs[0].Spec, want) {
+		t.Errorf("Configs() => %v, want %v", configSpecs(configs), want)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"context"
+	"sort"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// AllDatacenters watches all the datacenters known to the Consul agent
+	AllDatacenters = "*"
+	// AllPartitions watches all the admin partitions of Consul Enterprise
+	AllPartitions = "*"
+	// AllNamespaces watches all the namespaces of Consul Enterprise
+	AllNamespaces = "*"
+
+	// DatacenterModeMerge merges the instances of a service in all datacenters into one ServiceEntry
+	DatacenterModeMerge = "merge"
+	// DatacenterModeSplit creates a ServiceEntry with a per-datacenter hostname for each datacenter of a service
+	DatacenterModeSplit = "split"
+
+	// NamespaceModeHostname includes the Consul namespace and partition in the hostname of the ServiceEntry
+	NamespaceModeHostname = "hostname"
+	// NamespaceModeKubernetes creates the ServiceEntry in the Kubernetes namespace named after the Consul namespace
+	NamespaceModeKubernetes = "kubernetes"
+
+	// defaultEnterpriseName is the name of the default namespace and partition of Consul Enterprise
+	defaultEnterpriseName = "default"
+)
+
+// scope is the range of a Consul query: a namespace of an admin partition in a datacenter,
+// an empty field stands for the default one of the Consul agent
+type scope struct {
+	Datacenter string
+	Partition  string
+	Namespace  string
+}
+
+// queryOptions returns the options to query the resources in the scope
+func (s scope) queryOptions(ctx context.Context) *api.QueryOptions {
+	q := &api.QueryOptions{
+		Datacenter: s.Datacenter,
+		Namespace:  s.Namespace,
+	}
+	return q.WithContext(withPartition(ctx, s.Partition))
+}
+
+// scopeConfig is the configured range of the Consul resources to synchronize
+type scopeConfig struct {
+	datacenters []string
+	partitions  []string
+	namespaces  []string
+}
+
+func newScopeConfig(args *BootStrapArgs) scopeConfig {
+	return scopeConfig{
+		datacenters: args.Datacenters,
+		partitions:  args.ConsulPartitions,
+		namespaces:  args.ConsulNamespaces,
+	}
+}
+
+// dynamic tells whether the scopes may change over time
+func (c scopeConfig) dynamic() bool {
+	return contains(c.datacenters, AllDatacenters) || contains(c.partitions, AllPartitions) ||
+		contains(c.namespaces, AllNamespaces)
+}
+
+// enterprise tells whether Consul Enterprise namespaces or partitions are synchronized
+func (c scopeConfig) enterprise() bool {
+	return len(c.partitions) > 0 || len(c.namespaces) > 0
+}
+
+// serviceKey returns the key of a service named in a config entry, in the same form as the keys of the synchronized
+// services. Consul Enterprise names the default namespace and partition explicitly in config entries, even if they
+// are not synchronized.
+func (c scopeConfig) serviceKey(partition, namespace, name string) ServiceKey {
+	key := ServiceKey{Name: name}
+	if len(c.partitions) > 0 {
+		key.Partition = enterpriseName(partition)
+	}
+	if len(c.namespaces) > 0 || key.Partition != "" {
+		key.Namespace = enterpriseName(namespace)
+	}
+	return key
+}
+
+// resolveScopes returns all the scopes to synchronize
+func resolveScopes(client *api.Client, config scopeConfig) ([]scope, error) {
+	datacenters, err := resolveDatacenters(client, config.datacenters)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := make([]scope, 0)
+	for _, datacenter := range datacenters {
+		partitions, err := resolvePartitions(client, datacenter, config.partitions)
+		if err != nil {
+			return nil, err
+		}
+		for _, partition := range partitions {
+			namespaces, err := resolveNamespaces(client, scope{Datacenter: datacenter, Partition: partition},
+				config.namespaces)
+			if err != nil {
+				return nil, err
+			}
+			for _, namespace := range namespaces {
+				scopes = append(scopes, scope{Datacenter: datacenter, Partition: partition, Namespace: namespace})
+			}
+		}
+	}
+	return scopes, nil
+}
+
+// resolveDatacenters returns the datacenters to synchronize, an empty datacenter stands for the local datacenter
+// of the Consul agent
+func resolveDatacenters(client *api.Client, datacenters []string) ([]string, error) {
+	if len(datacenters) == 0 {
+		return []string{""}, nil
+	}
+	if !contains(datacenters, AllDatacenters) {
+		return datacenters, nil
+	}
+	return client.Catalog().Datacenters()
+}
+
+// resolvePartitions returns the admin partitions to synchronize in a datacenter
+func resolvePartitions(client *api.Client, datacenter string, partitions []string) ([]string, error) {
+	if len(partitions) == 0 {
+		return []string{""}, nil
+	}
+	if !contains(partitions, AllPartitions) {
+		return partitions, nil
+	}
+
+	// The vendored Consul client doesn't support admin partitions, so the API is called directly
+	var out []struct {
+		Name string
+	}
+	if _, err := client.Raw().Query("/v1/partitions", &out, &api.QueryOptions{Datacenter: datacenter}); err != nil {
+		return nil, err
+	}
+	resolved := make([]string, 0, len(out))
+	for _, partition := range out {
+		resolved = append(resolved, partition.Name)
+	}
+	return resolved, nil
+}
+
+// resolveNamespaces returns the namespaces to synchronize in an admin partition
+func resolveNamespaces(client *api.Client, s scope, namespaces []string) ([]string, error) {
+	if len(namespaces) == 0 {
+		// Namespaces are synchronized in partitions, so the default namespace is explicit to tell the services in
+		// different partitions apart
+		if s.Partition != "" {
+			return []string{defaultEnterpriseName}, nil
+		}
+		return []string{""}, nil
+	}
+	if !contains(namespaces, AllNamespaces) {
+		return namespaces, nil
+	}
+
+	out, _, err := client.Namespaces().List(s.queryOptions(context.Background()))
+	if err != nil {
+		return nil, err
+	}
+	resolved := make([]string, 0, len(out))
+	for _, namespace := range out {
+		resolved = append(resolved, namespace.Name)
+	}
+	return resolved, nil
+}
+
+// sortedDatacenters returns the datacenters of the endpoints in a stable order
+func sortedDatacenters(endpoints map[string][]*api.CatalogService) []string {
+	datacenters := make([]string, 0, len(endpoints))
+	for datacenter := range endpoints {
+		datacenters = append(datacenters, datacenter)
+	}
+	sort.Strings(datacenters)
+	return datacenters
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
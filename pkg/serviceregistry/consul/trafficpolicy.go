@@ -0,0 +1,614 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	istio "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/pkg/log"
+
+	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry"
+)
+
+// maxRedirects bounds the redirects followed to resolve a service, so that a redirect loop doesn't hang the conversion
+const maxRedirects = 8
+
+var (
+	// metaFilterTerm matches a term of a subset filter on the service meta, e.g. `Service.Meta.version == v1`
+	metaFilterTerm = regexp.MustCompile(`^Service\.Meta\.([-A-Za-z0-9_./]+)\s*==\s*(.+)$`)
+	// tagFilterTerms match a term of a subset filter on the tags, e.g. `"v1" in Service.Tags`
+	tagFilterTerms = []*regexp.Regexp{
+		regexp.MustCompile(`^(.+?)\s+in\s+Service\.Tags$`),
+		regexp.MustCompile(`^Service\.Tags\s+contains\s+(.+)$`),
+	}
+	// bareFilterValue matches a value of a filter term which is not quoted
+	bareFilterValue = regexp.MustCompile(`^[-A-Za-z0-9_.]+$`)
+)
+
+// discoveryChains indexes the config entries of the discovery chains by the IDs of the services they apply to
+type discoveryChains struct {
+	opts      *convertOptions
+	scopes    scopeConfig
+	keys      map[string]ServiceKey
+	resolvers map[string]*discoveryChainEntry
+	splitters map[string]*discoveryChainEntry
+	routers   map[string]*discoveryChainEntry
+	// datacenters are the synchronized datacenters to fail over between, the failovers are not converted if it's nil
+	datacenters []string
+}
+
+func newDiscoveryChains(opts *convertOptions, scopes scopeConfig, entries []*discoveryChainEntry) *discoveryChains {
+	chains := &discoveryChains{
+		opts:      opts,
+		scopes:    scopes,
+		keys:      make(map[string]ServiceKey),
+		resolvers: make(map[string]*discoveryChainEntry),
+		splitters: make(map[string]*discoveryChainEntry),
+		routers:   make(map[string]*discoveryChainEntry),
+	}
+	for _, entry := range entries {
+		id := configEntryServiceID(entry.Partition, entry.Namespace, entry.Name)
+		chains.keys[id] = scopes.serviceKey(entry.Partition, entry.Namespace, entry.Name)
+		switch entry.Kind {
+		case api.ServiceResolver:
+			chains.resolvers[id] = entry
+		case api.ServiceSplitter:
+			chains.splitters[id] = entry
+		case api.ServiceRouter:
+			chains.routers[id] = entry
+		}
+	}
+	return chains
+}
+
+// convert converts the discovery chain of each service to a DestinationRule and a VirtualService on the host of the
+// service. Only the first step of a chain is converted for a split or route to another service, which is resolved
+// by its service-resolver but not split or routed again.
+func (d *discoveryChains) convert() []*serviceregistry.ConfigWrapper {
+	ids := make([]string, 0, len(d.keys))
+	for id := range d.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	configs := make([]*serviceregistry.ConfigWrapper, 0)
+	for _, id := range ids {
+		key := d.keys[id]
+		if rule := d.destinationRule(key); rule != nil {
+			configs = append(configs, newConfigWrapper(d.opts, key, d.opts.serviceHost(key), rule))
+		}
+		if virtualService := d.virtualService(key); virtualService != nil {
+			configs = append(configs, newConfigWrapper(d.opts, key, d.opts.serviceHost(key), virtualService))
+		}
+	}
+	return configs
+}
+
+func (d *discoveryChains) id(key ServiceKey) string {
+	return configEntryServiceID(key.Partition, key.Namespace, key.Name)
+}
+
+// targetKey returns the key of the service which a split, route or redirect points to, the service, namespace and
+// partition default to the ones of the service of the config entry
+func (d *discoveryChains) targetKey(source ServiceKey, service, namespace, partition string) ServiceKey {
+	if service == "" {
+		service = source.Name
+	}
+	if namespace == "" {
+		namespace = source.Namespace
+	}
+	if partition == "" {
+		partition = source.Partition
+	}
+	return d.scopes.serviceKey(partition, namespace, service)
+}
+
+// resolve returns the destination of the traffic to a subset of a service, after the redirects and the default
+// subset of the service-resolvers are applied
+func (d *discoveryChains) resolve(key ServiceKey, subset string) *istio.Destination {
+	resolver := d.resolvers[d.id(key)]
+	for i := 0; resolver != nil && resolver.Redirect != nil; i++ {
+		if i == maxRedirects {
+			log.Warnf("Redirects of service %s exceed %d, the last one is used", key.Name, maxRedirects)
+			break
+		}
+		redirect := resolver.Redirect
+		if redirect.Datacenter != "" {
+			log.Warnf("Datacenter %s of the redirect of service %s is ignored", redirect.Datacenter, key.Name)
+		}
+		key = d.targetKey(key, redirect.Service, redirect.Namespace, redirect.Partition)
+		subset = redirect.ServiceSubset
+		resolver = d.resolvers[d.id(key)]
+	}
+	if subset == "" && resolver != nil {
+		subset = resolver.DefaultSubset
+	}
+	return &istio.Destination{Host: d.opts.serviceHost(key), Subset: subset}
+}
+
+// destinationRule converts the service-resolver of a service to the subsets and traffic policy of a DestinationRule,
+// it's nil if there is nothing to convert
+func (d *discoveryChains) destinationRule(key ServiceKey) *istio.DestinationRule {
+	resolver := d.resolvers[d.id(key)]
+	if resolver == nil {
+		return nil
+	}
+
+	rule := &istio.DestinationRule{Host: d.opts.serviceHost(key)}
+	names := make([]string, 0, len(resolver.Subsets))
+	for name := range resolver.Subsets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	policy := &istio.TrafficPolicy{}
+	if resolver.ConnectTimeout > 0 {
+		policy.ConnectionPool = &istio.ConnectionPoolSettings{
+			Tcp: &istio.ConnectionPoolSettings_TCPSettings{
+				ConnectTimeout: durationpb.New(time.Duration(resolver.ConnectTimeout)),
+			},
+		}
+	}
+	policy.LoadBalancer = convertLoadBalancer(key, resolver.LoadBalancer)
+	// The subsets take over the load balancer of the service, since Istio replaces it with the one of a subset
+	subsetPolicy := &istio.TrafficPolicy{LoadBalancer: policy.LoadBalancer}
+	if failover := d.failoverPolicy(key, wildcardSubset, resolver.Failover); failover != nil {
+		policy = withFailover(policy, failover)
+	}
+	if !proto.Equal(policy, &istio.TrafficPolicy{}) {
+		rule.TrafficPolicy = policy
+	}
+
+	for _, name := range names {
+		subsetLabels, err := d.subsetLabels(resolver.Subsets[name].Filter)
+		if err != nil {
+			log.Warnf("Subset %s of service %s is skipped: %v", name, key.Name, err)
+			continue
+		}
+		subset := &istio.Subset{Name: name, Labels: subsetLabels}
+		if failover := d.failoverPolicy(key, name, resolver.Failover); failover != nil {
+			subset.TrafficPolicy = withFailover(subsetPolicy, failover)
+		}
+		rule.Subsets = append(rule.Subsets, subset)
+	}
+
+	if len(rule.Subsets) == 0 && rule.TrafficPolicy == nil {
+		return nil
+	}
+	return rule
+}
+
+// failoverPolicy converts the failover of a subset of a service-resolver to the locality failover between
+// datacenters, it's nil if the subset doesn't fail over or the failover can't be converted
+func (d *discoveryChains) failoverPolicy(key ServiceKey, subset string,
+	failovers map[string]resolverFailover) *istio.TrafficPolicy {
+	failover, ok := failovers[subset]
+	if !ok || d.datacenters == nil {
+		return nil
+	}
+	if (failover.Service != "" && failover.Service != key.Name) || failover.ServiceSubset != "" ||
+		failover.Namespace != "" {
+		log.Warnf("Failover of subset %s of service %s is skipped since it fails over to another service", subset,
+			key.Name)
+		return nil
+	}
+	if d.opts.datacenterMode == DatacenterModeSplit {
+		log.Warnf("Failover of subset %s of service %s is skipped since the datacenters are split into different "+
+			"hosts", subset, key.Name)
+		return nil
+	}
+	targets := append([]string{}, failover.Datacenters...)
+	for _, target := range failover.Targets {
+		if target.Datacenter == "" || (target.Service != "" && target.Service != key.Name) ||
+			target.ServiceSubset != "" || target.Namespace != "" || target.Partition != "" || target.Peer != "" {
+			log.Warnf("Failover of subset %s of service %s is skipped since it has a target other than a "+
+				"datacenter", subset, key.Name)
+			return nil
+		}
+		targets = append(targets, target.Datacenter)
+	}
+	policy, err := d.opts.failoverPolicy(d.datacenters, targets)
+	if err != nil {
+		log.Warnf("Failover of subset %s of service %s is skipped: %v", subset, key.Name, err)
+		return nil
+	}
+	return policy
+}
+
+// subsetLabels converts the filter of a subset to the labels of the WorkloadEntries it selects. Only the conjunctions
+// of equality checks on the meta converted to labels and of the tags converted to labels are supported.
+func (d *discoveryChains) subsetLabels(filter string) (map[string]string, error) {
+	out := make(labels.Instance)
+	filter = strings.TrimSpace(filter)
+	if filter == "" {
+		return out, nil
+	}
+	for _, term := range strings.Split(filter, " and ") {
+		term = strings.TrimSpace(term)
+		if match := metaFilterTerm.FindStringSubmatch(term); match != nil {
+			key := match[1]
+			value, err := filterValue(match[2])
+			if err != nil {
+				return nil, fmt.Errorf("unsupported filter %q: %v", filter, err)
+			}
+			if !contains(d.opts.labels.metaKeys, key) && !contains(d.opts.labels.metaKeys, AllMetaKeys) {
+				return nil, fmt.Errorf("meta %s of filter %q is not converted to a label", key, filter)
+			}
+			if !addFilterLabel(out, key, value) {
+				return nil, fmt.Errorf("meta %s=%s of filter %q is not a valid label", key, value, filter)
+			}
+			continue
+		}
+
+		matched := false
+		for _, tagFilterTerm := range tagFilterTerms {
+			match := tagFilterTerm.FindStringSubmatch(term)
+			if match == nil {
+				continue
+			}
+			tag, err := filterValue(match[1])
+			if err != nil {
+				return nil, fmt.Errorf("unsupported filter %q: %v", filter, err)
+			}
+			key, value, ok := d.opts.labels.splitTag(tag)
+			if !ok {
+				return nil, fmt.Errorf("tag %s of filter %q is not converted to a label", tag, filter)
+			}
+			if !addFilterLabel(out, key, value) {
+				return nil, fmt.Errorf("tag %s of filter %q is not a valid label", tag, filter)
+			}
+			matched = true
+			break
+		}
+		if !matched {
+			return nil, fmt.Errorf("unsupported filter %q", filter)
+		}
+	}
+	return out, nil
+}
+
+// filterValue returns the value of a filter term, which is either quoted or a bare word
+func filterValue(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if bareFilterValue.MatchString(value) {
+		return value, nil
+	}
+	return strconv.Unquote(value)
+}
+
+// addFilterLabel adds a label converted from a subset filter the same way as the labels of the WorkloadEntries,
+// it returns false if the label is invalid
+func addFilterLabel(out labels.Instance, key, value string) bool {
+	size := len(out)
+	addLabel(out, key, value)
+	return len(out) > size
+}
+
+// convertLoadBalancer converts the load balancer of a service-resolver, the consistent hash only uses the first hash
+// policy since Istio doesn't support several ones
+func convertLoadBalancer(key ServiceKey, lb *resolverLoadBalancer) *istio.LoadBalancerSettings {
+	if lb == nil {
+		return nil
+	}
+	simple := map[string]istio.LoadBalancerSettings_SimpleLB{
+		"round_robin":   istio.LoadBalancerSettings_ROUND_ROBIN,
+		"least_request": istio.LoadBalancerSettings_LEAST_REQUEST,
+		"random":        istio.LoadBalancerSettings_RANDOM,
+	}
+	if policy, ok := simple[lb.Policy]; ok {
+		return &istio.LoadBalancerSettings{
+			LbPolicy: &istio.LoadBalancerSettings_Simple{Simple: policy},
+		}
+	}
+	if lb.Policy != "ring_hash" && lb.Policy != "maglev" {
+		if lb.Policy != "" {
+			log.Warnf("Load balancer policy %s of service %s is not supported", lb.Policy, key.Name)
+		}
+		return nil
+	}
+	if len(lb.HashPolicies) == 0 {
+		log.Warnf("Load balancer policy %s of service %s is skipped since it has no hash policy", lb.Policy,
+			key.Name)
+		return nil
+	}
+	if len(lb.HashPolicies) > 1 {
+		log.Warnf("Only the first hash policy of service %s is converted", key.Name)
+	}
+
+	consistentHash := &istio.LoadBalancerSettings_ConsistentHashLB{}
+	hash := lb.HashPolicies[0]
+	switch {
+	case hash.SourceIP:
+		consistentHash.HashKey = &istio.LoadBalancerSettings_ConsistentHashLB_UseSourceIp{UseSourceIp: true}
+	case hash.Field == "header":
+		consistentHash.HashKey = &istio.LoadBalancerSettings_ConsistentHashLB_HttpHeaderName{
+			HttpHeaderName: hash.FieldValue,
+		}
+	case hash.Field == "query_parameter":
+		consistentHash.HashKey = &istio.LoadBalancerSettings_ConsistentHashLB_HttpQueryParameterName{
+			HttpQueryParameterName: hash.FieldValue,
+		}
+	case hash.Field == "cookie":
+		cookie := &istio.LoadBalancerSettings_ConsistentHashLB_HTTPCookie{Name: hash.FieldValue}
+		if hash.CookieConfig != nil {
+			cookie.Path = hash.CookieConfig.Path
+			if hash.CookieConfig.TTL > 0 {
+				cookie.Ttl = durationpb.New(time.Duration(hash.CookieConfig.TTL))
+			}
+		}
+		consistentHash.HashKey = &istio.LoadBalancerSettings_ConsistentHashLB_HttpCookie{HttpCookie: cookie}
+	default:
+		log.Warnf("Hash policy on %s of service %s is not supported", hash.Field, key.Name)
+		return nil
+	}
+	if lb.Policy == "maglev" {
+		consistentHash.HashAlgorithm = &istio.LoadBalancerSettings_ConsistentHashLB_Maglev{
+			Maglev: &istio.LoadBalancerSettings_ConsistentHashLB_MagLev{},
+		}
+	} else if lb.RingHashConfig != nil && lb.RingHashConfig.MinimumRingSize > 0 {
+		consistentHash.HashAlgorithm = &istio.LoadBalancerSettings_ConsistentHashLB_RingHash_{
+			RingHash: &istio.LoadBalancerSettings_ConsistentHashLB_RingHash{
+				MinimumRingSize: lb.RingHashConfig.MinimumRingSize,
+			},
+		}
+	}
+	return &istio.LoadBalancerSettings{
+		LbPolicy: &istio.LoadBalancerSettings_ConsistentHash{ConsistentHash: consistentHash},
+	}
+}
+
+// virtualService converts the service-router and service-splitter of a service to the HTTP routes of a
+// VirtualService, the routes of the router come first and the default route goes through the splitter. It's nil if
+// the traffic to the service goes to all its instances.
+func (d *discoveryChains) virtualService(key ServiceKey) *istio.VirtualService {
+	id := d.id(key)
+	router, splitter := d.routers[id], d.splitters[id]
+	defaultRoute := d.splitRoute(key, splitter)
+	host := d.opts.serviceHost(key)
+	if router == nil && splitter == nil {
+		// A service-resolver only needs a VirtualService to apply its default subset or redirect
+		if destination := defaultRoute[0].Destination; destination.Host == host && destination.Subset == "" {
+			return nil
+		}
+	}
+
+	virtualService := &istio.VirtualService{Hosts: []string{host}}
+	if router != nil {
+		for _, route := range router.Routes {
+			virtualService.Http = append(virtualService.Http, d.convertRoute(key, route, defaultRoute))
+		}
+	}
+	virtualService.Http = append(virtualService.Http, &istio.HTTPRoute{Route: defaultRoute})
+	return virtualService
+}
+
+// splitRoute converts the splits of a service-splitter to weighted destinations, the traffic goes to the resolved
+// service if there is no splitter
+func (d *discoveryChains) splitRoute(key ServiceKey, splitter *discoveryChainEntry) []*istio.HTTPRouteDestination {
+	if splitter == nil || len(splitter.Splits) == 0 {
+		return []*istio.HTTPRouteDestination{{Destination: d.resolve(key, "")}}
+	}
+
+	weights := splitWeights(splitter.Splits)
+	route := make([]*istio.HTTPRouteDestination, 0, len(splitter.Splits))
+	for i, split := range splitter.Splits {
+		if weights[i] == 0 {
+			continue
+		}
+		target := d.targetKey(key, split.Service, split.Namespace, split.Partition)
+		route = append(route, &istio.HTTPRouteDestination{
+			Destination: d.resolve(target, split.ServiceSubset),
+			Weight:      weights[i],
+			Headers:     convertHeaders(split.RequestHeaders, split.ResponseHeaders),
+		})
+	}
+	if len(route) == 0 {
+		log.Warnf("Splits of service %s are skipped since all of their weights are 0", key.Name)
+		return []*istio.HTTPRouteDestination{{Destination: d.resolve(key, "")}}
+	}
+	if len(route) == 1 {
+		route[0].Weight = 0
+	}
+	return route
+}
+
+// splitWeights converts the weights of splits, which are percentages with up to two decimals, to integers which sum
+// up to 100 with the largest remainder method
+func splitWeights(splits []serviceSplit) []int32 {
+	weights := make([]int32, len(splits))
+	total := float64(0)
+	for _, split := range splits {
+		total += float64(split.Weight)
+	}
+	if total <= 0 {
+		return weights
+	}
+
+	remainders := make([]float64, len(splits))
+	order := make([]int, len(splits))
+	sum := int32(0)
+	for i, split := range splits {
+		exact := float64(split.Weight) * 100 / total
+		weights[i] = int32(math.Floor(exact))
+		remainders[i] = exact - math.Floor(exact)
+		order[i] = i
+		sum += weights[i]
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return remainders[order[i]] > remainders[order[j]]
+	})
+	for i := 0; sum < 100; i++ {
+		weights[order[i%len(order)]]++
+		sum++
+	}
+	return weights
+}
+
+// convertRoute converts a route of a service-router, the traffic to the service itself without a subset goes through
+// the splitter of the service
+func (d *discoveryChains) convertRoute(key ServiceKey, route serviceRoute,
+	defaultRoute []*istio.HTTPRouteDestination) *istio.HTTPRoute {
+	out := &istio.HTTPRoute{Route: defaultRoute}
+	if route.Match != nil && route.Match.HTTP != nil {
+		out.Match = []*istio.HTTPMatchRequest{convertHTTPMatch(route.Match.HTTP)}
+	}
+	destination := route.Destination
+	if destination == nil {
+		return out
+	}
+
+	target := d.targetKey(key, destination.Service, destination.Namespace, destination.Partition)
+	if d.id(target) != d.id(key) || destination.ServiceSubset != "" {
+		out.Route = []*istio.HTTPRouteDestination{{Destination: d.resolve(target, destination.ServiceSubset)}}
+	}
+	if destination.PrefixRewrite != "" {
+		out.Rewrite = &istio.HTTPRewrite{Uri: destination.PrefixRewrite}
+	}
+	if destination.RequestTimeout > 0 {
+		out.Timeout = durationpb.New(time.Duration(destination.RequestTimeout))
+	}
+	out.Retries = convertRetries(destination)
+	out.Headers = convertHeaders(destination.RequestHeaders, destination.ResponseHeaders)
+	return out
+}
+
+// convertHTTPMatch converts the HTTP match of a route, all its criteria must match like in Consul
+func convertHTTPMatch(match *routeHTTPMatch) *istio.HTTPMatchRequest {
+	out := &istio.HTTPMatchRequest{}
+	switch {
+	case match.PathExact != "":
+		out.Uri = &istio.StringMatch{MatchType: &istio.StringMatch_Exact{Exact: match.PathExact}}
+	case match.PathPrefix != "":
+		out.Uri = &istio.StringMatch{MatchType: &istio.StringMatch_Prefix{Prefix: match.PathPrefix}}
+	case match.PathRegex != "":
+		out.Uri = &istio.StringMatch{MatchType: &istio.StringMatch_Regex{Regex: match.PathRegex}}
+	}
+
+	for _, header := range match.Header {
+		var value *istio.StringMatch
+		switch {
+		case header.Exact != "":
+			value = &istio.StringMatch{MatchType: &istio.StringMatch_Exact{Exact: header.Exact}}
+		case header.Prefix != "":
+			value = &istio.StringMatch{MatchType: &istio.StringMatch_Prefix{Prefix: header.Prefix}}
+		case header.Suffix != "":
+			suffix := ".*" + regexp.QuoteMeta(header.Suffix)
+			value = &istio.StringMatch{MatchType: &istio.StringMatch_Regex{Regex: suffix}}
+		case header.Regex != "":
+			value = &istio.StringMatch{MatchType: &istio.StringMatch_Regex{Regex: header.Regex}}
+		default:
+			// The header is present
+			value = &istio.StringMatch{MatchType: &istio.StringMatch_Regex{Regex: ".*"}}
+		}
+		name := strings.ToLower(header.Name)
+		if header.Invert {
+			if out.WithoutHeaders == nil {
+				out.WithoutHeaders = make(map[string]*istio.StringMatch)
+			}
+			out.WithoutHeaders[name] = value
+		} else {
+			if out.Headers == nil {
+				out.Headers = make(map[string]*istio.StringMatch)
+			}
+			out.Headers[name] = value
+		}
+	}
+
+	for _, param := range match.QueryParam {
+		if out.QueryParams == nil {
+			out.QueryParams = make(map[string]*istio.StringMatch)
+		}
+		switch {
+		case param.Exact != "":
+			out.QueryParams[param.Name] = &istio.StringMatch{MatchType: &istio.StringMatch_Exact{Exact: param.Exact}}
+		case param.Regex != "":
+			out.QueryParams[param.Name] = &istio.StringMatch{MatchType: &istio.StringMatch_Regex{Regex: param.Regex}}
+		default:
+			out.QueryParams[param.Name] = &istio.StringMatch{MatchType: &istio.StringMatch_Regex{Regex: ".*"}}
+		}
+	}
+
+	switch len(match.Methods) {
+	case 0:
+	case 1:
+		out.Method = &istio.StringMatch{MatchType: &istio.StringMatch_Exact{Exact: match.Methods[0]}}
+	default:
+		methods := make([]string, 0, len(match.Methods))
+		for _, method := range match.Methods {
+			methods = append(methods, regexp.QuoteMeta(method))
+		}
+		out.Method = &istio.StringMatch{MatchType: &istio.StringMatch_Regex{Regex: strings.Join(methods, "|")}}
+	}
+	return out
+}
+
+// convertRetries converts the retry policy of a route, it's nil if the route doesn't retry
+func convertRetries(destination *routeDestination) *istio.HTTPRetry {
+	conditions := make([]string, 0, len(destination.RetryOn)+len(destination.RetryOnStatusCodes)+1)
+	conditions = append(conditions, destination.RetryOn...)
+	if destination.RetryOnConnectFailure {
+		conditions = append(conditions, "connect-failure")
+	}
+	for _, code := range destination.RetryOnStatusCodes {
+		conditions = append(conditions, strconv.Itoa(int(code)))
+	}
+	if destination.NumRetries == 0 && len(conditions) == 0 {
+		return nil
+	}
+	// Envoy retries once if the number of retries is not set
+	attempts := int32(destination.NumRetries)
+	if attempts == 0 {
+		attempts = 1
+	}
+	return &istio.HTTPRetry{
+		Attempts: attempts,
+		RetryOn:  strings.Join(conditions, ","),
+	}
+}
+
+// convertHeaders converts the header modifiers of a split or route, it's nil if no header is modified
+func convertHeaders(request, response *headerModifiers) *istio.Headers {
+	if request == nil && response == nil {
+		return nil
+	}
+	convert := func(modifiers *headerModifiers) *istio.Headers_HeaderOperations {
+		if modifiers == nil || (len(modifiers.Add) == 0 && len(modifiers.Set) == 0 && len(modifiers.Remove) == 0) {
+			return nil
+		}
+		return &istio.Headers_HeaderOperations{
+			Add:    modifiers.Add,
+			Set:    modifiers.Set,
+			Remove: modifiers.Remove,
+		}
+	}
+	headers := &istio.Headers{
+		Request:  convert(request),
+		Response: convert(response),
+	}
+	if headers.Request == nil && headers.Response == nil {
+		return nil
+	}
+	return headers
+}
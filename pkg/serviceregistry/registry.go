@@ -32,7 +32,7 @@ import istio "istio.io/api/networking/v1alpha3"
 // that all handlers must be appended before starting the controller.
 type Controller interface {
 	// AppendServiceChangeHandler notifies about changes to the service catalog.
-	AppendServiceChangeHandler(serviceChanged func())
+	AppendServiceChangeHandler(serviceChanged func(event ServiceEvent))
 
 	// Run until a signal is received
 	Run(stop <-chan struct{})
@@ -41,7 +41,11 @@ type Controller interface {
 // ServiceDiscovery provides interface for all service discovery mechanisms.
 type ServiceDiscovery interface {
 	// ServiceEntries list declarations of all services in this registry
-	ServiceEntries() ([]*istio.ServiceEntry, error)
+	ServiceEntries() ([]*ServiceEntryWrapper, error)
+
+	// ServiceEntriesOf list declarations of a single service in this registry,
+	// it returns an empty list if the service doesn't exist
+	ServiceEntriesOf(service string) ([]*ServiceEntryWrapper, error)
 }
 
 // Registry provides interface for service registry operations.
@@ -49,3 +53,49 @@ type Registry interface {
 	Controller
 	ServiceDiscovery
 }
+
+// ServiceEntryWrapper is a ServiceEntry converted from a service in the registry
+type ServiceEntryWrapper struct {
+	// Service is the name of the service in the registry which the ServiceEntry is converted from
+	Service string
+	// Name is the name of the ServiceEntry resource
+	Name string
+	// Namespace is the namespace of the ServiceEntry resource, empty for the default namespace of the registry
+	Namespace string
+	// Labels are the extra labels of the ServiceEntry resource which record where it comes from
+	Labels map[string]string
+	// Annotations are the extra annotations of the ServiceEntry resource
+	Annotations map[string]string
+	Spec        *istio.ServiceEntry
+}
+
+// EventType is the type of a service change event
+type EventType int
+
+const (
+	// EventAdd means that a service is added to the registry
+	EventAdd EventType = iota
+	// EventUpdate means that the ServiceEntries of a service have changed
+	EventUpdate
+	// EventDelete means that a service is deleted from the registry
+	EventDelete
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventAdd:
+		return "add"
+	case EventUpdate:
+		return "update"
+	case EventDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// ServiceEvent describes the change of a service in the registry
+type ServiceEvent struct {
+	Type EventType
+	// Service is the name of the changed service
+	Service string
+}
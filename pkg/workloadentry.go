@@ -0,0 +1,185 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	istio "istio.io/api/networking/v1alpha3"
+	"istio.io/pkg/log"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/aeraki-framework/consul2istio/pkg/constants"
+	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry"
+)
+
+// splitWorkloadEntries moves the endpoints of the ServiceEntries to WorkloadEntries, one for each instance, which are
+// selected by the workloadSelector of their ServiceEntry. Only the STATIC ServiceEntries inside the mesh support a
+// workloadSelector, the other ones keep their endpoints.
+func splitWorkloadEntries(serviceEntries []*serviceregistry.ServiceEntryWrapper) (
+	[]*serviceregistry.ServiceEntryWrapper, []*serviceregistry.ConfigWrapper) {
+	selected := make([]*serviceregistry.ServiceEntryWrapper, 0, len(serviceEntries))
+	workloadEntries := make([]*serviceregistry.ConfigWrapper, 0)
+	for _, serviceEntry := range serviceEntries {
+		if serviceEntry.Spec.Resolution != istio.ServiceEntry_STATIC ||
+			serviceEntry.Spec.Location != istio.ServiceEntry_MESH_INTERNAL {
+			selected = append(selected, serviceEntry)
+			continue
+		}
+
+		selectorLabels := map[string]string{
+			constants.WorkloadSelectorLabel: workloadSelectorValue(serviceEntry.Name),
+		}
+		names := make(map[string]*istio.WorkloadEntry, len(serviceEntry.Spec.Endpoints))
+		for _, endpoint := range serviceEntry.Spec.Endpoints {
+			name := workloadEntryName(serviceEntry.Name, endpoint)
+			if named, ok := names[name]; ok {
+				if proto.Equal(named, endpoint) {
+					log.Debugf("Duplicated endpoint %s of ServiceEntry %s is skipped", endpoint.Address,
+						serviceEntry.Name)
+				} else {
+					log.Warnf("Endpoint %s of ServiceEntry %s is skipped since its WorkloadEntry name %s is "+
+						"taken by endpoint %s", endpoint.Address, serviceEntry.Name, name, named.Address)
+				}
+				continue
+			}
+			names[name] = endpoint
+			workloadEntry := proto.Clone(endpoint).(*istio.WorkloadEntry)
+			if workloadEntry.Labels == nil {
+				workloadEntry.Labels = make(map[string]string, len(selectorLabels))
+			}
+			for k, v := range selectorLabels {
+				workloadEntry.Labels[k] = v
+			}
+			workloadEntries = append(workloadEntries, &serviceregistry.ConfigWrapper{
+				Service:     serviceEntry.Service,
+				Name:        name,
+				Namespace:   serviceEntry.Namespace,
+				Labels:      serviceEntry.Labels,
+				Annotations: serviceEntry.Annotations,
+				Spec:        workloadEntry,
+			})
+		}
+
+		spec := proto.Clone(serviceEntry.Spec).(*istio.ServiceEntry)
+		spec.Endpoints = nil
+		spec.WorkloadSelector = &istio.WorkloadSelector{Labels: selectorLabels}
+		selected = append(selected, &serviceregistry.ServiceEntryWrapper{
+			Service:     serviceEntry.Service,
+			Name:        serviceEntry.Name,
+			Namespace:   serviceEntry.Namespace,
+			Labels:      serviceEntry.Labels,
+			Annotations: serviceEntry.Annotations,
+			Spec:        spec,
+		})
+	}
+	sort.Slice(workloadEntries, func(i, j int) bool {
+		return workloadEntries[i].Name < workloadEntries[j].Name
+	})
+	return selected, workloadEntries
+}
+
+// workloadSelectorValue returns the value of the label which selects the WorkloadEntries of a ServiceEntry, a name
+// longer than a label value is truncated and suffixed with its hash to stay unique
+func workloadSelectorValue(serviceEntry string) string {
+	if len(serviceEntry) <= validation.LabelValueMaxLength {
+		return serviceEntry
+	}
+	suffix := "-" + nameHash(serviceEntry)
+	return truncateName(serviceEntry, validation.LabelValueMaxLength-len(suffix)) + suffix
+}
+
+// workloadEntryName names the WorkloadEntry of an instance after its ServiceEntry and a hash of its address and
+// ports, so that the name is stable as long as the instance is
+func workloadEntryName(serviceEntry string, endpoint *istio.WorkloadEntry) string {
+	ports := make([]string, 0, len(endpoint.Ports))
+	for name, port := range endpoint.Ports {
+		ports = append(ports, fmt.Sprintf("%s=%d", name, port))
+	}
+	sort.Strings(ports)
+	suffix := "-" + nameHash(endpoint.Address+"|"+endpoint.Network+"|"+strings.Join(ports, ","))
+	return truncateName(serviceEntry, validation.DNS1123SubdomainMaxLength-len(suffix)) + suffix
+}
+
+// nameHash returns a short hash to make the names of resources unique
+func nameHash(s string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// truncateName truncates a name to a maximum length, the name must still end with an alphanumeric character
+func truncateName(name string, maxLength int) string {
+	if len(name) <= maxLength {
+		return name
+	}
+	return strings.TrimRight(name[:maxLength], "-.")
+}
+
+// pushWorkloadEntries synchronizes the WorkloadEntries of all the services to the API server
+func (s *Controller) pushWorkloadEntries(workloadEntries []*serviceregistry.ConfigWrapper) error {
+	ic, err := s.getIstioClient()
+	if err != nil {
+		return err
+	}
+	client := configClients["WorkloadEntry"]
+	existingConfigs, err := client.list(ic, s.listNamespace(), v1.ListOptions{
+		LabelSelector: "manager=" + constants.AerakiFieldManager + ", registry=consul",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list WorkloadEntries: %v", err)
+	}
+	oldConfigs := make(map[string]*istioConfig, len(existingConfigs))
+	for _, oldConfig := range existingConfigs {
+		oldConfigs[resourceKey(oldConfig.Namespace, oldConfig.Name)] = oldConfig
+	}
+
+	pushed, err := s.applyConfigs(ic, "WorkloadEntry", client, oldConfigs, workloadEntries)
+	s.workloadEntries = make(map[string]map[string]*istioConfig)
+	for key, workloadEntry := range pushed {
+		service := workloadEntry.Annotations[constants.ConsulServiceAnnotation]
+		if s.workloadEntries[service] == nil {
+			s.workloadEntries[service] = make(map[string]*istioConfig)
+		}
+		s.workloadEntries[service][key] = workloadEntry
+	}
+	return err
+}
+
+// pushServiceWorkloadEntries synchronizes the WorkloadEntries of a service to the API server, the WorkloadEntries of
+// the other services are left untouched
+func (s *Controller) pushServiceWorkloadEntries(service string,
+	workloadEntries []*serviceregistry.ConfigWrapper) error {
+	ic, err := s.getIstioClient()
+	if err != nil {
+		return err
+	}
+	if s.workloadEntries == nil {
+		s.workloadEntries = make(map[string]map[string]*istioConfig)
+	}
+	pushed, err := s.applyConfigs(ic, "WorkloadEntry", configClients["WorkloadEntry"], s.workloadEntries[service],
+		workloadEntries)
+	if len(pushed) == 0 {
+		delete(s.workloadEntries, service)
+	} else {
+		s.workloadEntries[service] = pushed
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	istio "istio.io/api/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/aeraki-framework/consul2istio/pkg/constants"
+	"github.com/aeraki-framework/consul2istio/pkg/serviceregistry"
+)
+
+func TestSplitWorkloadEntries(t *testing.T) {
+	static := &serviceregistry.ServiceEntryWrapper{
+		Service: "reviews",
+		Name:    "reviews.consul",
+		Spec: &istio.ServiceEntry{
+			Hosts:      []string{"reviews.consul"},
+			Ports:      []*istio.Port{{Number: 9080, Protocol: "HTTP", Name: "http"}},
+			Location:   istio.ServiceEntry_MESH_INTERNAL,
+			Resolution: istio.ServiceEntry_STATIC,
+			Endpoints: []*istio.WorkloadEntry{
+				{Address: "10.0.0.1", Labels: map[string]string{"version": "v1"}},
+				{Address: "10.0.0.2"},
+				{Address: "10.0.0.2"},
+			},
+		},
+	}
+	dns := &serviceregistry.ServiceEntryWrapper{
+		Service: "db",
+		Name:    "db.consul",
+		Spec: &istio.ServiceEntry{
+			Hosts:      []string{"db.consul"},
+			Location:   istio.ServiceEntry_MESH_INTERNAL,
+			Resolution: istio.ServiceEntry_DNS,
+			Endpoints:  []*istio.WorkloadEntry{{Address: "db.example.com"}},
+		},
+	}
+	serviceEntries, workloadEntries := splitWorkloadEntries([]*serviceregistry.ServiceEntryWrapper{static, dns})
+
+	// The DNS ServiceEntry keeps its endpoints, and the duplicated endpoint is dropped
+	if len(serviceEntries) != 2 || serviceEntries[1] != dns {
+		t.Fatalf("splitWorkloadEntries() => %v, want the DNS ServiceEntry untouched", serviceEntries)
+	}
+	selector := map[string]string{constants.WorkloadSelectorLabel: "reviews.consul"}
+	wantServiceEntry := proto.Clone(static.Spec).(*istio.ServiceEntry)
+	wantServiceEntry.Endpoints = nil
+	wantServiceEntry.WorkloadSelector = &istio.WorkloadSelector{Labels: selector}
+	if !proto.Equal(serviceEntries[0].Spec, wantServiceEntry) {
+		t.Errorf("splitWorkloadEntries() => %v, want %v", serviceEntries[0].Spec, wantServiceEntry)
+	}
+	if len(static.Spec.Endpoints) != 3 {
+		t.Errorf("splitWorkloadEntries() modifies the ServiceEntry")
+	}
+
+	if len(workloadEntries) != 2 {
+		t.Fatalf("splitWorkloadEntries() => %d WorkloadEntries, want 2", len(workloadEntries))
+	}
+	for _, workloadEntry := range workloadEntries {
+		spec := workloadEntry.Spec.(*istio.WorkloadEntry)
+		if workloadEntry.Kind() != "WorkloadEntry" || workloadEntry.Service != "reviews" ||
+			!strings.HasPrefix(workloadEntry.Name, "reviews.consul-") ||
+			spec.Labels[constants.WorkloadSelectorLabel] != "reviews.consul" {
+			t.Errorf("splitWorkloadEntries() => WorkloadEntry %s %v, want one selected by %v", workloadEntry.Name,
+				spec, selector)
+		}
+		if spec.Address == "10.0.0.1" && spec.Labels["version"] != "v1" {
+			t.Errorf("splitWorkloadEntries() => WorkloadEntry %v, want the labels of the endpoint", spec)
+		}
+	}
+	// The names are stable
+	_, again := splitWorkloadEntries([]*serviceregistry.ServiceEntryWrapper{static})
+	if len(again) != 2 {
+		t.Fatalf("splitWorkloadEntries() => %d WorkloadEntries, want 2", len(again))
+	}
+	if again[0].Name != workloadEntries[0].Name || again[1].Name != workloadEntries[1].Name {
+		t.Errorf("splitWorkloadEntries() => names %s %s, want %s %s", again[0].Name, again[1].Name,
+			workloadEntries[0].Name, workloadEntries[1].Name)
+	}
+}
+
+func TestWorkloadSelectorValue(t *testing.T) {
+	long := strings.Repeat("a", 60) + ".service.consul"
+	value := workloadSelectorValue(long)
+	if len(value) > validation.LabelValueMaxLength || len(validation.IsValidLabelValue(value)) > 0 {
+		t.Errorf("workloadSelectorValue(%s) => invalid label value %s", long, value)
+	}
+	if other := workloadSelectorValue(strings.Repeat("a", 60) + ".service.consul2"); other == value {
+		t.Errorf("workloadSelectorValue() => %s for two names, want different values", value)
+	}
+}